@@ -0,0 +1,108 @@
+package audio
+
+import "math"
+
+// biquad is a second order filter section with coefficients normalised so
+// the first feedback coefficient is one
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+}
+
+// biquadState is the last two inputs and outputs of a biquad on one channel
+type biquadState struct {
+	x1, x2, y1, y2 float64
+}
+
+func (f biquad) step(s *biquadState, x float64) float64 {
+	y := f.b0*x + f.b1*s.x1 + f.b2*s.x2 - f.a1*s.y1 - f.a2*s.y2
+	s.x2, s.x1 = s.x1, x
+	s.y2, s.y1 = s.y1, y
+	return y
+}
+
+// butterworth returns a Butterworth high or low pass section at cutoff Hz,
+// following the Audio EQ Cookbook
+func butterworth(cutoff float64, rate int, highPass bool) biquad {
+	w := 2 * math.Pi * cutoff / float64(rate)
+	alpha := math.Sin(w) / math.Sqrt2 // sin(w) / 2Q with Q = 1/sqrt(2)
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+	f := biquad{a1: -2 * cos / a0, a2: (1 - alpha) / a0}
+	if highPass {
+		f.b0 = (1 + cos) / 2 / a0
+		f.b1 = -(1 + cos) / a0
+	} else {
+		f.b0 = (1 - cos) / 2 / a0
+		f.b1 = (1 - cos) / a0
+	}
+	f.b2 = f.b0
+	return f
+}
+
+// BandPass keeps the frequencies between two cutoffs of interleaved samples,
+// remembering each channel's filter state from one buffer to the next. Each
+// cutoff is two Butterworth sections in series, falling off at 24 dB per
+// octave.
+type BandPass struct {
+	low, high biquad
+	states    [][4]biquadState
+	out       []int32
+}
+
+// NewBandPass passes low to high Hz of audio sampled at rate with the given
+// number of channels
+func NewBandPass(low, high float64, rate, channels int) *BandPass {
+	return &BandPass{
+		low:    butterworth(low, rate, true),
+		high:   butterworth(high, rate, false),
+		states: make([][4]biquadState, channels),
+	}
+}
+
+// Filter returns a filtered copy of in, which it does not change. The copy
+// is only valid until the next call.
+func (b *BandPass) Filter(in []int32) []int32 {
+	if cap(b.out) < len(in) {
+		b.out = make([]int32, len(in))
+	}
+	out := b.out[:len(in)]
+	for i, n := range in {
+		s := &b.states[i%len(b.states)]
+		y := b.low.step(&s[1], b.low.step(&s[0], float64(n)))
+		y = b.high.step(&s[3], b.high.step(&s[2], y))
+		out[i] = ClampSample(y)
+	}
+	return out
+}
+
+// PassFilter is a high or low pass filter of interleaved samples, two
+// Butterworth sections in series falling off at 24 dB per octave, keeping
+// each channel's state from one buffer to the next
+type PassFilter struct {
+	f      biquad
+	states [][2]biquadState
+}
+
+// NewHighPass removes frequencies below cutoff Hz of audio sampled at rate
+// with the given number of channels, such as rumble and handling noise
+func NewHighPass(cutoff float64, rate, channels int) *PassFilter {
+	return &PassFilter{f: butterworth(cutoff, rate, true), states: make([][2]biquadState, channels)}
+}
+
+// NewLowPass removes frequencies above cutoff Hz of audio sampled at rate
+// with the given number of channels, such as hiss
+func NewLowPass(cutoff float64, rate, channels int) *PassFilter {
+	return &PassFilter{f: butterworth(cutoff, rate, false), states: make([][2]biquadState, channels)}
+}
+
+// Process filters integer samples in place
+func (p *PassFilter) Process(samples []int32) []int32 {
+	return processInts(p, samples)
+}
+
+func (p *PassFilter) process(buf []float32) {
+	for i, v := range buf {
+		s := &p.states[i%len(p.states)]
+		buf[i] = float32(p.f.step(&s[1], p.f.step(&s[0], float64(v))))
+	}
+}
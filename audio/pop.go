@@ -0,0 +1,112 @@
+package audio
+
+import "math"
+
+// popFade is how many frames either side of a zeroed pop are faded, so
+// zeroing it does not leave a click of its own
+const popFade = 64
+
+// PopGuard holds back the opening of a recording to look for a pop or click,
+// such as the stream opening or the microphone being touched: a burst above
+// the threshold no longer than the maximum length, followed by quieter audio
+// to the end of the window. A longer loud stretch is taken for a legitimately
+// loud start and left alone. The pop is zeroed or removed and the held audio
+// released to be written.
+type PopGuard struct {
+	window    int // samples held before deciding
+	maxLength int // frames
+	threshold float64
+	channels  int
+	drop      bool
+	held      []int32
+	done      bool
+
+	// Removed counts the frames zeroed or removed
+	Removed int
+}
+
+// NewPopGuard holds window samples, taking a burst of at most maxLength
+// frames above threshold dBFS for a pop, and removes pops when drop is set
+// instead of zeroing them
+func NewPopGuard(window, maxLength, channels int, threshold float64, drop bool) *PopGuard {
+	return &PopGuard{
+		window:    window,
+		maxLength: maxLength,
+		threshold: DBToGain(threshold) * math.MaxInt32,
+		channels:  channels,
+		drop:      drop,
+	}
+}
+
+// Filter returns the samples to write for a buffer: nothing while the
+// opening is held, then all of it at once, and then each buffer as given
+func (g *PopGuard) Filter(in []int32) []int32 {
+	if g.done {
+		return in
+	}
+	g.held = append(g.held, in...)
+	if len(g.held) < g.window {
+		return nil
+	}
+	return g.Flush()
+}
+
+// Flush checks and returns whatever is held, for a recording that ends
+// before the window is full, and lets later audio straight through
+func (g *PopGuard) Flush() []int32 {
+	if g.done {
+		return nil
+	}
+	g.done = true
+	out := g.held
+	g.held = nil
+
+	first, last := -1, -1
+	for frame := 0; frame*g.channels < len(out); frame++ {
+		if g.loud(out[frame*g.channels : (frame+1)*g.channels]) {
+			if first < 0 {
+				first = frame
+			}
+			last = frame
+		}
+	}
+	if first < 0 || last-first+1 > g.maxLength || (last+1)*g.channels >= len(out) {
+		return out
+	}
+
+	g.Removed = last - first + 1
+	if g.drop {
+		return append(out[:first*g.channels], out[(last+1)*g.channels:]...)
+	}
+	for frame := first - popFade; frame <= last+popFade; frame++ {
+		if frame < 0 || frame*g.channels >= len(out) {
+			continue
+		}
+		gain := 0.0
+		if frame < first {
+			gain = float64(first-frame) / popFade
+		} else if frame > last {
+			gain = float64(frame-last) / popFade
+		}
+		for c := 0; c < g.channels; c++ {
+			i := frame*g.channels + c
+			out[i] = ClampSample(float64(out[i]) * gain)
+		}
+	}
+	return out
+}
+
+// Holding reports whether the opening is still being held back
+func (g *PopGuard) Holding() bool {
+	return !g.done
+}
+
+// loud reports whether any channel of a frame is above the threshold
+func (g *PopGuard) loud(frame []int32) bool {
+	for _, n := range frame {
+		if math.Abs(float64(n)) >= g.threshold {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,418 @@
+package audio
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Processor is one stage of a processing chain. Process may change samples
+// in place and returns the processed samples, which in a Processing must be
+// as many as it was given.
+type Processor interface {
+	Process(samples []int32) []int32
+}
+
+// FileProcessor is a stage that needs a whole recording before it can
+// change any of it, such as one scaling it to a peak level. Measure is given
+// every sample of the recording in order before Process is given them again.
+type FileProcessor interface {
+	Processor
+	Measure(samples []int32)
+}
+
+// floatProcessor is a stage working on float32 samples where 1 is full
+// scale, which a Processing runs without converting back to integers
+type floatProcessor interface {
+	process(buf []float32)
+}
+
+// processInts runs a floating point stage over integer samples in place
+func processInts(p floatProcessor, samples []int32) []int32 {
+	buf := make([]float32, len(samples))
+	for i, n := range samples {
+		buf[i] = float32(float64(n) / math.MaxInt32)
+	}
+	p.process(buf)
+	for i, v := range buf {
+		samples[i] = ClampSample(float64(v) * math.MaxInt32)
+	}
+	return samples
+}
+
+// Processing applies the input gain and then each stage in order to audio
+// before it is written. The built in stages work on float32 samples where 1
+// is full scale, so a boost in one stage can exceed full scale and be
+// brought back by a later one; samples are clamped only when converted back
+// to integers at the end, or for a stage that only works on integers.
+type Processing struct {
+	Gain   float64
+	Stages []Processor
+	buf    []float32
+
+	// Balance, when set, is a further gain for each channel of the
+	// interleaved input applied with Gain, evening out a hotter channel
+	Balance []float64
+
+	// clipped counts samples the input gain pushed past full scale since the
+	// last warning
+	clipped int
+	warned  time.Time
+}
+
+// Run modifies the buffer in place
+func (p *Processing) Run(in []int32) {
+	if p.Gain == 1 && len(p.Stages) == 0 && p.Balance == nil {
+		return
+	}
+
+	buf := p.floats(len(in))
+	for i, n := range in {
+		buf[i] = float32(float64(n) / math.MaxInt32)
+	}
+	p.run(buf, in)
+}
+
+// RunFloats processes samples read as float32, where 1 is full scale, into
+// in, so samples a device gives beyond full scale reach the gain and stages
+// instead of being clipped before them
+func (p *Processing) RunFloats(samples []float32, in []int32) {
+	buf := p.floats(len(samples))
+	copy(buf, samples)
+	p.run(buf, in)
+}
+
+// floats is the processing buffer, grown to n samples
+func (p *Processing) floats(n int) []float32 {
+	if cap(p.buf) < n {
+		p.buf = make([]float32, n)
+	}
+	return p.buf[:n]
+}
+
+// run applies the gain and stages to buf and writes the result to in
+func (p *Processing) run(buf []float32, in []int32) {
+	for i, v := range buf {
+		gain := p.Gain
+		if p.Balance != nil {
+			gain *= p.Balance[i%len(p.Balance)]
+		}
+		buf[i] = float32(float64(v) * gain)
+	}
+
+	for _, stage := range p.Stages {
+		if f, ok := stage.(floatProcessor); ok {
+			f.process(buf)
+			continue
+		}
+		for i, v := range buf {
+			in[i] = ClampSample(float64(v) * math.MaxInt32)
+		}
+		copy(in, stage.Process(in))
+		for i, n := range in {
+			buf[i] = float32(float64(n) / math.MaxInt32)
+		}
+	}
+
+	for i, v := range buf {
+		if (p.Gain != 1 || p.Balance != nil) && (v > 1 || v < -1) {
+			p.clipped++
+		}
+		in[i] = ClampSample(float64(v) * math.MaxInt32)
+	}
+
+	if p.clipped > 0 && time.Since(p.warned) > 10*time.Second {
+		log.Printf("[Gain] %d samples clipped, lower the input gain", p.clipped)
+		p.clipped = 0
+		p.warned = time.Now()
+	}
+}
+
+// ParseGain reads a gain given in dB, such as 6dB, or as a factor, such as 2
+func ParseGain(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if db := strings.TrimSuffix(strings.ToLower(s), "db"); len(db) < len(s) {
+		v, err := strconv.ParseFloat(strings.TrimSpace(db), 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad gain %q", s)
+		}
+		return DBToGain(v), nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("bad gain %q, give dB such as 6dB or a factor above 0", s)
+	}
+	return v, nil
+}
+
+// WrapOverflow makes ClampSample wrap an out of range sample around as
+// integer arithmetic would, which clicks loudly, instead of saturating it.
+// It is only for tracking down which stage overflows.
+var WrapOverflow bool
+
+// ClampSample converts a processed sample back to int32, saturating rather
+// than wrapping around when it is out of range unless WrapOverflow is set.
+// All processing that turns its results back into samples goes through it.
+func ClampSample(v float64) int32 {
+	if WrapOverflow {
+		return int32(int64(v))
+	}
+	if v > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	if v < math.MinInt32 {
+		return math.MinInt32
+	}
+	return int32(v)
+}
+
+// rms is the root mean square of a processing buffer relative to full scale
+func rms(buf []float32) float64 {
+	sum := float64(0)
+	for _, v := range buf {
+		sum += float64(v) * float64(v)
+	}
+	return math.Sqrt(sum / float64(len(buf)))
+}
+
+// DBToGain converts decibels to a gain factor
+func DBToGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// AutoGain moves the gain towards whatever brings the level to the target,
+// quickly when the audio gets louder and slowly when it gets quieter so it
+// does not pump. The gain is held while the input is silent so background
+// noise is never boosted.
+type AutoGain struct {
+	target  float64
+	maxGain float64
+	attack  int
+	release int
+	rate    int
+	silence float64
+	gain    float64
+}
+
+// NewAutoGain takes the target and maximum gain in dB, the attack and
+// release in milliseconds, the sample rate across all channels and the level
+// below which the input counts as silent
+func NewAutoGain(target float64, maxGain float64, attack int, release int, rate int, silence float64) *AutoGain {
+	return &AutoGain{
+		target:  DBToGain(target),
+		maxGain: DBToGain(maxGain),
+		attack:  attack,
+		release: release,
+		rate:    rate,
+		silence: silence,
+		gain:    1,
+	}
+}
+
+// smoothing is the fraction of the way to the wanted gain moved in one
+// buffer for a time constant of ms milliseconds
+func smoothing(ms int, samples int, rate int) float64 {
+	if ms <= 0 {
+		return 1
+	}
+	seconds := float64(samples) / float64(rate)
+	return 1 - math.Exp(-seconds*1000/float64(ms))
+}
+
+// Process applies the gain control to integer samples in place
+func (a *AutoGain) Process(samples []int32) []int32 {
+	return processInts(a, samples)
+}
+
+func (a *AutoGain) process(buf []float32) {
+	previous := a.gain
+	if Level(buf) >= a.silence {
+		wanted := math.Min(a.target/math.Max(rms(buf), 1e-9), a.maxGain)
+		if wanted < a.gain {
+			a.gain += (wanted - a.gain) * smoothing(a.attack, len(buf), a.rate)
+		} else {
+			a.gain += (wanted - a.gain) * smoothing(a.release, len(buf), a.rate)
+		}
+	}
+
+	// ramp across the buffer so gain changes do not step
+	for i, v := range buf {
+		gain := previous + (a.gain-previous)*float64(i+1)/float64(len(buf))
+		buf[i] = float32(float64(v) * gain)
+	}
+}
+
+// Limiter is a look-ahead brick wall limiter. Samples pass through a short
+// delay line so the gain can be lowered before a peak reaches the output,
+// then recovers over the release time. The delay carries across buffers,
+// so the output lags the input by the look-ahead time.
+type Limiter struct {
+	ceiling float64
+	delay   []float32
+	pos     int
+	gain    float64
+	release float64
+
+	// need is a ring of the gains needed by samples in the delay line, each
+	// lower than the ones before it, so the lowest is always at head
+	need  []limitNeed
+	head  int
+	count int
+	n     int
+}
+
+// limitNeed is the gain needed by the nth sample into a limiter
+type limitNeed struct {
+	n    int
+	gain float64
+}
+
+// NewLimiter takes the ceiling in dBFS, the look-ahead and release in
+// milliseconds and the sample rate across all channels
+func NewLimiter(ceiling float64, lookahead int, release int, rate int) *Limiter {
+	size := lookahead * rate / 1000
+	if size < 1 {
+		size = 1
+	}
+	l := &Limiter{
+		ceiling: DBToGain(ceiling),
+		delay:   make([]float32, size),
+		need:    make([]limitNeed, size),
+		gain:    1,
+		release: 1 - math.Exp(-1000/(math.Max(float64(release), 1)*float64(rate))),
+	}
+	return l
+}
+
+// required is the gain that brings a sample down to the ceiling
+func (l *Limiter) required(v float32) float64 {
+	peak := math.Abs(float64(v))
+	if peak <= l.ceiling {
+		return 1
+	}
+	return l.ceiling / peak
+}
+
+// lowest adds the gain needed by the sample entering the delay line and
+// returns the lowest gain needed by anything still in it
+func (l *Limiter) lowest(gain float64) float64 {
+	size := len(l.need)
+	l.n++
+	for l.count > 0 && l.need[l.head].n <= l.n-size {
+		l.head = (l.head + 1) % size
+		l.count--
+	}
+	for l.count > 0 && l.need[(l.head+l.count-1)%size].gain >= gain {
+		l.count--
+	}
+	l.need[(l.head+l.count)%size] = limitNeed{l.n, gain}
+	l.count++
+	return l.need[l.head].gain
+}
+
+// Process limits integer samples in place
+func (l *Limiter) Process(samples []int32) []int32 {
+	return processInts(l, samples)
+}
+
+func (l *Limiter) process(buf []float32) {
+	for i, v := range buf {
+		out := l.delay[l.pos]
+		l.delay[l.pos] = v
+		l.pos = (l.pos + 1) % len(l.delay)
+
+		target := l.lowest(l.required(v))
+		if target < l.gain {
+			l.gain -= (l.gain - target) / float64(len(l.delay))
+		} else {
+			l.gain += (target - l.gain) * l.release
+		}
+
+		buf[i] = float32(float64(out) * math.Min(l.gain, l.required(out)))
+	}
+}
+
+// NoiseGate zeroes audio while its level is below threshold, ramping the
+// gain per sample so the gate opens and closes without clicks
+type NoiseGate struct {
+	threshold   float64
+	attackStep  float64
+	releaseStep float64
+	gain        float64
+}
+
+// NewNoiseGate takes the threshold on the scale of Level, the attack and
+// release in milliseconds and the sample rate across all channels
+func NewNoiseGate(threshold float64, attack int, release int, rate int) *NoiseGate {
+	return &NoiseGate{
+		threshold:   threshold,
+		attackStep:  rampStep(attack, rate),
+		releaseStep: rampStep(release, rate),
+	}
+}
+
+// rampStep is the per sample gain change needed to ramp fully in ms milliseconds
+func rampStep(ms int, rate int) float64 {
+	if ms <= 0 {
+		return 1
+	}
+	return 1 / (float64(ms) * float64(rate) / 1000)
+}
+
+// Process gates integer samples in place
+func (g *NoiseGate) Process(samples []int32) []int32 {
+	return processInts(g, samples)
+}
+
+func (g *NoiseGate) process(buf []float32) {
+	target := float64(0)
+	if Level(buf) >= g.threshold {
+		target = 1
+	}
+
+	for i, v := range buf {
+		if g.gain < target {
+			g.gain = math.Min(g.gain+g.attackStep, target)
+		} else if g.gain > target {
+			g.gain = math.Max(g.gain-g.releaseStep, target)
+		}
+		buf[i] = float32(float64(v) * g.gain)
+	}
+}
+
+// Normalize scales a whole recording so its highest peak reaches a target
+// level, boosting by no more than a maximum so a recording of little but
+// background noise is not made loud
+type Normalize struct {
+	target  float64
+	maxGain float64
+	peak    float64
+}
+
+// NewNormalize takes the target peak in dBFS and the largest boost in dB
+func NewNormalize(target, maxGain float64) *Normalize {
+	return &Normalize{target: DBToGain(target), maxGain: DBToGain(maxGain)}
+}
+
+// Measure finds the highest peak
+func (n *Normalize) Measure(samples []int32) {
+	for _, s := range samples {
+		n.peak = math.Max(n.peak, math.Abs(float64(s)/math.MaxInt32))
+	}
+}
+
+// Process scales samples in place by the gain that brings the peak measured
+// to the target
+func (n *Normalize) Process(samples []int32) []int32 {
+	if n.peak == 0 {
+		return samples
+	}
+	gain := math.Min(n.target/n.peak, n.maxGain)
+	for i, s := range samples {
+		samples[i] = ClampSample(float64(s) * gain)
+	}
+	return samples
+}
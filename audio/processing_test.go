@@ -0,0 +1,58 @@
+package audio
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestLimiterLowest(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		size int
+	}{
+		{"one sample look-ahead", 1},
+		{"short delay line", 4},
+		{"long delay line", 441},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l := NewLimiter(-1, 1, 100, 1000)
+			l.need = make([]limitNeed, test.size)
+			r := rand.New(rand.NewSource(1))
+			var gains []float64
+			for i := 0; i < 5000; i++ {
+				gain := 1.0
+				if r.Intn(3) == 0 {
+					gain = r.Float64()
+				}
+				gains = append(gains, gain)
+
+				want := 1.0
+				for j := len(gains) - 1; j >= 0 && j >= len(gains)-test.size; j-- {
+					want = math.Min(want, gains[j])
+				}
+				if got := l.lowest(gain); got != want {
+					t.Fatalf("sample %d: lowest = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterCeiling(t *testing.T) {
+	ceiling := DBToGain(-6)
+	l := NewLimiter(-6, 5, 50, 44100)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		buf := make([]float32, 512)
+		for j := range buf {
+			buf[j] = float32(r.Float64()*2 - 1)
+		}
+		l.process(buf)
+		for j, v := range buf {
+			if math.Abs(float64(v)) > ceiling+1e-6 {
+				t.Fatalf("buffer %d sample %d: %v is over the ceiling %v", i, j, v, ceiling)
+			}
+		}
+	}
+}
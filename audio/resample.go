@@ -0,0 +1,142 @@
+package audio
+
+import (
+	"errors"
+	"math"
+)
+
+// ResampleQualities are the interpolations a Resampler can use, from the
+// cheapest to the most faithful, with how many input frames each output
+// frame is computed from when converting up in rate
+var ResampleQualities = map[string]int{
+	"linear":    2,
+	"cubic":     4,
+	"sinc-fast": 16,
+	"sinc-best": 64,
+}
+
+// Resampler converts interleaved audio from one sample rate to another a
+// frame at a time, keeping only the input frames its interpolation still
+// needs. Linear and cubic interpolation are cheap but let through aliases
+// of anything above the new Nyquist frequency when converting down; the
+// sinc modes low pass filter below it, over more frames for sinc-best.
+type Resampler struct {
+	step     float64 // input frames advanced per output frame
+	channels int
+	taps     int // input frames used on each side of an output frame
+	weight   func(x float64) float64
+	weights  []float64
+	frames   []float64 // interleaved input from frame base on
+	base     int
+	pos      float64 // input frame the next output frame falls on
+	ended    bool
+}
+
+// NewResampler converts audio with the given number of channels from one
+// rate to another using one of ResampleQualities
+func NewResampler(from, to float64, channels int, quality string) (*Resampler, error) {
+	if from <= 0 || to <= 0 {
+		return nil, errors.New("resample: sample rates must be positive")
+	}
+	taps, ok := ResampleQualities[quality]
+	if !ok {
+		return nil, errors.New("resample: unknown quality " + quality)
+	}
+	r := &Resampler{step: from / to, channels: channels, taps: taps / 2}
+
+	switch quality {
+	case "linear":
+		r.weight = func(x float64) float64 {
+			return math.Max(0, 1-math.Abs(x))
+		}
+	case "cubic":
+		// Catmull-Rom
+		r.weight = func(x float64) float64 {
+			x = math.Abs(x)
+			if x < 1 {
+				return 1.5*x*x*x - 2.5*x*x + 1
+			}
+			if x < 2 {
+				return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+			}
+			return 0
+		}
+	default:
+		// a Blackman windowed sinc cutting off at the lower Nyquist
+		// frequency, widened to keep its sharpness when converting down
+		cutoff := math.Min(1, to/from)
+		r.taps = int(math.Ceil(float64(r.taps) / cutoff))
+		width := float64(r.taps)
+		r.weight = func(x float64) float64 {
+			if math.Abs(x) >= width {
+				return 0
+			}
+			window := 0.42 + 0.5*math.Cos(math.Pi*x/width) + 0.08*math.Cos(2*math.Pi*x/width)
+			if x == 0 {
+				return cutoff * window
+			}
+			return math.Sin(math.Pi*cutoff*x) / (math.Pi * x) * window
+		}
+	}
+	r.weights = make([]float64, 2*r.taps)
+	return r, nil
+}
+
+// buffered is how many input frames are held
+func (r *Resampler) buffered() int {
+	return len(r.frames) / r.channels
+}
+
+// Need reports whether another input frame must be written before Next
+func (r *Resampler) Need() bool {
+	return !r.ended && int(r.pos)+r.taps >= r.base+r.buffered()
+}
+
+// Write adds the next input frame
+func (r *Resampler) Write(frame []int32) {
+	for _, n := range frame {
+		r.frames = append(r.frames, float64(n))
+	}
+}
+
+// End marks the input finished, so frames past it count as silence
+func (r *Resampler) End() {
+	r.ended = true
+}
+
+// Next fills out with the next output frame, returning false once the
+// input is used up
+func (r *Resampler) Next(out []int32) bool {
+	if r.ended && r.pos >= float64(r.base+r.buffered()) {
+		return false
+	}
+
+	first := int(r.pos) - r.taps + 1
+	total := 0.0
+	for t := range r.weights {
+		r.weights[t] = r.weight(r.pos - float64(first+t))
+		total += r.weights[t]
+	}
+	if total == 0 {
+		total = 1
+	}
+	for c := range out {
+		sum := 0.0
+		for t, w := range r.weights {
+			if j := first + t - r.base; j >= 0 && j < r.buffered() {
+				sum += r.frames[j*r.channels+c] * w
+			}
+		}
+		// dividing by the weights' sum keeps a constant level where the
+		// kernel's weights do not quite add up to one
+		out[c] = ClampSample(sum / total)
+	}
+	r.pos += r.step
+
+	// drop what no later output frame reaches, in batches to save copying
+	if drop := int(r.pos) - r.taps + 1 - r.base; drop >= 1024 && drop <= r.buffered() {
+		r.frames = append(r.frames[:0], r.frames[drop*r.channels:]...)
+		r.base += drop
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+// Package audio measures and processes interleaved int32 samples, where the
+// full int32 range is full scale.
+package audio
+
+import "math"
+
+// Level is the scaled RMS of a processing buffer used for silence and gate
+// decisions
+func Level(buf []float32) float64 {
+	sum := float64(0)
+	for _, v := range buf {
+		sum += scaledSquare(float64(v))
+	}
+	return math.Sqrt(sum / float64(len(buf)))
+}
+
+// SquareLevel is the square of a sample on the scale of Level
+func SquareLevel(n int32) float64 {
+	return scaledSquare(float64(n) / math.MaxInt32)
+}
+
+// scaledSquare squares a sample relative to full scale after scaling it so
+// that -20 dBFS and above count as full level
+func scaledSquare(x float64) float64 {
+	return math.Pow(math.Min(math.Abs(x)/0.1, 1), 2)
+}
+
+// LevelFromDB converts a level in dBFS to the scale of Level, where full
+// scale is reached at -20 dBFS
+func LevelFromDB(db float64) float64 {
+	return math.Pow(10, db/20) / 0.1
+}
+
+// SilenceDetector decides silence from the level of the last few buffers
+// combined, as a single buffer is short enough for a zero crossing to look
+// silent. Each channel of an interleaved buffer is measured separately and
+// the buffer is silent when all of them are quiet, or any of them if anyQuiet
+// is set.
+type SilenceDetector struct {
+	// Band, when set, filters the copy of each buffer that is measured so
+	// steady noise outside the band does not hold off silence
+	Band *BandPass
+
+	sums      [][]float64
+	frames    []int
+	pos       int
+	channels  int
+	anyQuiet  bool
+	threshold float64
+}
+
+// NewSilenceDetector judges silence over window buffers against a threshold
+// on the scale of Level
+func NewSilenceDetector(window int, channels int, anyQuiet bool, threshold float64) *SilenceDetector {
+	if window < 1 {
+		window = 1
+	}
+	d := &SilenceDetector{frames: make([]int, window), channels: channels, anyQuiet: anyQuiet, threshold: threshold}
+	for i := 0; i < window; i++ {
+		d.sums = append(d.sums, make([]float64, channels))
+	}
+	return d
+}
+
+// IsSilent adds a buffer to the window and reports whether the window is
+// silent
+func (d *SilenceDetector) IsSilent(in []int32) bool {
+	if d.Band != nil {
+		in = d.Band.Filter(in)
+	}
+	sums := d.sums[d.pos]
+	for c := range sums {
+		sums[c] = 0
+	}
+	for i, n := range in {
+		sums[i%d.channels] += SquareLevel(n)
+	}
+	d.frames[d.pos] = len(in) / d.channels
+	d.pos = (d.pos + 1) % len(d.sums)
+
+	frames := 0
+	for _, n := range d.frames {
+		frames += n
+	}
+
+	quiet := 0
+	for c := 0; c < d.channels; c++ {
+		sum := float64(0)
+		for i := range d.sums {
+			sum += d.sums[i][c]
+		}
+		if math.Sqrt(sum/float64(frames)) < d.threshold {
+			quiet++
+		}
+	}
+
+	if d.anyQuiet {
+		return quiet > 0
+	}
+	return quiet == d.channels
+}
+
+// SilenceCompressor shortens each silence longer than after samples to gap
+// samples. Silence past the gap is held back until it is known whether the
+// silence will run past after: if sound returns first the held samples are
+// written, otherwise they are dropped along with the rest of the silence.
+type SilenceCompressor struct {
+	after, gap int
+	run        int
+	held       []int32
+
+	// Saved counts the samples left out
+	Saved int
+}
+
+// NewSilenceCompressor takes both lengths in samples
+func NewSilenceCompressor(after, gap int) *SilenceCompressor {
+	return &SilenceCompressor{after: after, gap: gap}
+}
+
+// Filter returns the samples to write for a buffer
+func (c *SilenceCompressor) Filter(in []int32, silent bool) []int32 {
+	if !silent {
+		out := append(c.held, in...)
+		c.held = c.held[:0]
+		c.run = 0
+		return out
+	}
+
+	c.run += len(in)
+	switch {
+	case c.run <= c.gap:
+		return in
+	case c.run <= c.after:
+		c.held = append(c.held, in...)
+	default:
+		c.Saved += len(c.held) + len(in)
+		c.held = c.held[:0]
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+// constant is n interleaved samples all at level, a fraction of full scale
+func constant(n int, level float64) []int32 {
+	samples := make([]int32, n)
+	for i := range samples {
+		samples[i] = int32(level * math.MaxInt32)
+	}
+	return samples
+}
+
+func TestLevel(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		buf  []float32
+		want float64
+	}{
+		{"silence", []float32{0, 0, 0, 0}, 0},
+		{"-20 dBFS is full level", []float32{0.1, -0.1}, 1},
+		{"louder is still full level", []float32{1, -0.5}, 1},
+		{"-40 dBFS", []float32{0.01, -0.01}, 0.1},
+		{"half the buffer at -20 dBFS", []float32{0.1, 0}, math.Sqrt(0.5)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Level(test.buf); math.Abs(got-test.want) > 1e-6 {
+				t.Errorf("Level(%v) = %v, want %v", test.buf, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLevelFromDB(t *testing.T) {
+	for _, test := range []struct {
+		db   float64
+		want float64
+	}{
+		{-20, 1},
+		{-40, 0.1},
+		{0, 10},
+	} {
+		if got := LevelFromDB(test.db); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("LevelFromDB(%v) = %v, want %v", test.db, got, test.want)
+		}
+	}
+}
+
+func TestSilenceDetector(t *testing.T) {
+	quiet, loud := 0.001, 0.5
+	threshold := LevelFromDB(-50)
+	for _, test := range []struct {
+		name     string
+		window   int
+		anyQuiet bool
+		levels   [][2]float64 // the level of each channel in each buffer
+		want     []bool
+	}{
+		{"quiet buffers", 1, false, [][2]float64{{quiet, quiet}, {quiet, quiet}}, []bool{true, true}},
+		{"loud buffers", 1, false, [][2]float64{{loud, loud}}, []bool{false}},
+		{"one loud channel holds off silence", 1, false, [][2]float64{{loud, quiet}}, []bool{false}},
+		{"one quiet channel is silence with anyQuiet", 1, true, [][2]float64{{loud, quiet}}, []bool{true}},
+		{"a loud buffer stays in the window", 3, false,
+			[][2]float64{{loud, loud}, {quiet, quiet}, {quiet, quiet}, {quiet, quiet}},
+			[]bool{false, false, false, true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewSilenceDetector(test.window, 2, test.anyQuiet, threshold)
+			for i, levels := range test.levels {
+				buf := make([]int32, 64)
+				for j := range buf {
+					buf[j] = constant(1, levels[j%2])[0]
+				}
+				if got := d.IsSilent(buf); got != test.want[i] {
+					t.Errorf("buffer %d: IsSilent = %v, want %v", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSilenceCompressor(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		silent    []bool
+		wantLens  []int
+		wantSaved int
+	}{
+		{"sound passes", []bool{false, false}, []int{4, 4}, 0},
+		{"a short silence is kept", []bool{true, true, false}, []int{4, 0, 8}, 0},
+		{"a long silence is cut to the gap", []bool{true, true, true, true, false}, []int{4, 0, 0, 0, 4}, 12},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewSilenceCompressor(8, 4)
+			for i, silent := range test.silent {
+				if got := len(c.Filter(constant(4, 0), silent)); got != test.wantLens[i] {
+					t.Errorf("buffer %d: %d samples written, want %d", i, got, test.wantLens[i])
+				}
+			}
+			if c.Saved != test.wantSaved {
+				t.Errorf("Saved = %d, want %d", c.Saved, test.wantSaved)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package audio
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"math/cmplx"
+)
+
+// SpectrogramRange is how many dB below the loudest point of a spectrogram
+// still shows above black
+const SpectrogramRange = 90
+
+// Windows are the window functions a spectrogram can apply to each FFT frame
+var Windows = map[string]func(i, n int) float64{
+	"rectangular": func(i, n int) float64 { return 1 },
+	"hann": func(i, n int) float64 {
+		return 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	},
+	"hamming": func(i, n int) float64 {
+		return 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	},
+	"blackman": func(i, n int) float64 {
+		x := 2 * math.Pi * float64(i) / float64(n-1)
+		return 0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2*x)
+	},
+}
+
+// Spectrogram runs a short-time Fourier transform over a known number of
+// frames as they are added, one FFT per image column spread evenly over the
+// frames, so only the image and one FFT frame are held in memory. Rows
+// cover the frequencies from 20 Hz, or the lowest FFT bin above it, up to
+// half the sample rate on a log scale.
+type Spectrogram struct {
+	frames, fftSize int
+	width, height   int
+	rate            int
+	window          []float64
+	ring            []float64
+	added           int
+	columns         [][]float64 // dB of each row, lowest frequency first
+}
+
+// NewSpectrogram starts a width by height spectrogram of frames mono frames
+// sampled at rate. fftSize must be a power of two and window one of Windows.
+func NewSpectrogram(frames, rate, fftSize int, window string, width, height int) (*Spectrogram, error) {
+	if fftSize < 2 || fftSize&(fftSize-1) != 0 {
+		return nil, errors.New("spectrogram: FFT size must be a power of two")
+	}
+	w, ok := Windows[window]
+	if !ok {
+		return nil, errors.New("spectrogram: unknown window " + window)
+	}
+	if width < 1 || height < 1 {
+		return nil, errors.New("spectrogram: width and height must be positive")
+	}
+	s := &Spectrogram{frames: frames, fftSize: fftSize, width: width, height: height, rate: rate, ring: make([]float64, fftSize)}
+	for i := 0; i < fftSize; i++ {
+		s.window = append(s.window, w(i, fftSize))
+	}
+	return s, nil
+}
+
+// end is the frame count at which column c's FFT frame is complete
+func (s *Spectrogram) end(c int) int {
+	start := 0
+	if s.width > 1 && s.frames > s.fftSize {
+		start = c * (s.frames - s.fftSize) / (s.width - 1)
+	}
+	return start + s.fftSize
+}
+
+// Add takes the next frame, mixed to mono
+func (s *Spectrogram) Add(frame float64) {
+	s.ring[s.added%s.fftSize] = frame
+	s.added++
+	for len(s.columns) < s.width && s.added == s.end(len(s.columns)) {
+		s.columns = append(s.columns, s.column())
+	}
+}
+
+// column transforms the last fftSize frames added and sums the magnitudes
+// falling in each row
+func (s *Spectrogram) column() []float64 {
+	x := make([]complex128, s.fftSize)
+	for i := range x {
+		x[i] = complex(s.ring[(s.added+i)%s.fftSize]*s.window[i], 0)
+	}
+	fft(x)
+
+	lowest := math.Max(20, float64(s.rate)/float64(s.fftSize))
+	nyquist := float64(s.rate) / 2
+	binWidth := float64(s.rate) / float64(s.fftSize)
+	rows := make([]float64, s.height)
+	for r := range rows {
+		lo := lowest * math.Pow(nyquist/lowest, float64(r)/float64(s.height))
+		hi := lowest * math.Pow(nyquist/lowest, float64(r+1)/float64(s.height))
+		// rows narrower than a bin take the bin they fall in
+		first, last := int(lo/binWidth), int(hi/binWidth)
+		if last <= first {
+			last = first + 1
+		}
+		power := 0.0
+		for b := first; b < last && b <= s.fftSize/2; b++ {
+			power += math.Pow(cmplx.Abs(x[b]), 2)
+		}
+		rows[r] = 10 * math.Log10(power+1e-20)
+	}
+	return rows
+}
+
+// Image finishes the spectrogram, padding it with silence if fewer frames
+// were added than promised, and draws it with the loudest point white
+func (s *Spectrogram) Image() *image.RGBA {
+	for len(s.columns) < s.width {
+		s.Add(0)
+	}
+
+	peak := math.Inf(-1)
+	for _, col := range s.columns {
+		for _, db := range col {
+			peak = math.Max(peak, db)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	for x, col := range s.columns {
+		for r, db := range col {
+			level := 1 - (peak-db)/SpectrogramRange
+			img.Set(x, s.height-1-r, heat(math.Max(0, math.Min(1, level))))
+		}
+	}
+	return img
+}
+
+// heat maps a level from 0 to 1 onto black, blue, red, yellow and white
+func heat(level float64) color.RGBA {
+	stops := []color.RGBA{{0, 0, 0, 255}, {0, 0, 160, 255}, {200, 0, 60, 255}, {255, 200, 0, 255}, {255, 255, 255, 255}}
+	pos := level * float64(len(stops)-1)
+	i := int(pos)
+	if i >= len(stops)-1 {
+		return stops[len(stops)-1]
+	}
+	f := pos - float64(i)
+	mix := func(a, b uint8) uint8 { return uint8(float64(a) + f*(float64(b)-float64(a))) }
+	a, b := stops[i], stops[i+1]
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
+
+// fft transforms x in place with an iterative radix-2 Cooley-Tukey FFT.
+// len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package audio
+
+import "math"
+
+// toneFade is how long in seconds a tone fades in and out, short enough to
+// keep its start sharp for lining up recordings but long enough not to click
+const toneFade = 0.002
+
+// Tone returns frames of a sine wave at freq Hz and level dBFS, the same on
+// every channel, as a reference tone at the start of a recording
+func Tone(freq, level float64, frames, rate, channels int) []int32 {
+	out := make([]int32, frames*channels)
+	amplitude := DBToGain(level) * math.MaxInt32
+	fade := toneFade * float64(rate)
+	for frame := 0; frame < frames; frame++ {
+		gain := math.Min(1, math.Min(float64(frame), float64(frames-1-frame))/fade)
+		n := ClampSample(amplitude * gain * math.Sin(2*math.Pi*freq*float64(frame)/float64(rate)))
+		for c := 0; c < channels; c++ {
+			out[frame*channels+c] = n
+		}
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+// Package clip records short clips from the default input device entirely
+// in memory, for programs embedding the recorder rather than running it.
+package clip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/1hitsong/Go-Record-Audio/encode"
+	"github.com/1hitsong/Go-Record-Audio/recorder"
+	"github.com/gordonklaus/portaudio"
+)
+
+// Format is what clips are recorded as, a 16 bit mono WAV at 44100 Hz
+// unless changed
+var Format = recorder.Format{Container: "wav", Channels: 1, SampleRate: 44100, BitDepth: 16}
+
+// Encoder, when set, encodes each clip at Bitrate kbps through a pipe so
+// RecordToBytes returns the encoded file rather than the recording
+var Encoder *encode.Encoder
+
+// Bitrate is the bitrate in kbps clips are encoded at
+var Bitrate = "128"
+
+// framesPerBuffer is how many frames each read of the device returns,
+// which is also how often a cancelled context is noticed
+const framesPerBuffer = 64
+
+// RecordToBytes records from the default input device for duration, or
+// until ctx is done, and returns the finished recording in Format, or
+// encoded when Encoder is set. A clip cut short by ctx is still returned,
+// along with ctx's error.
+func RecordToBytes(ctx context.Context, duration time.Duration) ([]byte, error) {
+	buf := &recorder.Buffer{}
+	stopped := RecordTo(ctx, duration, buf)
+	if stopped != nil && stopped != ctx.Err() {
+		return nil, stopped
+	}
+
+	out := buf.Bytes()
+	if Encoder != nil {
+		var err error
+		if out, err = encodeClip(out); err != nil {
+			return nil, err
+		}
+	}
+	return out, stopped
+}
+
+// RecordTo records from the default input device for duration, or until
+// ctx is done, into w in Format and closes it, for sending a clip to a
+// destination of the caller's own, such as one a recorder.Opener creates.
+// A clip cut short by ctx is still finished, and ctx's error returned.
+func RecordTo(ctx context.Context, duration time.Duration, w recorder.Writer) error {
+	if duration <= 0 {
+		w.Close()
+		return errors.New("clip: duration must be positive")
+	}
+	r, err := recorder.New(w, Format)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	nSamples, stopped := capture(ctx, duration, r)
+	if stopped != nil && stopped != ctx.Err() {
+		w.Close()
+		return stopped
+	}
+	if err = r.Close(nSamples); err != nil {
+		return err
+	}
+	return stopped
+}
+
+// capture reads the default input device into r, returning the number of
+// samples written, and ctx's error when it ended the clip early
+func capture(ctx context.Context, duration time.Duration, r *recorder.Recording) (int, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return 0, err
+	}
+	defer portaudio.Terminate()
+
+	in := make([]int32, framesPerBuffer*Format.Channels)
+	stream, err := portaudio.OpenDefaultStream(Format.Channels, 0, float64(Format.SampleRate), framesPerBuffer, in)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	if err = stream.Start(); err != nil {
+		return 0, err
+	}
+	defer stream.Stop()
+
+	want := int(duration.Seconds()*float64(Format.SampleRate)) * Format.Channels
+	nSamples := 0
+	for nSamples < want {
+		select {
+		case <-ctx.Done():
+			return nSamples, ctx.Err()
+		default:
+		}
+		// an overflow lost audio before this buffer, but the buffer is good
+		if err := stream.Read(); err != nil && err != portaudio.InputOverflowed {
+			return 0, err
+		}
+		samples := in
+		if want-nSamples < len(samples) {
+			samples = samples[:want-nSamples]
+		}
+		if err := r.WriteSamples(samples); err != nil {
+			return 0, err
+		}
+		nSamples += len(samples)
+	}
+	return nSamples, nil
+}
+
+// encodeClip pipes a finished recording through the encoder
+func encodeClip(recording []byte) ([]byte, error) {
+	cmd := Encoder.Pipe(Bitrate)
+	cmd.Stdin = bytes.NewReader(recording)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if messages, err := encode.Run(cmd, nil); err != nil {
+		return nil, fmt.Errorf("clip: %s: %v %s", cmd.Path, err, messages)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,308 @@
+// Package config holds the recorder's settings, read from config.yml and
+// environment variables.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a application configuration structure
+type Config struct {
+	SilenceDetection struct {
+		Delayatstartofcapture int           `yaml:"delayatstartofcapture" env:"SilenceDelay" env-description:"Seconds to wait at start of capture before listening for silence" env-default:"5"`
+		WaitForSound          bool          `yaml:"waitforsound" env:"WaitForSound" env-description:"In endless mode, create the first recording only once sound is heard instead of straight away" env-default:"false"`
+		DiscardDelay          bool          `yaml:"discarddelay" env:"DiscardDelay" env-description:"Treat the start delay as a warm-up whose audio is processed but not recorded" env-default:"false"`
+		Threshold             float64       `yaml:"threshold" env:"SilenceThreshold" env-description:"Level in dBFS below which audio counts as silence" env-default:"-100"`
+		LinearThreshold       bool          `yaml:"linearthreshold" env:"SilenceLinearThreshold" env-description:"Read the threshold as the old linear level, such as 0.0001, instead of dBFS" env-default:"false"`
+		Trim                  bool          `yaml:"trim" env:"SilenceTrim" env-description:"Trim the silence around split points from each segment" env-default:"true"`
+		Window                int           `yaml:"window" env:"SilenceWindow" env-description:"Number of 64 sample buffers whose combined level decides silence" env-default:"1"`
+		Channels              string        `yaml:"channels" env:"SilenceChannels" env-description:"With more than one channel, whether all or any channel must be quiet for silence" env-default:"all"`
+		NoSplit               bool          `yaml:"nosplit" env:"NoSplit" env-description:"Keep recording one file when silence is detected" env-default:"false"`
+		MarkSplits            bool          `yaml:"marksplits" env:"MarkSplits" env-description:"Write a cue sheet of where silence would have split a no-split recording" env-default:"false"`
+		MarkerInterval        time.Duration `yaml:"markerinterval" env:"MarkerInterval" env-description:"Add a numbered marker to the cue sheet every interval, 0 for none" env-default:"0s"`
+		RepeatedSilence       string        `yaml:"repeatedsilence" env:"RepeatedSilence" env-description:"In endless mode, what silence straight after a split does: discard stops and deletes the new segment, keep stops and keeps it, continue never stops" env-default:"discard"`
+		StopAfter             int           `yaml:"stopafter" env:"SilenceStopAfter" env-description:"Seconds the silence after a split must last, beyond the start delay, before endless mode stops" env-default:"0"`
+		MaxSilenceFiles       int           `yaml:"maxsilencefiles" env:"MaxSilenceFiles" env-description:"In endless mode, stop after this many segments in a row split off on silence with less than shortsegment of sound, 0 for no limit" env-default:"0"`
+		ShortSegment          time.Duration `yaml:"shortsegment" env:"ShortSegment" env-description:"Sound a segment needs to not count towards maxsilencefiles" env-default:"2s"`
+		Compress              bool          `yaml:"compress" env:"CompressSilence" env-description:"Shorten long silences to a short gap instead of splitting, keeping one continuous file" env-default:"false"`
+		CompressAfter         time.Duration `yaml:"compressafter" env:"CompressAfter" env-description:"Silence longer than this is shortened when compressing" env-default:"3s"`
+		Band                  bool          `yaml:"band" env:"SilenceBand" env-description:"Measure silence only between bandlow and bandhigh so steady hum or hiss outside the band does not prevent it; recordings are not filtered" env-default:"false"`
+		BandLow               float64       `yaml:"bandlow" env:"SilenceBandLow" env-description:"Lowest frequency in Hz measured for silence when band limited" env-default:"300"`
+		BandHigh              float64       `yaml:"bandhigh" env:"SilenceBandHigh" env-description:"Highest frequency in Hz measured for silence when band limited" env-default:"3400"`
+		CompressGap           time.Duration `yaml:"compressgap" env:"CompressGap" env-description:"Silence kept in place of each long silence when compressing" env-default:"1s"`
+	} `yaml:"silencedetection"`
+	Encode struct {
+		Bitrate         string        `yaml:"bitrate" env:"BitRate" env-description:"Bitrate to encode the resulting MP3 at"`
+		Bitrates        string        `yaml:"bitrates" env:"BitRates" env-description:"Comma separated bitrates to encode each recording at instead of the single bitrate, each MP3 named with its bitrate"`
+		Auto            bool          `yaml:"auto" env:"AutoEncode" env-description:"Encode each recording as it finishes; false keeps the AIFF to encode later with the encode command" env-default:"true"`
+		Encoder         string        `yaml:"encoder" env:"Encoder" env-description:"Program that encodes recordings, lame or ffmpeg" env-default:"lame"`
+		Format          string        `yaml:"format" env:"EncodeFormat" env-description:"Extension of encoded files, which chooses the codec: mp3, or with ffmpeg also m4a, ogg, opus or flac" env-default:"mp3"`
+		DefaultArtist   string        `yaml:"defaultartist" env:"DefaultArtist" env-description:"Default value to use if Artist is not specified"`
+		DefaultTitle    string        `yaml:"defaulttitle" env:"DefaultTitle" env-description:"Default value to use if Title is not specified"`
+		Workers         int           `yaml:"workers" env:"EncodeWorkers" env-description:"Number of encodes run at once, by the encode command and in the background while recording, 0 uses one per CPU" env-default:"0"`
+		Playlist        string        `yaml:"playlist" env:"Playlist" env-description:"JSON or CSV file giving the artist and title of each segment by index or start time"`
+		KeepGoing       bool          `yaml:"continueonerror" env:"ContinueOnEncodeError" env-description:"In endless and retro mode, log a failed encode and keep its recording instead of exiting" env-default:"false"`
+		Preview         time.Duration `yaml:"preview" env:"Preview" env-description:"Length of a low bitrate preview encoded from the start of each recording alongside the full file, 0 for none" env-default:"0s"`
+		PreviewBitrate  string        `yaml:"previewbitrate" env:"PreviewBitRate" env-description:"Bitrate previews are encoded at" env-default:"64"`
+		Chapters        bool          `yaml:"chapters" env:"Chapters" env-description:"With ffmpeg, embed a chapter at each marker, or at each split point of a no-split recording, instead of splitting" env-default:"false"`
+		ChapterFile     string        `yaml:"chapterfile" env:"ChapterFile" env-description:"File of chapter start times and names, one per line such as 12:30 Questions, embedded in each file encoded with ffmpeg"`
+		TargetSize      string        `yaml:"targetsize" env:"TargetSize" env-description:"Largest size of each encoded file, such as 25MB, from which its bitrate is chosen by its length in place of the bitrate; empty to use the bitrate"`
+		Verify          bool          `yaml:"verify" env:"VerifyEncode" env-description:"Decode each encoded file back and check it lasts as long as the recording before the recording is removed" env-default:"false"`
+		Nice            int           `yaml:"nice" env:"EncodeNice" env-description:"Niceness from 0 to 19 the encoder runs at so it yields the CPU to recording; on Windows 1 to 14 is below normal priority and 15 up is idle" env-default:"0"`
+		Log             string        `yaml:"log" env:"EncodeLog" env-description:"File each encoder run's command line, output and exit status is appended to; empty for none"`
+		Retries         int           `yaml:"retries" env:"EncodeRetries" env-description:"Times a failed encode is run again on the kept recording before giving up" env-default:"0"`
+		RetryDelay      time.Duration `yaml:"retrydelay" env:"EncodeRetryDelay" env-description:"Wait before the first encode retry, doubled before each one after" env-default:"5s"`
+		ShutdownTimeout time.Duration `yaml:"shutdowntimeout" env:"ShutdownTimeout" env-description:"How long to wait on exit for background encodes and uploads before abandoning them, 0 to wait for as long as they take" env-default:"5m"`
+	} `yaml:"encode"`
+	Tags struct {
+		Retag       bool   `yaml:"retag" env:"Retag" env-description:"Rewrite the tags of each encoded file with the artist, title and the fields below after encoding, as an ID3v2 tag in MP3s and Vorbis comments in FLAC, Ogg and Opus files" env-default:"false"`
+		Album       string `yaml:"album" env:"TagAlbum" env-description:"Album name"`
+		AlbumArtist string `yaml:"albumartist" env:"TagAlbumArtist" env-description:"Album artist"`
+		Composer    string `yaml:"composer" env:"TagComposer" env-description:"Composer"`
+		Comment     string `yaml:"comment" env:"TagComment" env-description:"Comment"`
+		Provenance  bool   `yaml:"provenance" env:"Provenance" env-description:"Tag each encoded file with a comment naming the input device, machine and version it was recorded with and when" env-default:"false"`
+		TrackTotal  int    `yaml:"tracktotal" env:"TagTrackTotal" env-description:"Total number of tracks given after each segment's track number, 0 to leave it out" env-default:"0"`
+		Cover       string `yaml:"cover" env:"TagCover" env-description:"JPEG or PNG image embedded as the front cover"`
+	} `yaml:"tags"`
+	Location struct {
+		Latitude  string `yaml:"latitude" env:"Latitude" env-description:"Latitude in decimal degrees written to each encoded file, empty for none"`
+		Longitude string `yaml:"longitude" env:"Longitude" env-description:"Longitude in decimal degrees written to each encoded file, empty for none"`
+		Command   string `yaml:"command" env:"GPSCommand" env-description:"Command run as each recording starts that prints the current latitude and longitude, used instead of the fixed coordinates"`
+		Sidecar   bool   `yaml:"sidecar" env:"LocationSidecar" env-description:"Also write the location to a .geojson file beside each encoded file" env-default:"false"`
+	} `yaml:"location"`
+	Gate struct {
+		Enabled   bool    `yaml:"enabled" env:"Gate" env-description:"Silence audio whose level falls below the gate threshold" env-default:"false"`
+		Threshold float64 `yaml:"threshold" env:"GateThreshold" env-description:"Level below which the gate closes" env-default:"0.0001"`
+		Attack    int     `yaml:"attack" env:"GateAttack" env-description:"Milliseconds taken to open the gate" env-default:"5"`
+		Release   int     `yaml:"release" env:"GateRelease" env-description:"Milliseconds taken to close the gate" env-default:"150"`
+	} `yaml:"gate"`
+	AGC struct {
+		Enabled bool    `yaml:"enabled" env:"AGC" env-description:"Continuously adjust gain to keep the level near the target" env-default:"false"`
+		Target  float64 `yaml:"target" env:"AGCTarget" env-description:"RMS level in dBFS the gain control aims for" env-default:"-20"`
+		MaxGain float64 `yaml:"maxgain" env:"AGCMaxGain" env-description:"Largest boost in dB the gain control may apply" env-default:"20"`
+		Attack  int     `yaml:"attack" env:"AGCAttack" env-description:"Milliseconds taken to reduce gain when audio gets louder" env-default:"20"`
+		Release int     `yaml:"release" env:"AGCRelease" env-description:"Milliseconds taken to raise gain when audio gets quieter" env-default:"1000"`
+	} `yaml:"agc"`
+	Limiter struct {
+		Enabled   bool    `yaml:"enabled" env:"Limiter" env-description:"Keep peaks below the ceiling so loud transients do not clip" env-default:"false"`
+		Ceiling   float64 `yaml:"ceiling" env:"LimiterCeiling" env-description:"Highest peak level in dBFS the limiter lets through" env-default:"-0.5"`
+		Lookahead int     `yaml:"lookahead" env:"LimiterLookahead" env-description:"Milliseconds the limiter looks ahead, which also delays the audio" env-default:"2"`
+		Release   int     `yaml:"release" env:"LimiterRelease" env-description:"Milliseconds taken to recover after a peak" env-default:"100"`
+	} `yaml:"limiter"`
+	Processing struct {
+		Chain            []string           `yaml:"chain" env:"ProcessingChain" env-separator:"," env-description:"Processing stages run in order, from highpass, lowpass, gate, agc, limiter and normalize; when empty the gate, agc and limiter run in that order when enabled"`
+		HighPass         float64            `yaml:"highpass" env:"HighPass" env-description:"Cutoff in Hz of the highpass stage" env-default:"80"`
+		LowPass          float64            `yaml:"lowpass" env:"LowPass" env-description:"Cutoff in Hz of the lowpass stage" env-default:"12000"`
+		NormalizePeak    float64            `yaml:"normalizepeak" env:"NormalizePeak" env-description:"Peak level in dBFS the normalize stage scales each recording to" env-default:"-1"`
+		NormalizeMaxGain float64            `yaml:"normalizemaxgain" env:"NormalizeMaxGain" env-description:"Largest boost in dB the normalize stage may apply" env-default:"20"`
+		FormatPeaks      map[string]float64 `yaml:"formatpeaks" env:"FormatPeaks" env-description:"Peak level in dBFS encodes are normalized to, looked up by encode.format, such as mp3:-0.5,flac:-3"`
+		Overflow         string             `yaml:"overflow" env:"ProcessingOverflow" env-description:"What happens to samples processing pushes past full scale: clamp to saturate them, or wrap to let them wrap around as integers, which clicks and is only for debugging" env-default:"clamp"`
+	} `yaml:"processing"`
+	Output struct {
+		Annotation    string        `yaml:"annotation" env:"Annotation" env-description:"Text stored in an annotation chunk of each recording"`
+		Dir           string        `yaml:"dir" env:"OutputDir" env-description:"Directory recordings are written to" env-default:"recordings"`
+		FallbackDir   string        `yaml:"fallbackdir" env:"OutputFallbackDir" env-description:"Directory recordings are written to instead when the output directory is not writable, empty to stop with an error"`
+		FsyncInterval time.Duration `yaml:"fsyncinterval" env:"FsyncInterval" env-description:"Flush each recording to disk at least this often as it is written, 0 to leave it to the system" env-default:"0s"`
+		MirrorDir     string        `yaml:"mirrordir" env:"MirrorDir" env-description:"Second directory every recording is also written to as it is made, empty for none"`
+		Stdout        bool          `yaml:"stdout" env:"Stdout" env-description:"Write raw PCM to standard output instead of recording files" env-default:"false"`
+		SampleFormat  string        `yaml:"sampleformat" env:"SampleFormat" env-description:"Raw PCM sample format written to standard output or a named pipe, such as s16le, s24le, s32be, f32le or u8" env-default:"s16le"`
+		IndexWidth    int           `yaml:"indexwidth" env:"IndexWidth" env-description:"Digits the number of each numbered recording is padded to with zeros, as in Unnamed Recording007.aiff, so names sort in order; 0 for no padding" env-default:"0"`
+		SplitChannels bool          `yaml:"splitchannels" env:"SplitChannels" env-description:"Write each input channel to its own mono file, named with its channel number as in name.ch1.aiff" env-default:"false"`
+		PipeHeader    string        `yaml:"pipeheader" env:"PipeHeader" env-description:"Header written before the audio when recording to a named pipe: wav, a WAV header of unknown length, or none for raw PCM" env-default:"wav"`
+		DateDirs      bool          `yaml:"datedirs" env:"DateDirs" env-description:"Place each recording in year/month/day directories under the output directory" env-default:"false"`
+		Checksum      bool          `yaml:"checksum" env:"Checksum" env-description:"Write a .sha256 sidecar next to each encoded file" env-default:"false"`
+		MaxDuration   time.Duration `yaml:"maxduration" env:"MaxDuration" env-description:"Stop recording after this much audio, counting down the time left, 0 for no limit" env-default:"0s"`
+		MinFreeSpace  int           `yaml:"minfreespace" env:"MinFreeSpace" env-description:"Megabytes of free disk space below which recording stops, 0 to never check" env-default:"100"`
+		FileMode      string        `yaml:"filemode" env:"FileMode" env-description:"Octal permissions for recordings and the files made from them"`
+		Format        string        `yaml:"format" env:"Format" env-description:"Container recordings are written in, aiff, aifc or wav" env-default:"aiff"`
+		BitDepth      int           `yaml:"bitdepth" env:"BitDepth" env-description:"Bits per sample of recordings, 8, 16 or 32. 8 bit WAV is unsigned, 8 bit AIFF is signed" env-default:"32"`
+		Dither        string        `yaml:"dither" env:"Dither" env-description:"Noise added when storing fewer than 32 bits per sample: none, rectangular or tpdf" env-default:"none"`
+	} `yaml:"output"`
+	Transcribe struct {
+		Command        string        `yaml:"command" env:"TranscribeCommand" env-description:"Command run with each encoded file whose output is saved as a .txt transcript"`
+		AutoName       bool          `yaml:"autoname" env:"AutoName" env-description:"Rename each recording after the first words the transcription command hears in its opening seconds" env-default:"false"`
+		AutoNameLength time.Duration `yaml:"autonamelength" env:"AutoNameLength" env-description:"Length of the opening transcribed to name a recording" env-default:"5s"`
+		AutoNameWords  int           `yaml:"autonamewords" env:"AutoNameWords" env-description:"Most words of the transcript used in the name" env-default:"6"`
+	} `yaml:"transcribe"`
+	Spectrogram struct {
+		File    string `yaml:"file" env:"Spectrogram" env-description:"PNG spectrogram written for each recording, {name} is replaced by the recording's path without its extension"`
+		FFTSize int    `yaml:"fftsize" env:"SpectrogramFFTSize" env-description:"Samples in each FFT frame, a power of two; larger sizes resolve frequency better and time worse" env-default:"2048"`
+		Window  string `yaml:"window" env:"SpectrogramWindow" env-description:"Window applied to each FFT frame: hann, hamming, blackman or rectangular" env-default:"hann"`
+		Width   int    `yaml:"width" env:"SpectrogramWidth" env-description:"Width of the image in pixels, one FFT frame per column" env-default:"1200"`
+		Height  int    `yaml:"height" env:"SpectrogramHeight" env-description:"Height of the image in pixels, covering 20 Hz to half the sample rate on a log scale" env-default:"400"`
+	} `yaml:"spectrogram"`
+	Retro struct {
+		Seconds   int    `yaml:"seconds" env:"RetroSeconds" env-description:"Keep only this many seconds of audio in memory and save them when s is pressed" env-default:"0"`
+		MaxMemory string `yaml:"maxmemory" env:"RetroMaxMemory" env-description:"Most memory retro mode may hold, the window and the copy made to save it, such as 256MB" env-default:"256MB"`
+	} `yaml:"retro"`
+	Utterances struct {
+		Enabled   bool          `yaml:"enabled" env:"Utterances" env-description:"Save each stretch of sound between silences as its own trimmed file" env-default:"false"`
+		Margin    time.Duration `yaml:"margin" env:"UtteranceMargin" env-description:"Replaced by preroll and postroll, and refused when set"`
+		PreRoll   time.Duration `yaml:"preroll" env:"UtterancePreRoll" env-description:"Audio from before the sound starts that opens each utterance, and the first recording when waiting for sound" env-default:"200ms"`
+		PostRoll  time.Duration `yaml:"postroll" env:"UtterancePostRoll" env-description:"Audio after the sound stops that ends each utterance, recording on past the gap if longer" env-default:"200ms"`
+		Gap       time.Duration `yaml:"gap" env:"UtteranceGap" env-description:"Silence that ends an utterance" env-default:"500ms"`
+		MinLength time.Duration `yaml:"minlength" env:"UtteranceMinLength" env-description:"Utterances with less sound than this are dropped as clicks" env-default:"300ms"`
+		Naming    string        `yaml:"naming" env:"UtteranceNaming" env-description:"Name utterance files with a sequence number or the time they started, sequential or timestamp" env-default:"sequential"`
+	} `yaml:"utterances"`
+	Keys struct {
+		Stop    string `yaml:"stop" env:"KeyStop" env-description:"Key pressed before Enter to finish recording and stop, a character or space, tab or enter" env-default:"q"`
+		Save    string `yaml:"save" env:"KeySave" env-description:"Key that saves the audio held in retro mode, or in endless mode stops once the segment being recorded ends" env-default:"s"`
+		Split   string `yaml:"split" env:"KeySplit" env-description:"Key that splits the recording into a new segment as a marker does, or starts the next take in take mode" env-default:"t"`
+		NoStdin bool   `yaml:"nostdin" env:"NoStdin" env-description:"Do not read keys from stdin, stopping only on a signal or a limit" env-default:"false"`
+	} `yaml:"keys"`
+	Messages struct {
+		Quiet     bool   `yaml:"quiet" env:"Quiet" env-description:"Only print errors" env-default:"false"`
+		Recording string `yaml:"recording" env:"RecordingMessage" env-description:"Shown when recording starts" env-default:"Recording.  Press q to stop."`
+		Listening string `yaml:"listening" env:"ListeningMessage" env-description:"Shown when retro mode starts, %d is replaced by the seconds kept" env-default:"Listening.  Press s to save the last %d seconds, q to stop."`
+		Encoding  string `yaml:"encoding" env:"EncodingMessage" env-description:"Shown before the artist and title being encoded" env-default:"[Encoding] "`
+	} `yaml:"messages"`
+	Input struct {
+		File            string        `yaml:"file" env:"InputFile" env-description:"Replay an AIFF or WAV file instead of recording from the input device"`
+		Channels        int           `yaml:"channels" env:"Channels" env-description:"Number of input channels recorded, interleaved in the output" env-default:"1"`
+		ChannelMismatch string        `yaml:"channelmismatch" env:"ChannelMismatch" env-description:"What to do when the input file's channels differ from the configured channels: error, downmix a file to mono, or duplicate a mono file to every channel" env-default:"error"`
+		Negotiate       bool          `yaml:"negotiate" env:"NegotiateFormat" env-description:"When the input device cannot record at 44100 Hz with the configured channels, record it at its own sample rate, in mono or in stereo and convert, instead of failing" env-default:"true"`
+		Resample        string        `yaml:"resample" env:"Resample" env-description:"Interpolation used to convert an input file at another sample rate: linear, cubic, sinc-fast or sinc-best, from the least CPU to the most faithful" env-default:"sinc-fast"`
+		LatencyOffset   time.Duration `yaml:"latencyoffset" env:"LatencyOffset" env-description:"Audio discarded at the start of recording to compensate for input latency" env-default:"0s"`
+		ShowStream      bool          `yaml:"showstream" env:"ShowStream" env-description:"Log the parameters each input stream is opened with" env-default:"false"`
+		Exclusive       bool          `yaml:"exclusive" env:"Exclusive" env-description:"Open the input device for exclusive, unprocessed access where the host API allows it" env-default:"false"`
+		Float           bool          `yaml:"float" env:"FloatInput" env-description:"Read the input device as 32 bit float samples even when nothing processes them, as it always is when the input gain, balance or a processing stage is set" env-default:"false"`
+		Device          string        `yaml:"device" env:"InputDevice" env-description:"Input device to record from by name or list-devices number, the default input device when empty"`
+		Devices         string        `yaml:"devices" env:"InputDevices" env-description:"Comma separated input devices, by name or list-devices number, recorded together into one multitrack file, each supplying an equal share of the channels in the order given"`
+		Loopback        bool          `yaml:"loopback" env:"Loopback" env-description:"Record what the default output device plays instead of an input, where the host API offers a loopback or monitor input" env-default:"false"`
+		Interactive     bool          `yaml:"interactive" env:"Interactive" env-description:"Ask which input device to record from when none is configured" env-default:"false"`
+		Gain            string        `yaml:"gain" env:"InputGain" env-description:"Gain applied to the input before anything else, in dB such as 6dB or as a factor such as 2" env-default:"0dB"`
+		Balance         string        `yaml:"balance" env:"InputBalance" env-description:"Gain for each input channel in order, in dB or as a factor, such as 0dB,-3dB; empty for none"`
+		GainSilence     bool          `yaml:"gainsilence" env:"InputGainSilence" env-description:"Judge silence after the input gain and processing; when off silence is judged on the audio as captured" env-default:"true"`
+		FallbackDevice  string        `yaml:"fallbackdevice" env:"FallbackDevice" env-description:"What to do when the input device fails or is unplugged mid-run, after finishing the recording: stop, default to carry on with the default input device, or wait for the device to come back" env-default:"stop"`
+		StallTimeout    time.Duration `yaml:"stalltimeout" env:"StallTimeout" env-description:"How long the input device may deliver no audio before the recording is finished and the device reopened, 0 to never reopen it" env-default:"1m"`
+		Overflow        string        `yaml:"overflow" env:"InputOverflow" env-description:"What to do when the input device overflows and audio is lost: continue with the next buffer, silence to mark the gap with a short silence, or fail to stop recording" env-default:"continue"`
+		OverflowGap     time.Duration `yaml:"overflowgap" env:"InputOverflowGap" env-description:"Length of the silence marking each overflow with overflow silence" env-default:"20ms"`
+	} `yaml:"input"`
+	Upload struct {
+		RetryDelay time.Duration `yaml:"retrydelay" env:"UploadRetryDelay" env-description:"Wait before the first retry of a failed upload or publish, doubled before each one after" env-default:"1s"`
+		KeepOnFail bool          `yaml:"keeponfail" env:"KeepOnUploadFail" env-description:"Keep an encoded file whose upload still fails after its retries instead of letting s3.deletelocal remove it" env-default:"false"`
+		S3         struct {
+			Enabled     bool   `yaml:"enabled" env:"UploadS3" env-description:"Upload each encoded file to an S3 compatible bucket" env-default:"false"`
+			Endpoint    string `yaml:"endpoint" env:"S3Endpoint" env-description:"Base URL of the S3 compatible service" env-default:"https://s3.amazonaws.com"`
+			Region      string `yaml:"region" env:"S3Region" env-description:"Region used to sign requests" env-default:"us-east-1"`
+			Bucket      string `yaml:"bucket" env:"S3Bucket" env-description:"Bucket uploads are stored in"`
+			AccessKey   string `yaml:"accesskey" env:"S3AccessKey" env-description:"Access key ID used to sign requests" secret:"true"`
+			SecretKey   string `yaml:"secretkey" env:"S3SecretKey" env-description:"Secret access key used to sign requests" secret:"true"`
+			DeleteLocal bool   `yaml:"deletelocal" env:"S3DeleteLocal" env-description:"Remove the local file once it has been uploaded" env-default:"false"`
+			Retries     int    `yaml:"retries" env:"S3Retries" env-description:"Times a failed upload is retried when the error looks transient" env-default:"3"`
+		} `yaml:"s3"`
+		Queue struct {
+			Enabled   bool   `yaml:"enabled" env:"PublishQueue" env-description:"Publish each encoded file as a JSON message to a message queue" env-default:"false"`
+			Broker    string `yaml:"broker" env:"QueueBroker" env-description:"Message broker to publish to, nats or redis" env-default:"nats"`
+			Address   string `yaml:"address" env:"QueueAddress" env-description:"Broker host and port, such as localhost:4222 for NATS or localhost:6379 for Redis" env-default:"localhost:4222"`
+			Subject   string `yaml:"subject" env:"QueueSubject" env-description:"NATS subject, or Redis list pushed to, that messages are published on" env-default:"recordings"`
+			Token     string `yaml:"token" env:"QueueToken" env-description:"NATS auth token or Redis password" secret:"true"`
+			Reference bool   `yaml:"reference" env:"QueueReference" env-description:"Publish only the file's path and details instead of its contents as base64" env-default:"false"`
+			Retries   int    `yaml:"retries" env:"QueueRetries" env-description:"Times a failed publish is retried when the error looks transient" env-default:"3"`
+		} `yaml:"queue"`
+	} `yaml:"upload"`
+	Markers struct {
+		Enabled bool   `yaml:"enabled" env:"SplitOnMarker" env-description:"Split on markers from the FIFO or SIGHUP instead of on silence" env-default:"false"`
+		FIFO    string `yaml:"fifo" env:"MarkerFIFO" env-description:"Named pipe whose lines each split the recording, a non-empty line naming the new segment \"artist - title\""`
+	} `yaml:"markers"`
+	Icecast struct {
+		Enabled    bool   `yaml:"enabled" env:"Icecast" env-description:"Stream the live audio to an Icecast mount" env-default:"false"`
+		Format     string `yaml:"format" env:"IcecastFormat" env-description:"Codec of the stream: mp3 encoded by lame, or ogg (Vorbis) or opus in Ogg encoded by ffmpeg" env-default:"mp3"`
+		URL        string `yaml:"url" env:"IcecastURL" env-description:"Base URL of the Icecast server" env-default:"http://localhost:8000"`
+		Mount      string `yaml:"mount" env:"IcecastMount" env-description:"Mount point to stream to" env-default:"/live.mp3"`
+		User       string `yaml:"user" env:"IcecastUser" env-description:"Source user name" env-default:"source"`
+		Password   string `yaml:"password" env:"IcecastPassword" env-description:"Source password" secret:"true"`
+		RecordFile bool   `yaml:"recordfile" env:"IcecastRecordFile" env-description:"Keep recording to files while streaming" env-default:"true"`
+	} `yaml:"icecast"`
+	Pop struct {
+		Enabled   bool          `yaml:"enabled" env:"SkipPop" env-description:"Hold back the opening of a recording and remove a pop or click from the stream opening or the microphone being touched" env-default:"false"`
+		Window    time.Duration `yaml:"window" env:"PopWindow" env-description:"Opening held back and checked for a pop, which must be followed by quieter audio before it ends" env-default:"500ms"`
+		MaxLength time.Duration `yaml:"maxlength" env:"PopMaxLength" env-description:"Longest loud burst taken for a pop; anything longer is a loud start and kept" env-default:"30ms"`
+		Threshold float64       `yaml:"threshold" env:"PopThreshold" env-description:"Peak level in dBFS above which the opening counts as loud" env-default:"-12"`
+		Mode      string        `yaml:"mode" env:"PopMode" env-description:"zero to silence a pop where it was, or drop to cut it out" env-default:"zero"`
+	} `yaml:"pop"`
+	QuietRecordings struct {
+		Threshold float64 `yaml:"threshold" env:"DeleteQuietBelow" env-description:"Level in dBFS a finished recording must reach somewhere or be deleted unencoded as a false trigger; 0 keeps every recording" env-default:"0"`
+		Measure   string  `yaml:"measure" env:"QuietMeasure" env-description:"Level compared with the threshold: peak, the loudest sample, or rms, the level of the whole recording" env-default:"peak"`
+	} `yaml:"quietrecordings"`
+	SyncTone struct {
+		Enabled   bool          `yaml:"enabled" env:"SyncTone" env-description:"Start the recording with a reference tone, a clap-equivalent for lining it up with other recordings of the same event" env-default:"false"`
+		Frequency float64       `yaml:"frequency" env:"SyncToneFrequency" env-description:"Frequency of the tone in Hz" env-default:"1000"`
+		Level     float64       `yaml:"level" env:"SyncToneLevel" env-description:"Peak level of the tone in dBFS" env-default:"-20"`
+		Duration  time.Duration `yaml:"duration" env:"SyncToneDuration" env-description:"Length of the tone" env-default:"1s"`
+	} `yaml:"synctone"`
+	Take struct {
+		Name string `yaml:"name" env:"TakeName" env-description:"Name of the piece to record numbered takes of, as in \"Song - Take 1\", each take tagged with the take number and the name as its album; empty for normal recording"`
+	} `yaml:"take"`
+	OSC struct {
+		Address string `yaml:"address" env:"OSCAddress" env-description:"host:port OSC messages are sent to over UDP as recording starts, splits, hears silence and stops; empty for none"`
+		Start   string `yaml:"start" env:"OSCStart" env-description:"Address pattern sent with the file name as each recording starts, empty to leave it out" env-default:"/recorder/start"`
+		Split   string `yaml:"split" env:"OSCSplit" env-description:"Address pattern sent with the file name of the recording finished by a split" env-default:"/recorder/split"`
+		Silence string `yaml:"silence" env:"OSCSilence" env-description:"Address pattern sent with the file name as silence begins" env-default:"/recorder/silence"`
+		Stop    string `yaml:"stop" env:"OSCStop" env-description:"Address pattern sent as recording stops" env-default:"/recorder/stop"`
+	} `yaml:"osc"`
+	Monitor struct {
+		Address string `yaml:"address" env:"MonitorAddress" env-description:"Address such as :9000 to serve a live meter page and a WebSocket of levels and waveform on; empty for none"`
+		Rate    int    `yaml:"rate" env:"MonitorRate" env-description:"Messages sent to each monitoring client per second" env-default:"25"`
+	} `yaml:"monitor"`
+}
+
+// Load reads the settings from the file at path, then from environment
+// variables, filling in defaults for anything neither sets. A missing file
+// and fields the file has that no setting knows are returned as warnings,
+// or as errors when strict; malformed YAML and values of the wrong type are
+// always errors.
+func Load(path string, cfg *Config, strict bool) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !strict {
+		warning := path + " not found, using environment variables and defaults"
+		return []string{warning}, cleanenv.ReadEnv(cfg)
+	} else if err != nil {
+		return nil, err
+	}
+
+	unknown, err := unknownFields(data)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	if strict && len(unknown) > 0 {
+		return nil, fmt.Errorf("config file %s: %s", path, strings.Join(unknown, "; "))
+	}
+	return unknown, cleanenv.ReadConfig(path, cfg)
+}
+
+// unknownFields lists the fields of a YAML config that no setting knows,
+// such as a misspelt name, failing on anything else wrong with it
+func unknownFields(data []byte) ([]string, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var check Config
+	err := dec.Decode(&check)
+	if err == nil || err == io.EOF {
+		return nil, nil
+	}
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil, err
+	}
+
+	var unknown []string
+	for _, msg := range typeErr.Errors {
+		// the type named after this is the whole section's struct
+		i := strings.Index(msg, " not found in type")
+		if i < 0 {
+			return nil, err
+		}
+		unknown = append(unknown, msg[:i]+" is not a known setting")
+	}
+	return unknown, nil
+}
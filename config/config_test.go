@@ -0,0 +1,88 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnknownFields(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		yaml    string
+		want    []string
+		wantErr bool
+	}{
+		{"known settings", "input:\n  channels: 2\n", nil, false},
+		{"empty file", "", nil, false},
+		{"misspelt setting", "input:\n  chanels: 2\n", []string{"line 2: field chanels is not a known setting"}, false},
+		{"misspelt section", "inptu:\n  channels: 2\n", []string{"line 1: field inptu is not a known setting"}, false},
+		{"several", "input:\n  chanels: 2\nencode:\n  bitrat: 128\n",
+			[]string{"line 2: field chanels is not a known setting", "line 4: field bitrat is not a known setting"}, false},
+		{"wrong type", "input:\n  channels: two\n", nil, true},
+		{"malformed", "input: [\n", nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := unknownFields([]byte(test.yaml))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("unknownFields error = %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("unknownFields = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name         string
+		yaml         string // written to the config file unless empty
+		strict       bool
+		wantWarnings int
+		wantErr      string
+		wantChannels int
+	}{
+		{"file settings", "input:\n  channels: 2\n", false, 0, "", 2},
+		{"defaults fill the rest", "encode:\n  bitrate: \"128\"\n", false, 0, "", 1},
+		{"unknown field warns", "input:\n  channels: 2\n  chanels: 3\n", false, 1, "", 2},
+		{"unknown field fails when strict", "input:\n  chanels: 3\n", true, 0, "chanels is not a known setting", 0},
+		{"missing file warns", "", false, 1, "", 1},
+		{"missing file fails when strict", "", true, 0, "config.yml", 0},
+		{"wrong type fails", "input:\n  channels: two\n", false, 0, "config file", 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1), "config.yml")
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if test.yaml != "" {
+				if err := ioutil.WriteFile(path, []byte(test.yaml), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var cfg Config
+			warnings, err := Load(path, &cfg, test.strict)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Load returned %v, want an error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load returned %v", err)
+			}
+			if len(warnings) != test.wantWarnings {
+				t.Errorf("Load warned %q, want %d warnings", warnings, test.wantWarnings)
+			}
+			if cfg.Input.Channels != test.wantChannels {
+				t.Errorf("input.channels = %d, want %d", cfg.Input.Channels, test.wantChannels)
+			}
+		})
+	}
+}
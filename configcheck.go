@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/1hitsong/Go-Record-Audio/audio"
+	"github.com/gordonklaus/portaudio"
+)
+
+// configProblems validates the values of the loaded configuration
+func configProblems() []string {
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if bitrate, err := strconv.Atoi(cfg.Encode.Bitrate); err != nil || bitrate < 8 || bitrate > 320 {
+		problem("encode.bitrate %q must be a number of kbps from 8 to 320", cfg.Encode.Bitrate)
+	}
+	if cfg.Encode.Bitrates != "" {
+		for _, b := range encodeBitrates() {
+			if bitrate, err := strconv.Atoi(b); err != nil || bitrate < 8 || bitrate > 320 {
+				problem("encode.bitrates entry %q must be a number of kbps from 8 to 320", b)
+			}
+		}
+	}
+	if cfg.SilenceDetection.Delayatstartofcapture < 0 {
+		problem("silencedetection.delayatstartofcapture must not be negative")
+	}
+	if cfg.SilenceDetection.LinearThreshold && cfg.SilenceDetection.Threshold < 0 {
+		problem("silencedetection.threshold must not be negative when linearthreshold is set")
+	} else if !cfg.SilenceDetection.LinearThreshold && cfg.SilenceDetection.Threshold > 0 {
+		problem("silencedetection.threshold is in dBFS and must not be above 0, set linearthreshold for an old linear level")
+	}
+	if cfg.SilenceDetection.Window < 1 {
+		problem("silencedetection.window must be at least 1")
+	}
+	switch cfg.SilenceDetection.RepeatedSilence {
+	case "discard", "keep", "continue":
+	default:
+		problem("silencedetection.repeatedsilence %q must be discard, keep or continue", cfg.SilenceDetection.RepeatedSilence)
+	}
+	if cfg.SilenceDetection.CompressGap < 0 {
+		problem("silencedetection.compressgap must not be negative")
+	}
+	if cfg.SilenceDetection.CompressAfter < cfg.SilenceDetection.CompressGap {
+		problem("silencedetection.compressafter must not be shorter than compressgap")
+	}
+	if cfg.SilenceDetection.MaxSilenceFiles < 0 || cfg.SilenceDetection.ShortSegment < 0 {
+		problem("silencedetection.maxsilencefiles and shortsegment must not be negative")
+	}
+	if cfg.SilenceDetection.StopAfter < 0 {
+		problem("silencedetection.stopafter must not be negative")
+	}
+	if cfg.SilenceDetection.Band && (cfg.SilenceDetection.BandLow <= 0 || cfg.SilenceDetection.BandHigh <= cfg.SilenceDetection.BandLow || cfg.SilenceDetection.BandHigh >= sampleRate/2) {
+		problem("silencedetection.bandlow and bandhigh must satisfy 0 < bandlow < bandhigh < %d Hz", sampleRate/2)
+	}
+	if cfg.SilenceDetection.Channels != "all" && cfg.SilenceDetection.Channels != "any" {
+		problem("silencedetection.channels %q must be all or any", cfg.SilenceDetection.Channels)
+	}
+	if cfg.Gate.Threshold < 0 || cfg.Gate.Attack < 0 || cfg.Gate.Release < 0 {
+		problem("gate threshold, attack and release must not be negative")
+	}
+	if cfg.AGC.MaxGain < 0 || cfg.AGC.Target > 0 || cfg.AGC.Attack < 0 || cfg.AGC.Release < 0 {
+		problem("agc target must be at most 0 dBFS and its max gain, attack and release must not be negative")
+	}
+	if cfg.Limiter.Ceiling > 0 || cfg.Limiter.Lookahead < 0 || cfg.Limiter.Release < 0 {
+		problem("limiter ceiling must be at most 0 dBFS and its lookahead and release must not be negative")
+	}
+	fileStage := ""
+	inChain := map[string]bool{}
+	for _, name := range cfg.Processing.Chain {
+		inChain[name] = true
+		stage, err := newStage(name)
+		if err != nil {
+			problem("%v", err)
+			continue
+		}
+		if _, whole := stage.(audio.FileProcessor); whole {
+			fileStage = name
+		} else if fileStage != "" {
+			problem("processing.chain runs %s on each buffer as it is recorded, so it must come before %s, which runs on the finished recording", name, fileStage)
+		}
+	}
+	if len(cfg.Processing.Chain) > 0 {
+		for _, s := range []struct {
+			name    string
+			enabled bool
+		}{{"gate", cfg.Gate.Enabled}, {"agc", cfg.AGC.Enabled}, {"limiter", cfg.Limiter.Enabled}} {
+			if s.enabled && !inChain[s.name] {
+				problem("%s is enabled but not in processing.chain, which alone decides the stages run when set", s.name)
+			}
+		}
+	}
+	if cfg.Retro.Seconds < 0 {
+		problem("retro.seconds must not be negative")
+	}
+	if max, err := parseSize(cfg.Retro.MaxMemory); err != nil {
+		problem("retro.maxmemory: %v", err)
+	} else if need := retroMemory(); need > max {
+		problem("retro.seconds %d holds %.1f MB in memory with %d channels, over retro.maxmemory %s", cfg.Retro.Seconds, float64(need)/1e6, cfg.Input.Channels, cfg.Retro.MaxMemory)
+	}
+	if cfg.Utterances.Margin != 0 {
+		problem("utterances.margin has been replaced by utterances.preroll and utterances.postroll, set those to %v instead", cfg.Utterances.Margin)
+	}
+	if cfg.Utterances.PreRoll < 0 || cfg.Utterances.PostRoll < 0 || cfg.Utterances.MinLength < 0 {
+		problem("utterances preroll, postroll and minlength must not be negative")
+	}
+	if cfg.Utterances.Naming != "sequential" && cfg.Utterances.Naming != "timestamp" {
+		problem("utterances.naming %q must be sequential or timestamp", cfg.Utterances.Naming)
+	}
+	if cfg.Input.Channels < 1 {
+		problem("input.channels must be at least 1")
+	}
+	if names := multitrackDevices(); names != nil {
+		if cfg.Input.Device != "" || cfg.Input.Loopback || cfg.Input.Exclusive {
+			problem("input.devices cannot be combined with input.device, input.loopback or input.exclusive")
+		}
+		if cfg.Input.Channels%len(names) != 0 {
+			problem("input.channels %d must be a multiple of the %d input.devices, each supplying an equal share", cfg.Input.Channels, len(names))
+		}
+	}
+	if cfg.Input.LatencyOffset < 0 {
+		problem("input.latencyoffset must not be negative")
+	}
+	if cfg.Input.Balance != "" {
+		if cfg.Input.Channels < 2 {
+			problem("input.balance needs at least two input.channels")
+		} else if _, err := parseBalance(cfg.Input.Balance); err != nil {
+			problem("input.balance: %v", err)
+		}
+	}
+	if _, err := audio.ParseGain(cfg.Input.Gain); err != nil {
+		problem("input.gain: %v", err)
+	}
+	if cfg.Input.StallTimeout < 0 {
+		problem("input.stalltimeout must not be negative")
+	}
+	if cfg.Output.Format != "aiff" && cfg.Output.Format != "aifc" && cfg.Output.Format != "wav" {
+		problem("output.format %q must be aiff, aifc or wav", cfg.Output.Format)
+	}
+	if cfg.Output.Dither != "none" && cfg.Output.Dither != "rectangular" && cfg.Output.Dither != "tpdf" {
+		problem("output.dither %q must be none, rectangular or tpdf", cfg.Output.Dither)
+	}
+	if cfg.Output.BitDepth != 8 && cfg.Output.BitDepth != 16 && cfg.Output.BitDepth != 32 {
+		problem("output.bitdepth %d must be 8, 16 or 32", cfg.Output.BitDepth)
+	}
+	switch {
+	case cfg.Encode.Encoder != "lame" && cfg.Encode.Encoder != "ffmpeg":
+		problem("encode.encoder %q must be lame or ffmpeg", cfg.Encode.Encoder)
+	case cfg.Encode.Encoder == "lame" && cfg.Encode.Format != "mp3":
+		problem("encode.format %q needs the ffmpeg encoder, lame only writes mp3", cfg.Encode.Format)
+	case !strings.Contains(" mp3 m4a ogg opus flac ", " "+cfg.Encode.Format+" "):
+		problem("encode.format %q must be mp3, m4a, ogg, opus or flac", cfg.Encode.Format)
+	}
+	if (cfg.Encode.Chapters || cfg.Encode.ChapterFile != "") && cfg.Encode.Encoder != "ffmpeg" {
+		problem("encode.chapters and encode.chapterfile need the ffmpeg encoder")
+	}
+	if cfg.Tags.Retag && cfg.Encode.Format == "m4a" {
+		problem("tags.retag rewrites mp3, ogg, opus and flac files, not m4a")
+	}
+	if cfg.Encode.Preview < 0 {
+		problem("encode.preview must not be negative")
+	}
+	if bitrate, err := strconv.Atoi(cfg.Encode.PreviewBitrate); cfg.Encode.Preview > 0 && (err != nil || bitrate < 8 || bitrate > 320) {
+		problem("encode.previewbitrate %q must be a number of kbps from 8 to 320", cfg.Encode.PreviewBitrate)
+	}
+	if cfg.Spectrogram.File != "" {
+		if n := cfg.Spectrogram.FFTSize; n < 64 || n > 65536 || n&(n-1) != 0 {
+			problem("spectrogram.fftsize %d must be a power of two from 64 to 65536", n)
+		}
+		if _, ok := audio.Windows[cfg.Spectrogram.Window]; !ok {
+			problem("spectrogram.window %q must be hann, hamming, blackman or rectangular", cfg.Spectrogram.Window)
+		}
+		if cfg.Spectrogram.Width < 1 || cfg.Spectrogram.Height < 1 {
+			problem("spectrogram.width and spectrogram.height must be positive")
+		}
+	}
+	if cfg.Encode.TargetSize != "" {
+		if size, err := parseSize(cfg.Encode.TargetSize); err != nil {
+			problem("encode.targetsize: %v", err)
+		} else if size <= 64<<10 {
+			problem("encode.targetsize %s leaves no room for audio after the tags", cfg.Encode.TargetSize)
+		}
+		if cfg.Encode.Bitrates != "" || cfg.Encode.Format == "flac" {
+			problem("encode.targetsize picks one bitrate, so it cannot be used with encode.bitrates or flac")
+		}
+	}
+	if cfg.Encode.Nice < 0 || cfg.Encode.Nice > 19 {
+		problem("encode.nice %d must be from 0 to 19", cfg.Encode.Nice)
+	}
+	if cfg.Encode.Retries < 0 {
+		problem("encode.retries must not be negative")
+	}
+	if cfg.Encode.Retries > 0 && cfg.Encode.RetryDelay < 0 {
+		problem("encode.retrydelay must not be negative")
+	}
+	if cfg.Encode.ShutdownTimeout < 0 {
+		problem("encode.shutdowntimeout must not be negative")
+	}
+	if cfg.Markers.Enabled && cfg.Markers.FIFO != "" {
+		if info, err := os.Stat(cfg.Markers.FIFO); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+			problem("markers.fifo %s must be a named pipe, create it with mkfifo", cfg.Markers.FIFO)
+		}
+	}
+	if _, err := parseSampleFormat(cfg.Output.SampleFormat); err != nil {
+		problem("output.sampleformat: %v, use one like s16le, s24be, f32le or u8", err)
+	}
+	if cfg.Output.PipeHeader != "wav" && cfg.Output.PipeHeader != "none" {
+		problem("output.pipeheader must be wav or none, not %q", cfg.Output.PipeHeader)
+	}
+	if cfg.Tags.TrackTotal < 0 {
+		problem("tags.tracktotal must not be negative")
+	}
+	if cfg.Tags.Cover != "" && !fileExists(cfg.Tags.Cover) {
+		problem("tags.cover %q does not exist", cfg.Tags.Cover)
+	}
+	for _, c := range []struct{ name, command string }{{"transcribe.command", cfg.Transcribe.Command}, {"location.command", cfg.Location.Command}} {
+		if _, err := commandArgs(c.command); c.command != "" && err != nil {
+			problem("%s %q must name a program to run", c.name, c.command)
+		}
+	}
+	if cfg.Transcribe.AutoName && (cfg.Transcribe.Command == "" || cfg.Transcribe.AutoNameLength <= 0 || cfg.Transcribe.AutoNameWords < 1) {
+		problem("transcribe.autoname needs a transcribe.command, a positive autonamelength and at least one autonameword")
+	}
+	if cfg.Output.MaxDuration < 0 {
+		problem("output.maxduration must not be negative")
+	}
+	if cfg.Output.MinFreeSpace < 0 {
+		problem("output.minfreespace must not be negative")
+	}
+	if cfg.Output.FileMode != "" {
+		if mode, err := strconv.ParseUint(cfg.Output.FileMode, 8, 32); err != nil || mode > 0777 {
+			problem("output.filemode %q must be octal permissions such as 0644", cfg.Output.FileMode)
+		}
+	}
+	if cfg.Upload.RetryDelay <= 0 {
+		problem("upload.retrydelay must be positive")
+	}
+	if cfg.Upload.S3.Enabled && (cfg.Upload.S3.Bucket == "" || cfg.Upload.S3.AccessKey == "" || cfg.Upload.S3.SecretKey == "") {
+		problem("upload.s3 needs a bucket, access key and secret key")
+	}
+	if cfg.Upload.Queue.Enabled {
+		if _, ok := publishers[cfg.Upload.Queue.Broker]; !ok {
+			problem("upload.queue.broker %q must be nats or redis", cfg.Upload.Queue.Broker)
+		}
+		if cfg.Upload.Queue.Subject == "" || strings.ContainsAny(cfg.Upload.Queue.Subject, " \t\r\n") {
+			problem("upload.queue.subject %q must be set and contain no whitespace", cfg.Upload.Queue.Subject)
+		}
+		if cfg.Upload.Queue.Retries < 0 {
+			problem("upload.queue.retries must not be negative")
+		}
+	}
+	if cfg.OSC.Address != "" {
+		if _, _, err := net.SplitHostPort(cfg.OSC.Address); err != nil {
+			problem("osc.address %q must be host:port", cfg.OSC.Address)
+		}
+		for _, p := range []struct{ name, pattern string }{
+			{"start", cfg.OSC.Start}, {"split", cfg.OSC.Split}, {"silence", cfg.OSC.Silence}, {"stop", cfg.OSC.Stop},
+		} {
+			if p.pattern != "" && (!strings.HasPrefix(p.pattern, "/") || strings.ContainsAny(p.pattern, " #,")) {
+				problem("osc.%s %q must start with / and contain no spaces, # or commas", p.name, p.pattern)
+			}
+		}
+	}
+	if cfg.Monitor.Address != "" {
+		if _, _, err := net.SplitHostPort(cfg.Monitor.Address); err != nil {
+			problem("monitor.address %q must be host:port or :port", cfg.Monitor.Address)
+		}
+		if cfg.Monitor.Rate < 1 || cfg.Monitor.Rate > 100 {
+			problem("monitor.rate must be from 1 to 100 messages a second")
+		}
+	}
+	if cfg.Icecast.Enabled {
+		if u, err := url.Parse(cfg.Icecast.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("icecast.url %q must be an http or https URL", cfg.Icecast.URL)
+		}
+		if !strings.HasPrefix(cfg.Icecast.Mount, "/") {
+			problem("icecast.mount %q must start with /", cfg.Icecast.Mount)
+		}
+		if cfg.Icecast.Password == "" {
+			problem("icecast needs a source password")
+		}
+		if cfg.Icecast.Format != "mp3" && cfg.Icecast.Format != "ogg" && cfg.Icecast.Format != "opus" {
+			problem("icecast.format %q must be mp3, ogg or opus", cfg.Icecast.Format)
+		}
+	}
+	if cfg.Input.Loopback && cfg.Input.Device != "" {
+		problem("input.loopback picks the device itself, leave input.device empty")
+	}
+	if cfg.Take.Name != "" && (cfg.Retro.Seconds > 0 || cfg.Utterances.Enabled || cfg.Output.Stdout || cfg.Markers.Enabled) {
+		problem("take.name records takes split by the split key, so it cannot be used with retro, utterances, stdout or markers")
+	}
+	if cfg.Pop.Enabled {
+		if cfg.Pop.MaxLength <= 0 || cfg.Pop.Window < 2*cfg.Pop.MaxLength {
+			problem("pop.window must be at least twice pop.maxlength, which must be positive, so quieter audio can follow a pop")
+		}
+		if cfg.Pop.Threshold > 0 {
+			problem("pop.threshold must be at most 0 dBFS")
+		}
+		if cfg.Pop.Mode != "zero" && cfg.Pop.Mode != "drop" {
+			problem("pop.mode %q must be zero or drop", cfg.Pop.Mode)
+		}
+	}
+	if cfg.QuietRecordings.Threshold > 0 {
+		problem("quietrecordings.threshold must be below 0 dBFS, or 0 to keep every recording")
+	}
+	if m := cfg.QuietRecordings.Measure; m != "peak" && m != "rms" {
+		problem("quietrecordings.measure %q must be peak or rms", m)
+	}
+	if cfg.SyncTone.Enabled {
+		if cfg.SyncTone.Frequency <= 0 || cfg.SyncTone.Frequency >= sampleRate/2 {
+			problem("synctone.frequency must be above 0 Hz and below %d Hz", sampleRate/2)
+		}
+		if cfg.SyncTone.Level > 0 {
+			problem("synctone.level must be at most 0 dBFS")
+		}
+		if cfg.SyncTone.Duration <= 0 {
+			problem("synctone.duration must be positive")
+		}
+		if cfg.Retro.Seconds > 0 || cfg.Utterances.Enabled {
+			problem("synctone cannot be used in retro or utterance mode, which have no start to put it at")
+		}
+	}
+	keys := map[string]string{}
+	for _, k := range []struct{ action, key string }{{"stop", cfg.Keys.Stop}, {"save", cfg.Keys.Save}, {"split", cfg.Keys.Split}} {
+		action, key := k.action, k.key
+		typed := typedKey(key)
+		if _, named := keyNames[strings.ToLower(key)]; !named && (key == "" || strings.TrimSpace(key) != key) {
+			problem("keys.%s %q must be a key such as q, or space, tab or enter", action, key)
+		} else if other, ok := keys[typed]; ok {
+			problem("keys.%s and keys.%s are both %q, each action needs its own key", other, action, key)
+		}
+		keys[typed] = action
+	}
+	if cfg.Output.IndexWidth < 0 || cfg.Output.IndexWidth > 9 {
+		problem("output.indexwidth must be from 0 to 9")
+	}
+	if cfg.Output.SplitChannels {
+		if cfg.Input.Channels < 2 {
+			problem("output.splitchannels needs at least two input.channels")
+		}
+		// these read a finished recording as interleaved input channels
+		for _, c := range []struct {
+			name string
+			on   bool
+		}{
+			{"processing.chain stage " + fileStage, fileStage != ""},
+			{"spectrogram.file", cfg.Spectrogram.File != ""},
+			{"transcribe.autoname", cfg.Transcribe.AutoName},
+			{"encode.preview", cfg.Encode.Preview > 0},
+			{"encode.chapters", cfg.Encode.Chapters},
+			{"encode.chapterfile", cfg.Encode.ChapterFile != ""},
+			{"encode.targetsize", cfg.Encode.TargetSize != ""},
+			{"silencedetection.marksplits", cfg.SilenceDetection.MarkSplits},
+			{"silencedetection.markerinterval", cfg.SilenceDetection.MarkerInterval > 0},
+		} {
+			if c.on {
+				problem("output.splitchannels cannot be combined with %s", c.name)
+			}
+		}
+	}
+	if cfg.Processing.HighPass <= 0 || cfg.Processing.LowPass <= cfg.Processing.HighPass || cfg.Processing.LowPass >= sampleRate/2 {
+		problem("processing.highpass and processing.lowpass must be above 0 Hz, in order and below %d Hz", sampleRate/2)
+	}
+	if cfg.Processing.NormalizePeak > 0 || cfg.Processing.NormalizeMaxGain < 0 {
+		problem("processing.normalizepeak must be at most 0 dBFS and processing.normalizemaxgain must not be negative")
+	}
+	var peakFormats []string
+	for format := range cfg.Processing.FormatPeaks {
+		peakFormats = append(peakFormats, format)
+	}
+	sort.Strings(peakFormats)
+	for _, format := range peakFormats {
+		if peak := cfg.Processing.FormatPeaks[format]; !strings.Contains(" mp3 m4a ogg opus flac ", " "+format+" ") || peak > 0 {
+			problem("processing.formatpeaks %s: %v must name mp3, m4a, ogg, opus or flac and be at most 0 dBFS", format, peak)
+		}
+	}
+	if cfg.Processing.Overflow != "clamp" && cfg.Processing.Overflow != "wrap" {
+		problem("processing.overflow %q must be clamp or wrap", cfg.Processing.Overflow)
+	}
+	if cfg.Output.FsyncInterval < 0 {
+		problem("output.fsyncinterval must not be negative")
+	}
+	if cfg.SilenceDetection.MarkerInterval < 0 {
+		problem("silencedetection.markerinterval must not be negative")
+	}
+	if d := cfg.Input.FallbackDevice; d != "stop" && d != "default" && d != "wait" {
+		problem("input.fallbackdevice %q must be stop, default or wait", d)
+	}
+	if o := cfg.Input.Overflow; o != "continue" && o != "silence" && o != "fail" {
+		problem("input.overflow %q must be continue, silence or fail", o)
+	}
+	if cfg.Input.OverflowGap <= 0 && cfg.Input.Overflow == "silence" {
+		problem("input.overflowgap must be positive to mark overflows with silence")
+	}
+	if _, ok := audio.ResampleQualities[cfg.Input.Resample]; !ok {
+		problem("input.resample %q must be linear, cubic, sinc-fast or sinc-best", cfg.Input.Resample)
+	}
+	if m := cfg.Input.ChannelMismatch; m != "error" && m != "downmix" && m != "duplicate" {
+		problem("input.channelmismatch %q must be error, downmix or duplicate", m)
+	}
+	return problems
+}
+
+// checkConfig validates the configuration and the environment it needs,
+// printing each problem without opening an audio stream. It returns the
+// exit status.
+func checkConfig() int {
+	problems := configProblems()
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if _, err := exec.LookPath(cfg.Encode.Encoder); err != nil && cfg.Encode.Auto {
+		problem("encoder %s was not found: %v", cfg.Encode.Encoder, err)
+	}
+	if err := writable(cfg.Output.Dir); err != nil {
+		problem("output.dir %s is not writable: %v", cfg.Output.Dir, err)
+	}
+	if cfg.Icecast.Enabled {
+		if _, err := exec.LookPath(icecastEncoder()[0]); err != nil {
+			problem("icecast: %v", err)
+		}
+	}
+	if args, err := commandArgs(cfg.Transcribe.Command); err == nil {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			problem("transcribe.command: %v", err)
+		}
+	}
+	if args, err := commandArgs(cfg.Location.Command); err == nil {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			problem("location.command: %v", err)
+		}
+	}
+	if cfg.Encode.Playlist != "" {
+		if _, err := loadPlaylist(cfg.Encode.Playlist); err != nil {
+			problem("encode.playlist: %v", err)
+		}
+	}
+
+	if cfg.Input.File != "" {
+		in := make([]int32, 64*cfg.Input.Channels)
+		if src, err := openInputFile(cfg.Input.File, in); err != nil {
+			problem("input.file: %v", err)
+		} else {
+			src.Close()
+		}
+	} else if err := portaudio.Initialize(); err != nil {
+		problem("PortAudio: %v", err)
+	} else if names := multitrackDevices(); names != nil {
+		for _, name := range names {
+			device, err := findInputDevice(name)
+			if err != nil {
+				problem("input.devices: %v", err)
+			} else if device.MaxInputChannels < cfg.Input.Channels/len(names) {
+				problem("input device %s has %d channels, %d are configured for each device", device.Name, device.MaxInputChannels, cfg.Input.Channels/len(names))
+			}
+		}
+		portaudio.Terminate()
+	} else {
+		device, err := inputDevice()
+		if err != nil {
+			problem("input device: %v", err)
+		} else if device.MaxInputChannels < cfg.Input.Channels {
+			problem("input device %s has %d channels, %d are configured", device.Name, device.MaxInputChannels, cfg.Input.Channels)
+		}
+		portaudio.Terminate()
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	say("Config OK")
+	return 0
+}
+
+// dumpConfig prints the configuration in effect after config.yml,
+// environment variables and flags are applied, as YAML in the layout of
+// config.yml or as JSON. Fields tagged secret are redacted.
+func dumpConfig(w io.Writer, asJSON bool) error {
+	values := configValues(reflect.ValueOf(cfg))
+	if asJSON {
+		out, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	}
+
+	var dump func(v reflect.Value, indent string)
+	dump = func(v reflect.Value, indent string) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name := field.Tag.Get("yaml")
+			if v.Field(i).Kind() == reflect.Struct {
+				if indent == "" && i > 0 {
+					fmt.Fprintln(w)
+				}
+				fmt.Fprintf(w, "%s%s:\n", indent, name)
+				dump(v.Field(i), indent+"  ")
+				continue
+			}
+
+			value := configValue(v.Field(i), field)
+			if v.Field(i).Kind() == reflect.String {
+				value = strconv.Quote(value.(string))
+			}
+			fmt.Fprintf(w, "%s%s: %v\n", indent, name, value)
+		}
+	}
+	dump(reflect.ValueOf(cfg), "")
+	return nil
+}
+
+// configValues maps a config struct's yaml names to their values
+func configValues(v reflect.Value) map[string]interface{} {
+	values := map[string]interface{}{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if v.Field(i).Kind() == reflect.Struct {
+			values[field.Tag.Get("yaml")] = configValues(v.Field(i))
+		} else {
+			values[field.Tag.Get("yaml")] = configValue(v.Field(i), field)
+		}
+	}
+	return values
+}
+
+// configValue is a setting as it should be shown, with durations written as
+// in config.yml and secrets that are set redacted
+func configValue(v reflect.Value, field reflect.StructField) interface{} {
+	if field.Tag.Get("secret") == "true" && !v.IsZero() {
+		return "REDACTED"
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return v.Interface()
+}
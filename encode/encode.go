@@ -0,0 +1,166 @@
+// Package encode runs lame or ffmpeg over recordings and spreads the encodes
+// of many recordings over a pool of workers.
+package encode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// Encoder is the program that encodes recordings and the format it writes
+type Encoder struct {
+	Program string // lame or ffmpeg
+	Format  string // mp3, or with ffmpeg also m4a, ogg, opus or flac
+	Nice    int    // niceness from 0 to 19 the encoder runs at
+}
+
+// Tags are the metadata written to an encoded file
+type Tags struct {
+	Artist   string
+	Title    string
+	Album    string // left out when empty
+	Track    string // left out when empty
+	Location string // ISO 6709 coordinates, or empty for none
+	Comment  string // left out when empty
+}
+
+// Command runs the encoder on a recording. ffmpeg picks the codec from the
+// output's extension, and each lossy codec is given the bitrate. chapters
+// names an ffmpeg metadata file whose chapters are embedded, or is empty.
+// The location is a user defined ID3 frame in MP3s and a location tag in
+// other formats. A positive Nice runs the encoder at a lower priority.
+func (e Encoder) Command(in, out, bitrate string, tags Tags, chapters string) *exec.Cmd {
+	if e.Program != "ffmpeg" {
+		args := []string{in, out, "-b", bitrate, "--ta", tags.Artist, "--tt", tags.Title}
+		if tags.Album != "" {
+			args = append(args, "--tl", tags.Album)
+		}
+		if tags.Track != "" {
+			args = append(args, "--tn", tags.Track)
+		}
+		if tags.Location != "" {
+			args = append(args, "--tv", "TXXX=location="+tags.Location)
+		}
+		if tags.Comment != "" {
+			args = append(args, "--tc", tags.Comment)
+		}
+		return lowerPriority(exec.Command("lame", args...), e.Nice)
+	}
+
+	args := []string{"-nostdin", "-y", "-loglevel", "error", "-stats", "-i", in}
+	if chapters != "" {
+		args = append(args, "-i", chapters, "-map", "0:a", "-map_chapters", "1")
+	}
+	args = append(args, "-metadata", "artist="+tags.Artist, "-metadata", "title="+tags.Title)
+	if tags.Album != "" {
+		args = append(args, "-metadata", "album="+tags.Album)
+	}
+	if tags.Track != "" {
+		args = append(args, "-metadata", "track="+tags.Track)
+	}
+	if tags.Location != "" {
+		args = append(args, "-metadata", "location="+tags.Location)
+	}
+	if tags.Comment != "" {
+		args = append(args, "-metadata", "comment="+tags.Comment)
+	}
+	codec := map[string]string{"mp3": "libmp3lame", "m4a": "aac", "ogg": "libvorbis", "opus": "libopus", "flac": "flac"}
+	args = append(args, "-c:a", codec[e.Format])
+	if e.Format != "flac" {
+		args = append(args, "-b:a", bitrate+"k")
+	}
+	return lowerPriority(exec.Command("ffmpeg", append(args, out)...), e.Nice)
+}
+
+// Pipe runs the encoder reading a WAV or AIFF file on stdin and writing the
+// encoded file to stdout, for a recording held in memory. m4a is written
+// fragmented as its index cannot be moved to the front of a pipe.
+func (e Encoder) Pipe(bitrate string) *exec.Cmd {
+	if e.Program != "ffmpeg" {
+		return lowerPriority(exec.Command("lame", "--quiet", "-b", bitrate, "-", "-"), e.Nice)
+	}
+
+	args := []string{"-nostdin", "-loglevel", "error", "-i", "pipe:0"}
+	codec := map[string]string{"mp3": "libmp3lame", "m4a": "aac", "ogg": "libvorbis", "opus": "libopus", "flac": "flac"}
+	args = append(args, "-c:a", codec[e.Format])
+	if e.Format != "flac" {
+		args = append(args, "-b:a", bitrate+"k")
+	}
+	muxer := map[string]string{"mp3": "mp3", "m4a": "ipod", "ogg": "ogg", "opus": "opus", "flac": "flac"}
+	if e.Format == "m4a" {
+		args = append(args, "-movflags", "frag_keyframe+empty_moov")
+	}
+	return lowerPriority(exec.Command("ffmpeg", append(args, "-f", muxer[e.Format], "pipe:1")...), e.Nice)
+}
+
+// Decode runs the encoder to decode an encoded file back to a WAV file,
+// lame only decoding MP3s
+func (e Encoder) Decode(in, out string) *exec.Cmd {
+	if e.Program != "ffmpeg" {
+		return lowerPriority(exec.Command("lame", "--quiet", "--decode", in, out), e.Nice)
+	}
+	return lowerPriority(exec.Command("ffmpeg", "-nostdin", "-y", "-loglevel", "error", "-i", in, "-f", "wav", out), e.Nice)
+}
+
+// Run starts an encoder command and waits for it, drawing its progress on
+// bar unless bar is nil. It returns whatever else the encoder printed, which
+// explains a failure.
+func Run(cmd *exec.Cmd, bar *ProgressBar) ([]byte, error) {
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// lame and ffmpeg redraw their progress lines with carriage returns;
+	// anything else they print is kept for the error message
+	var messages bytes.Buffer
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanLinesOrReturns)
+	for scanner.Scan() {
+		if m := lameProgress.FindSubmatch(scanner.Bytes()); m != nil {
+			if bar != nil {
+				percent, _ := strconv.Atoi(string(m[1]))
+				bar.set(percent)
+			}
+		} else if bytes.HasPrefix(scanner.Bytes(), []byte("size=")) {
+			// ffmpeg's stats give no percentage without the input duration
+			if bar != nil {
+				bar.spin()
+			}
+		} else if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			messages.Write(line)
+			messages.WriteByte('\n')
+			if bar != nil {
+				bar.spin()
+			}
+		}
+	}
+	// drain whatever a failed scan left so the encoder cannot block writing it
+	io.Copy(ioutil.Discard, stderr)
+	bar.done()
+
+	return bytes.TrimSpace(messages.Bytes()), cmd.Wait()
+}
+
+// lameProgress matches the percentage in lame's frame counter, such as
+// "  1234/5678  (22%)|"
+var lameProgress = regexp.MustCompile(`^\s*\d+/\d+\s+\(\s*(\d+)%\)`)
+
+// scanLinesOrReturns is a bufio.SplitFunc ending lines at \r as well as \n
+func scanLinesOrReturns(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,82 @@
+package encode
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log appends a record of each encoder run to a file, giving its command
+// line, what it printed and how it exited, so a failure in a long
+// unattended run can be looked into afterwards. Progress lines are left
+// out. A Log may be shared by encode workers, and a nil Log records nothing.
+type Log struct {
+	file string
+	mu   sync.Mutex
+}
+
+// NewLog appends to file, checking it can be opened
+func NewLog(file string) (*Log, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &Log{file: file}, nil
+}
+
+// Run runs an encoder command as the package Run does and records it
+func (l *Log) Run(cmd *exec.Cmd, bar *ProgressBar) ([]byte, error) {
+	if l == nil {
+		return Run(cmd, bar)
+	}
+
+	var stdout bytes.Buffer
+	if cmd.Stdout == nil {
+		cmd.Stdout = &stdout
+	}
+	start := time.Now()
+	messages, err := Run(cmd, bar)
+
+	var entry bytes.Buffer
+	fmt.Fprintf(&entry, "=== %s\n$ %s\n", start.Format("2006-01-02 15:04:05"), commandLine(cmd.Args))
+	if stdout.Len() > 0 {
+		fmt.Fprintf(&entry, "stdout:\n%s\n", bytes.TrimSpace(stdout.Bytes()))
+	}
+	if len(messages) > 0 {
+		fmt.Fprintf(&entry, "stderr:\n%s\n", messages)
+	}
+	status := "exit status 0"
+	if err != nil {
+		status = err.Error()
+	}
+	fmt.Fprintf(&entry, "%s after %v\n\n", status, time.Since(start).Round(time.Millisecond))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ferr := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if ferr != nil {
+		return messages, err
+	}
+	f.Write(entry.Bytes())
+	f.Close()
+	return messages, err
+}
+
+// commandLine quotes the arguments holding spaces or quotes so the line can
+// be pasted into a shell
+func commandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\$") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package encode
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// lowerPriority runs cmd through nice at the given niceness, from 1 to 19,
+// so encoding yields the CPU to recording. Zero leaves cmd as it is.
+func lowerPriority(cmd *exec.Cmd, nice int) *exec.Cmd {
+	if nice <= 0 {
+		return cmd
+	}
+	return exec.Command("nice", append([]string{"-n", strconv.Itoa(nice)}, cmd.Args...)...)
+}
@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package encode
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Windows priority classes passed as process creation flags
+const (
+	idlePriorityClass        = 0x00000040
+	belowNormalPriorityClass = 0x00004000
+)
+
+// lowerPriority starts cmd in a lower priority class, as Windows has no
+// niceness: below normal for a niceness from 1 to 14 and idle from 15 up.
+// Zero leaves cmd as it is.
+func lowerPriority(cmd *exec.Cmd, nice int) *exec.Cmd {
+	if nice <= 0 {
+		return cmd
+	}
+	class := uint32(belowNormalPriorityClass)
+	if nice >= 15 {
+		class = idlePriorityClass
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: class}
+	return cmd
+}
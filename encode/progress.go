@@ -0,0 +1,36 @@
+package encode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProgressBar draws an encode's progress on a single terminal line, falling
+// back to a spinner until a percentage is known
+type ProgressBar struct {
+	percent int
+	turns   int
+	drawn   bool
+}
+
+func (b *ProgressBar) set(percent int) {
+	b.percent = percent
+	b.drawn = true
+	fmt.Printf("\r[%-40s] %3d%%", strings.Repeat("=", percent*40/100), percent)
+}
+
+func (b *ProgressBar) spin() {
+	if b.percent > 0 {
+		return
+	}
+	b.drawn = true
+	fmt.Printf("\r%c", `|/-\`[b.turns%4])
+	b.turns++
+}
+
+// done ends the bar's line. It is safe to call on a nil bar.
+func (b *ProgressBar) done() {
+	if b != nil && b.drawn {
+		fmt.Println()
+	}
+}
@@ -0,0 +1,174 @@
+package encode
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Job is one encode of a recording, at a bitrate or as its preview. Input
+// is the file the encoder reads when it is a processed copy of Source.
+type Job struct {
+	Source  string
+	Input   string
+	Bitrate string
+	Preview bool
+}
+
+// Queue encodes recordings on a pool of background workers, one job per
+// recording and variant. Once every job for a recording has succeeded the
+// recording is handed to finish, which usually removes it. Adding jobs never
+// waits for a worker, so a recording loop can queue its recordings and carry
+// on capturing.
+type Queue struct {
+	mu         sync.Mutex
+	ready      *sync.Cond
+	pending    []queuedJob
+	closed     bool
+	unfinished int
+	completed  int
+	failed     int
+	done       chan struct{}
+	wg         sync.WaitGroup
+	encode     func(Job) error
+	finish     func(source string) error
+}
+
+type queuedJob struct {
+	Job
+	variants *variants
+}
+
+// variants tracks the jobs of one recording still being encoded so the
+// recording is finished only after all of them succeed
+type variants struct {
+	remaining int32
+	failed    int32
+}
+
+// NewQueue starts the given number of workers, or one per CPU if workers is
+// not positive, each running encode on the jobs it is given
+func NewQueue(workers int, encode func(Job) error, finish func(source string) error) *Queue {
+	q := &Queue{done: make(chan struct{}), encode: encode, finish: finish}
+	q.ready = sync.NewCond(&q.mu)
+	for i := 0; i < Workers(workers); i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for {
+				job, ok := q.next()
+				if !ok {
+					return
+				}
+				q.run(job)
+			}
+		}()
+	}
+	return q
+}
+
+// Workers is the number of workers a queue asked for workers starts
+func Workers(workers int) int {
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// next waits for a job to run, returning false once the queue is closed and
+// empty
+func (q *Queue) next() (queuedJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if len(q.pending) == 0 {
+		return queuedJob{}, false
+	}
+	job := q.pending[0]
+	q.pending = q.pending[1:]
+	return job, true
+}
+
+func (q *Queue) run(job queuedJob) {
+	err := q.encode(job.Job)
+	encoded := err == nil
+	if err != nil {
+		atomic.StoreInt32(&job.variants.failed, 1)
+	} else if atomic.AddInt32(&job.variants.remaining, -1) == 0 && atomic.LoadInt32(&job.variants.failed) == 0 {
+		err = q.finish(job.Source)
+	}
+	if err != nil {
+		log.Println("[Encoding] ", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.unfinished--
+	if encoded {
+		q.completed++
+	}
+	if err != nil {
+		q.failed++
+	}
+}
+
+// Add queues the jobs for one recording without waiting for them to start
+func (q *Queue) Add(jobs []Job) {
+	v := &variants{remaining: int32(len(jobs))}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		panic("encode: Add on a closed queue")
+	}
+	for _, job := range jobs {
+		q.pending = append(q.pending, queuedJob{Job: job, variants: v})
+	}
+	q.unfinished += len(jobs)
+	q.ready.Broadcast()
+}
+
+// Close stops accepting recordings and returns a channel that is closed once
+// every queued encode is done. It may be called more than once.
+func (q *Queue) Close() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.ready.Broadcast()
+		go func() {
+			q.wg.Wait()
+			close(q.done)
+		}()
+	}
+	return q.done
+}
+
+// Wait stops accepting recordings and blocks until every queued encode is
+// done
+func (q *Queue) Wait() {
+	<-q.Close()
+}
+
+// Completed counts the jobs that encoded successfully
+func (q *Queue) Completed() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.completed
+}
+
+// Unfinished counts the jobs queued or still encoding
+func (q *Queue) Unfinished() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.unfinished
+}
+
+// Failed counts the jobs and finishes that failed
+func (q *Queue) Failed() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.failed
+}
@@ -0,0 +1,158 @@
+package encode
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueFinishesRecordings(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		jobs         []Job
+		fail         string // bitrate whose encode fails
+		wantFinished bool
+		wantFailed   int
+	}{
+		{"one job", []Job{{Source: "a.aiff", Bitrate: "128"}}, "", true, 0},
+		{"every variant", []Job{{Source: "a.aiff", Bitrate: "128"}, {Source: "a.aiff", Bitrate: "320"}, {Source: "a.aiff", Preview: true}}, "", true, 0},
+		{"a failed variant keeps the recording", []Job{{Source: "a.aiff", Bitrate: "128"}, {Source: "a.aiff", Bitrate: "320"}}, "320", false, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var finished []string
+			encoded := 0
+			q := NewQueue(2, func(job Job) error {
+				mu.Lock()
+				defer mu.Unlock()
+				encoded++
+				if test.fail != "" && job.Bitrate == test.fail {
+					return errors.New("encoder failed")
+				}
+				return nil
+			}, func(source string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				finished = append(finished, source)
+				return nil
+			})
+			q.Add(test.jobs)
+			q.Wait()
+
+			if encoded != len(test.jobs) {
+				t.Errorf("%d jobs encoded, want %d", encoded, len(test.jobs))
+			}
+			if got := len(finished) == 1; got != test.wantFinished {
+				t.Errorf("recording finished %d times, want finished %v", len(finished), test.wantFinished)
+			}
+			if q.Failed() != test.wantFailed {
+				t.Errorf("Failed() = %d, want %d", q.Failed(), test.wantFailed)
+			}
+		})
+	}
+}
+
+func TestQueueFinishesAfterPreview(t *testing.T) {
+	release := make(chan struct{})
+	finished := make(chan string, 1)
+	q := NewQueue(2, func(job Job) error {
+		if job.Preview {
+			<-release
+		}
+		return nil
+	}, func(source string) error {
+		finished <- source
+		return nil
+	})
+	q.Add([]Job{{Source: "a.aiff", Preview: true}, {Source: "a.aiff", Bitrate: "128"}})
+
+	for q.Completed() < 1 {
+		runtime.Gosched()
+	}
+	select {
+	case <-finished:
+		t.Fatal("recording finished while its preview was still encoding")
+	default:
+	}
+	close(release)
+	q.Wait()
+	if source := <-finished; source != "a.aiff" {
+		t.Errorf("finished %q, want a.aiff", source)
+	}
+}
+
+func TestQueueCountsFailedFinish(t *testing.T) {
+	q := NewQueue(1, func(Job) error { return nil }, func(string) error { return errors.New("cannot remove") })
+	q.Add([]Job{{Source: "a.aiff"}})
+	q.Add([]Job{{Source: "b.aiff"}})
+	q.Wait()
+	if q.Failed() != 2 {
+		t.Errorf("Failed() = %d, want 2", q.Failed())
+	}
+}
+
+func TestQueueRetriesOnWorkers(t *testing.T) {
+	const backoff = 100 * time.Millisecond
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	q := NewQueue(1, func(job Job) error {
+		return Retry(job.Source, 1, backoff, func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts[job.Source]++
+			if attempts[job.Source] == 1 {
+				return errors.New("encoder failed")
+			}
+			return nil
+		})
+	}, func(string) error { return nil })
+
+	start := time.Now()
+	q.Add([]Job{{Source: "a.aiff"}})
+	q.Add([]Job{{Source: "b.aiff"}})
+	if waited := time.Since(start); waited >= backoff {
+		t.Errorf("Add waited %v for a retry", waited)
+	}
+	q.Wait()
+	if q.Completed() != 2 || q.Failed() != 0 {
+		t.Errorf("%d completed and %d failed, want 2 and 0", q.Completed(), q.Failed())
+	}
+}
+
+func TestRetry(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		retries   int
+		failures  int // attempts that fail before one succeeds
+		wantRuns  int
+		wantError string
+	}{
+		{"first attempt succeeds", 3, 0, 1, ""},
+		{"succeeds on a retry", 3, 2, 3, ""},
+		{"gives up", 2, 5, 3, "giving up after 2 retries"},
+		{"no retries", 0, 1, 1, "encoder failed"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			runs := 0
+			err := Retry("a.aiff", test.retries, 0, func() error {
+				runs++
+				if runs <= test.failures {
+					return errors.New("encoder failed")
+				}
+				return nil
+			})
+			if runs != test.wantRuns {
+				t.Errorf("encode ran %d times, want %d", runs, test.wantRuns)
+			}
+			switch {
+			case test.wantError == "" && err != nil:
+				t.Errorf("Retry returned %v, want success", err)
+			case test.wantError != "" && (err == nil || !strings.Contains(err.Error(), test.wantError)):
+				t.Errorf("Retry returned %v, want an error containing %q", err, test.wantError)
+			}
+		})
+	}
+}
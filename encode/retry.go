@@ -0,0 +1,28 @@
+package encode
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Retry runs an encode of source, running it again up to retries times
+// while it fails, waiting backoff before the first retry and twice as long
+// before each one after. The recording is left alone throughout, so every
+// attempt encodes the same preserved source. It sleeps between attempts, so
+// it runs on a queue worker and never in a recording loop.
+func Retry(source string, retries int, backoff time.Duration, encode func() error) error {
+	err := encode()
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		delay := backoff << uint(attempt)
+		log.Printf("[Encoding] %v - retrying %s in %v", err, source, delay)
+		time.Sleep(delay)
+		if err = encode(); err == nil {
+			log.Printf("[Encoding] %s encoded on retry %d", source, attempt+1)
+		}
+	}
+	if err != nil && retries > 0 {
+		return fmt.Errorf("%v, giving up after %d retries", err, retries)
+	}
+	return err
+}
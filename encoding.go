@@ -0,0 +1,924 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+
+	"github.com/1hitsong/Go-Record-Audio/encode"
+	"github.com/1hitsong/Go-Record-Audio/recorder"
+)
+
+// encodeRecording encodes a finished recording, exiting if that fails
+// unless encode errors are only logged. Its spectrogram is drawn first, as
+// the recording is removed once encoded. With auto naming the recording is
+// first renamed after its opening words, and the name it ends up with is
+// returned. Split channels are each encoded from their own file.
+func encodeRecording(fileName string) string {
+	if cfg.QuietRecordings.Threshold < 0 && deleteIfQuiet(fileName) {
+		return fileName
+	}
+	if !cfg.Output.SplitChannels {
+		return encodeRecordingFile(fileName)
+	}
+	for _, name := range recordingFiles(fileName) {
+		encodeRecordingFile(name)
+	}
+	return fileName
+}
+
+// deleteIfQuiet deletes a finished recording whose level never reaches the
+// quiet threshold, such as a false trigger, reporting whether it did. With
+// split channels the loudest channel decides.
+func deleteIfQuiet(fileName string) bool {
+	level := 0.0
+	for _, name := range recordingFiles(fileName) {
+		peak, rms, err := measureFile(name)
+		if err != nil {
+			log.Println("[Quiet] ", err, "- keeping", fileName)
+			return false
+		}
+		if cfg.QuietRecordings.Measure == "rms" {
+			peak = rms
+		}
+		level = math.Max(level, peak)
+	}
+
+	db := 20 * math.Log10(level+1e-12)
+	if db >= cfg.QuietRecordings.Threshold {
+		return false
+	}
+	log.Printf("[Quiet] deleting %s, its %s level of %.1f dBFS is below %v dBFS", filepath.Base(fileName), cfg.QuietRecordings.Measure, db, cfg.QuietRecordings.Threshold)
+	if err := discardRecording(fileName); err != nil {
+		log.Println("[Quiet] ", err)
+	}
+	return true
+}
+
+// encodeRecordingFile processes and encodes one file of a recording
+func encodeRecordingFile(fileName string) string {
+	if err := processRecording(fileName); err != nil {
+		log.Println("[Processing] ", err, "- encoding it unprocessed")
+	}
+	if cfg.Transcribe.AutoName {
+		fileName = autoName(fileName)
+	}
+	if cfg.Spectrogram.File != "" {
+		if err := writeSpectrogram(fileName); err != nil {
+			log.Println("[Spectrogram] ", err)
+		}
+	}
+	if !cfg.Encode.Auto {
+		say("Keeping", fileName, "to encode later")
+		return fileName
+	}
+	encodeFile(fileName)
+	return fileName
+}
+
+// encodeFile queues a recording to be converted to MP3 at each configured
+// bitrate, tagged from its "artist - title" file name. The recording encodes
+// queue removes it once every bitrate succeeds, retrying failed encodes as
+// configured, while recording carries on.
+func encodeFile(fileName string) {
+	recordingEncodes.Add(encodeJobs(fileName))
+}
+
+// removeRecording deletes an encoded recording along with its chapters
+func removeRecording(fileName string) error {
+	if err := os.Remove(chaptersName(fileName)); err != nil && !os.IsNotExist(err) {
+		log.Println("[Chapters] ", err)
+	}
+	return os.Remove(fileName)
+}
+
+// encodeAt encodes a recording at one bitrate from input, the recording
+// itself or a normalized copy of it, and starts its post processing
+func encodeAt(fileName, input, bitrate string) error {
+	tags := encodeTags(fileName)
+	out := encodedNameAt(fileName, bitrate)
+
+	say(cfg.Messages.Encoding, tags.Artist, tags.Title)
+
+	var bar *encode.ProgressBar
+	if showProgress && !cfg.Messages.Quiet {
+		bar = &encode.ProgressBar{}
+	}
+	if messages, err := encodeLog.Run(encoder().Command(input, out, bitrate, tags, existingChapters(fileName)), bar); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", cfg.Encode.Encoder, fileName, err, messages)
+	}
+
+	if cfg.Encode.Verify {
+		if err := verifyEncode(fileName, out); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Tags.Retag {
+		if err := retag(out, fileName); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Output.FileMode != "" {
+		if err := os.Chmod(out, fileMode); err != nil {
+			return err
+		}
+	}
+
+	if loc, ok := locationFor(fileName); ok && cfg.Location.Sidecar {
+		if err := writeLocationSidecar(out, loc); err != nil {
+			log.Println("[Location] ", err)
+		}
+	}
+
+	background.Add(1)
+	go postProcess(out, fileName)
+	return nil
+}
+
+// encodePreview encodes the start of a recording at the preview bitrate,
+// tagged as the recording is
+func encodePreview(fileName string) error {
+	preview, err := writePreview(fileName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(preview)
+
+	out := previewName(fileName)
+	if messages, err := encodeLog.Run(encoderCommand(preview, out, cfg.Encode.PreviewBitrate, encodeTags(fileName)), nil); err != nil {
+		return fmt.Errorf("%s preview of %s: %v: %s", cfg.Encode.Encoder, fileName, err, messages)
+	}
+
+	if cfg.Output.FileMode != "" {
+		if err := os.Chmod(out, fileMode); err != nil {
+			return err
+		}
+	}
+
+	background.Add(1)
+	go postProcess(out, fileName)
+	return nil
+}
+
+// writePreview copies the first preview length of a recording to a
+// temporary recording beside it, returning its name
+func writePreview(fileName string) (string, error) {
+	return writeExcerpt(fileName, ".preview", cfg.Encode.Preview)
+}
+
+// writeExcerpt copies the first length of a recording to a temporary
+// recording beside it, named with suffix, returning its name
+func writeExcerpt(fileName, suffix string, length time.Duration) (string, error) {
+	in := make([]int32, 64*cfg.Input.Channels)
+	src, err := openInputFile(fileName, in)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	name := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + suffix + recordingExt()
+	r, err := recorder.Create(fileOpener(), name, recordingFormat())
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+
+	n := 0
+	limit := samplesIn(length)
+	for n < limit {
+		if err := src.Read(); err == io.EOF {
+			break
+		} else if err != nil {
+			CloseRecording(r, n)
+			os.Remove(name)
+			return "", err
+		}
+		samples := in
+		if limit-n < len(samples) {
+			samples = samples[:limit-n]
+		}
+		writeSamples(r, samples)
+		n += len(samples)
+	}
+	CloseRecording(r, n)
+	return name, nil
+}
+
+// previewName is the file a recording's preview is encoded to
+func previewName(fileName string) string {
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".preview." + cfg.Encode.Format
+}
+
+// retag replaces the tags the encoder wrote with ones holding the artist
+// and title of the recording it came from and the configured tags: an ID3v2
+// tag in an MP3 and Vorbis comments in FLAC, Ogg and Opus files. The audio is
+// copied to a new file rather than read into memory.
+func retag(file, recording string) error {
+	tags, err := fileTagsFor(recording)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := file + ".tmp"
+	dst, err := createFile(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(dst)
+	switch filepath.Ext(file) {
+	case ".flac":
+		err = writeFLACTags(src, w, tags)
+	case ".ogg", ".opus":
+		err = writeOggTags(src, w, tags)
+	default:
+		err = writeID3Tag(src, w, tags)
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: %v", file, err)
+	} else {
+		err = w.Flush()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// fileTags are the tags retag writes, whatever the format. Empty fields are
+// left out.
+type fileTags struct {
+	artist, title, album, albumArtist, composer string
+	track, trackTotal                           int
+	location, comment, provenance               string
+	cover                                       []byte
+}
+
+// fileTagsFor gathers the tags of a recording
+func fileTagsFor(recording string) (fileTags, error) {
+	t := fileTags{
+		album:       albumFor(recording),
+		albumArtist: cfg.Tags.AlbumArtist,
+		composer:    cfg.Tags.Composer,
+		comment:     cfg.Tags.Comment,
+		provenance:  provenanceFor(recording),
+	}
+	t.artist, t.title = tagsFor(recording)
+	if n, ok := takeNumber(recording); ok {
+		t.track = n
+	} else if v, ok := segmentStarts.Load(recording); ok {
+		t.track = v.(segmentStart).index + 1
+		t.trackTotal = cfg.Tags.TrackTotal
+	}
+	if loc, ok := locationFor(recording); ok {
+		t.location = loc.iso6709()
+	}
+	if cfg.Tags.Cover != "" {
+		var err error
+		if t.cover, err = ioutil.ReadFile(cfg.Tags.Cover); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// writeID3Tag copies an MP3 to w with its ID3v2 tag replaced by one holding
+// the tags
+func writeID3Tag(src *os.File, w io.Writer, t fileTags) error {
+	track := ""
+	if t.track > 0 {
+		track = strconv.Itoa(t.track)
+		if t.trackTotal > 0 {
+			track += "/" + strconv.Itoa(t.trackTotal)
+		}
+	}
+	frames := []id3Frame{
+		textFrame("TPE1", t.artist),
+		textFrame("TIT2", t.title),
+		textFrame("TALB", t.album),
+		textFrame("TPE2", t.albumArtist),
+		textFrame("TCOM", t.composer),
+		textFrame("TRCK", track),
+	}
+	if t.location != "" {
+		// latin-1, the description then the value, as ffmpeg writes it
+		frames = append(frames, id3Frame{"TXXX", []byte("\x00location\x00" + t.location)})
+	}
+	if t.comment != "" {
+		// language, then an empty description before the text
+		data := append([]byte{1, 'e', 'n', 'g'}, utf16String("")...)
+		frames = append(frames, id3Frame{"COMM", append(data, utf16String(t.comment)...)})
+	}
+	if t.provenance != "" {
+		// a comment of its own, described so it sits beside the user's
+		data := append([]byte{1, 'e', 'n', 'g'}, utf16String("provenance")...)
+		frames = append(frames, id3Frame{"COMM", append(data, utf16String(t.provenance)...)})
+	}
+	if t.cover != nil {
+		// latin-1 MIME type, front cover picture type and no description
+		data := append([]byte{0}, http.DetectContentType(t.cover)...)
+		data = append(data, 0, 3, 0)
+		frames = append(frames, id3Frame{"APIC", append(data, t.cover...)})
+	}
+
+	audio, err := skipID3v2(src)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(id3v2Tag(frames)); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, audio)
+	return err
+}
+
+// id3Frame is an ID3v2.3 frame's id and contents. Frames with no contents are
+// left out of the tag.
+type id3Frame struct {
+	id   string
+	data []byte
+}
+
+// textFrame is a text information frame in UTF-16
+func textFrame(id, text string) id3Frame {
+	if text == "" {
+		return id3Frame{id: id}
+	}
+	return id3Frame{id, append([]byte{1}, utf16String(text)...)}
+}
+
+// utf16String encodes text as ID3v2.3 UTF-16: a byte order mark, the little
+// endian code units and a two byte terminator
+func utf16String(text string) []byte {
+	out := []byte{0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune(text)) {
+		out = append(out, byte(u), byte(u>>8))
+	}
+	return append(out, 0, 0)
+}
+
+// id3v2Tag builds an ID3v2.3 tag from its frames
+func id3v2Tag(frames []id3Frame) []byte {
+	var body bytes.Buffer
+	for _, frame := range frames {
+		if len(frame.data) == 0 {
+			continue
+		}
+		body.WriteString(frame.id)
+		binary.Write(&body, binary.BigEndian, uint32(len(frame.data)))
+		body.Write([]byte{0, 0}) //flags
+		body.Write(frame.data)
+	}
+
+	// the tag size is stored in 7 bit bytes so it never looks like a frame sync
+	size := body.Len()
+	header := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(header, body.Bytes()...)
+}
+
+// skipID3v2 positions f after any ID3v2 tag at its start and returns it
+func skipID3v2(f *os.File) (io.Reader, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	if string(header[:3]) != "ID3" {
+		_, err := f.Seek(0, io.SeekStart)
+		return f, err
+	}
+
+	size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9])
+	if header[5]&0x10 != 0 {
+		size += 10 // footer
+	}
+	_, err := f.Seek(10+size, io.SeekStart)
+	return f, err
+}
+
+// encoderCommand runs the configured encoder, embedding the recording's
+// chapters when it has any
+func encoderCommand(fileName, out, bitrate string, tags encode.Tags) *exec.Cmd {
+	return encoder().Command(fileName, out, bitrate, tags, existingChapters(fileName))
+}
+
+// existingChapters is the chapters file of a recording, or empty when it
+// has none
+func existingChapters(fileName string) string {
+	if chapters := chaptersName(fileName); fileExists(chapters) {
+		return chapters
+	}
+	return ""
+}
+
+// encoder is the configured encoder
+func encoder() encode.Encoder {
+	return encode.Encoder{Program: cfg.Encode.Encoder, Format: cfg.Encode.Format, Nice: cfg.Encode.Nice}
+}
+
+// verifyTolerance is how far the decoded length of an encoded file may be
+// from its recording's, allowing for encoder delay and padding
+const verifyTolerance = 200 * time.Millisecond
+
+// verifyEncode decodes an encoded file to a temporary WAV beside it and
+// checks it lasts as long as its recording, catching a truncated or garbled
+// encode before the recording is removed
+func verifyEncode(fileName, out string) error {
+	src, err := openAudioFile(fileName, nil)
+	if err != nil {
+		return err
+	}
+	src.Close()
+
+	wav := strings.TrimSuffix(out, filepath.Ext(out)) + ".verify.wav"
+	defer os.Remove(wav)
+	if messages, err := encodeLog.Run(encoder().Decode(out, wav), nil); err != nil {
+		return fmt.Errorf("verifying %s: %v: %s", out, err, messages)
+	}
+	decoded, err := openAudioFile(wav, nil)
+	if err != nil {
+		return fmt.Errorf("verifying %s: %v", out, err)
+	}
+	decoded.Close()
+
+	if diff := decoded.length() - src.length(); diff > verifyTolerance || diff < -verifyTolerance {
+		return fmt.Errorf("verifying %s: it decodes to %v of audio but %s holds %v", out, decoded.length().Round(time.Millisecond), filepath.Base(fileName), src.length().Round(time.Millisecond))
+	}
+	return nil
+}
+
+// encodeTags are the tags encoded files of a recording are given
+func encodeTags(recording string) encode.Tags {
+	artist, title := tagsFor(recording)
+	tags := encode.Tags{Artist: artist, Title: title, Album: albumFor(recording)}
+	if n, ok := takeNumber(recording); ok {
+		tags.Track = strconv.Itoa(n)
+	}
+	if loc, ok := locationFor(recording); ok {
+		tags.Location = loc.iso6709()
+	}
+	tags.Comment = provenanceFor(recording)
+	return tags
+}
+
+// chapter is a named point in a recording. Chapters without a title are
+// numbered.
+type chapter struct {
+	start time.Duration
+	title string
+}
+
+// chaptersName is the ffmpeg metadata file holding a recording's chapters
+func chaptersName(fileName string) string {
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".chapters"
+}
+
+// writeChapters saves chapters for a recording of the given length in
+// ffmpeg's metadata format, where each chapter ends where the next begins
+func writeChapters(fileName string, chapters []chapter, length time.Duration) error {
+	escape := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n")
+
+	var meta bytes.Buffer
+	meta.WriteString(";FFMETADATA1\n")
+	for i, c := range chapters {
+		end := length
+		if i+1 < len(chapters) {
+			end = chapters[i+1].start
+		}
+		title := c.title
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		fmt.Fprintf(&meta, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			c.start.Milliseconds(), end.Milliseconds(), escape.Replace(title))
+	}
+	return writeFile(chaptersName(fileName), meta.Bytes())
+}
+
+// prepareChapters writes the chapters of the chapter file for a recording
+// about to be encoded, unless chapters were already saved while recording
+func prepareChapters(fileName string) {
+	if cfg.Encode.ChapterFile == "" || fileExists(chaptersName(fileName)) {
+		return
+	}
+
+	chapters, err := readChapterFile(cfg.Encode.ChapterFile)
+	if err == nil {
+		var src *fileSource
+		if src, err = openInputFile(fileName, nil); err == nil {
+			src.Close()
+			err = writeChapters(fileName, chapters, src.length())
+		}
+	}
+	if err != nil {
+		log.Println("[Chapters] ", err)
+	}
+}
+
+// readChapterFile reads lines of a start time followed by a chapter name,
+// such as 1:02:30 Questions. Blank lines and lines starting with # are
+// skipped.
+func readChapterFile(path string) ([]chapter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chapters []chapter
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		start, err := parseTimestamp(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, n+1, err)
+		}
+		c := chapter{start: start}
+		if len(fields) == 2 {
+			c.title = strings.TrimSpace(fields[1])
+		}
+		chapters = append(chapters, c)
+	}
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].start < chapters[j].start })
+	return chapters, nil
+}
+
+// parseTimestamp reads seconds, minutes:seconds or hours:minutes:seconds,
+// where the seconds may have a fraction
+func parseTimestamp(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+
+	total := float64(0)
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || (i < len(parts)-1 && v != math.Trunc(v)) {
+			return 0, fmt.Errorf("bad time %q", s)
+		}
+		total = total*60 + v
+	}
+	return time.Duration(total * float64(time.Second)), nil
+}
+
+// encodeBitrates lists the bitrates every recording is encoded at, the
+// bitrates list when one is set and otherwise the single bitrate
+func encodeBitrates() []string {
+	if cfg.Encode.Bitrates == "" {
+		return []string{cfg.Encode.Bitrate}
+	}
+
+	var bitrates []string
+	for _, bitrate := range strings.Split(cfg.Encode.Bitrates, ",") {
+		bitrates = append(bitrates, strings.TrimSpace(bitrate))
+	}
+	return bitrates
+}
+
+// mp3Bitrates are the constant bitrates lame writes MP3s at
+var mp3Bitrates = []int{8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+
+// minUsableBitrate is the lowest bitrate worth listening to; fitting the
+// target size below it is warned about
+const minUsableBitrate = 32
+
+// targetBitrateFor picks the bitrate a recording is encoded at to fit the
+// target size from its length
+func targetBitrateFor(fileName string) string {
+	src, err := openInputFile(fileName, nil)
+	if err != nil {
+		log.Println("[Target size] ", err, "- encoding at", cfg.Encode.Bitrate, "kbps")
+		return cfg.Encode.Bitrate
+	}
+	src.Close()
+	return strconv.Itoa(targetBitrate(src.length(), filepath.Base(fileName)))
+}
+
+// targetBitrate is the highest bitrate in kbps at which length of audio fits
+// the target size, leaving room for tags, warning about what as needed
+func targetBitrate(length time.Duration, what string) int {
+	target, _ := parseSize(cfg.Encode.TargetSize)
+	overhead := int64(64 << 10)
+	if cfg.Tags.Retag && cfg.Tags.Cover != "" {
+		if info, err := os.Stat(cfg.Tags.Cover); err == nil {
+			overhead += info.Size()
+		}
+	}
+
+	kbps := 320
+	if length > 0 {
+		// keep 1% back for frame padding and container overhead
+		kbps = int(float64(target-overhead) * 8 / length.Seconds() / 1000 * 0.99)
+	}
+	if kbps > 320 {
+		kbps = 320
+	}
+	if cfg.Encode.Format == "mp3" {
+		fitted := mp3Bitrates[0]
+		for _, b := range mp3Bitrates {
+			if b <= kbps {
+				fitted = b
+			}
+		}
+		if kbps < fitted {
+			log.Printf("[Target size] %s needs %d kbps to fit %s, under the lowest MP3 bitrate, so it will be larger", what, kbps, cfg.Encode.TargetSize)
+		}
+		kbps = fitted
+	} else if kbps < 8 {
+		log.Printf("[Target size] %s needs %d kbps to fit %s, so it will be larger", what, kbps, cfg.Encode.TargetSize)
+		kbps = 8
+	}
+	if kbps < minUsableBitrate {
+		log.Printf("[Target size] %s is encoded at %d kbps to fit %s, below the usable %d kbps", what, kbps, cfg.Encode.TargetSize, minUsableBitrate)
+	}
+	return kbps
+}
+
+// parseSize reads a size in bytes with an optional KB, MB or GB suffix, or
+// KiB, MiB or GiB for powers of 1024
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		bytes  float64
+	}{{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"b", 1}}
+	lower := strings.ToLower(strings.TrimSpace(s))
+	scale := 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, scale = strings.TrimSpace(strings.TrimSuffix(lower, unit.suffix)), unit.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(lower, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("size %q must be a positive number of bytes, optionally with KB, MB or GB", s)
+	}
+	return int64(n * scale), nil
+}
+
+// tagsFor returns the artist and title of a recording from the playlist
+// when one is loaded, otherwise from its "artist - title" file name
+func tagsFor(fileName string) (string, string) {
+	artist := cfg.Encode.DefaultArtist
+	title := cfg.Encode.DefaultTitle
+
+	if n, ok := takeNumber(fileName); ok {
+		return artist, fmt.Sprintf("%s (Take %d)", cfg.Take.Name, n)
+	}
+	if playlist != nil {
+		if entry, ok := playlistEntryFor(fileName); ok {
+			artist = entry.Artist
+			title = entry.Title
+		}
+		return artist, title
+	}
+
+	baseName := filepath.Base(fileName)
+	if strings.Index(baseName, " - ") > 1 {
+		spl := strings.Split(strings.TrimSuffix(baseName, filepath.Ext(baseName)), " - ")
+		if len(spl) > 1 {
+			artist = spl[0]
+			title = spl[1]
+		}
+	}
+	return artist, title
+}
+
+// playlistEntry gives the artist and title for a segment, matched by its
+// index in this session or else by the time it started
+type playlistEntry struct {
+	Segment *int      `json:"segment"`
+	Start   time.Time `json:"start"`
+	Artist  string    `json:"artist"`
+	Title   string    `json:"title"`
+}
+
+// segmentStart records when and in which order a recording was started
+type segmentStart struct {
+	index int
+	at    time.Time
+}
+
+var (
+	playlist      []playlistEntry
+	segmentStarts sync.Map
+	segmentCount  int32
+)
+
+func noteSegmentStart(fileName string) {
+	index := int(atomic.AddInt32(&segmentCount, 1)) - 1
+	segmentStarts.Store(fileName, segmentStart{index: index, at: time.Now()})
+}
+
+// playlistEntryFor prefers an entry for the recording's segment index, then
+// the latest entry starting at or before the recording
+func playlistEntryFor(fileName string) (playlistEntry, bool) {
+	v, ok := segmentStarts.Load(fileName)
+	if !ok {
+		return playlistEntry{}, false
+	}
+	start := v.(segmentStart)
+
+	for _, entry := range playlist {
+		if entry.Segment != nil && *entry.Segment == start.index {
+			return entry, true
+		}
+	}
+
+	var match playlistEntry
+	found := false
+	for _, entry := range playlist {
+		if entry.Start.IsZero() || entry.Start.After(start.at) {
+			continue
+		}
+		if !found || entry.Start.After(match.Start) {
+			match = entry
+			found = true
+		}
+	}
+	return match, found
+}
+
+// loadPlaylist reads a JSON array of entries, or a CSV file with a header
+// row naming the segment, start, artist and title columns. Start times are
+// RFC 3339.
+func loadPlaylist(name string) ([]playlistEntry, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []playlistEntry
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return entries, nil
+	}
+
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(rows) == 0 {
+		return entries, nil
+	}
+
+	columns := map[string]int{}
+	for i, heading := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(heading))] = i
+	}
+	field := func(row []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	for line, row := range rows[1:] {
+		entry := playlistEntry{Artist: field(row, "artist"), Title: field(row, "title")}
+		if v := field(row, "segment"); v != "" {
+			segment, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad segment %q", name, line+2, v)
+			}
+			entry.Segment = &segment
+		}
+		if v := field(row, "start"); v != "" {
+			if entry.Start, err = time.Parse(time.RFC3339, v); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad start %q", name, line+2, v)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// encodeFiles encodes existing recordings in parallel without recording
+// anything, reporting whether all of them succeeded
+func encodeFiles(fileNames []string) bool {
+	if len(fileNames) == 0 {
+		log.Println("encode: no files given")
+		return false
+	}
+
+	q := newEncodeQueue(cfg.Encode.Workers, encodeWithRetries)
+	for _, fileName := range fileNames {
+		q.Add(encodeJobs(fileName))
+	}
+	q.Wait()
+	return q.Failed() == 0
+}
+
+// newEncodeQueue starts workers running each encode of a recording, removing
+// the recording once all of its encodes succeed
+func newEncodeQueue(workers int, run func(encode.Job) error) *encode.Queue {
+	if encode.Workers(workers) > 1 {
+		showProgress = false
+	}
+	return encode.NewQueue(workers, run, removeRecording)
+}
+
+// newRecordingQueue starts the workers encoding recordings as they finish. A
+// failed encode keeps its recording, and ends the program unless the
+// recording mode carries on past encode errors.
+func newRecordingQueue(workers int) *encode.Queue {
+	return newEncodeQueue(workers, func(job encode.Job) error {
+		err := encodeWithRetries(job)
+		if err != nil && !continueOnEncodeError {
+			log.Fatal(err)
+		}
+		if err != nil {
+			return fmt.Errorf("%v - keeping %s", err, job.Source)
+		}
+		return nil
+	})
+}
+
+// encodeWithRetries runs one encode of a recording, retrying it as
+// configured when it fails
+func encodeWithRetries(job encode.Job) error {
+	if !job.Preview {
+		defer releaseInput(job.Input)
+	}
+	return encode.Retry(job.Source, cfg.Encode.Retries, cfg.Encode.RetryDelay, func() error {
+		if job.Preview {
+			return encodePreview(job.Source)
+		}
+		return encodeAt(job.Source, job.Input, job.Bitrate)
+	})
+}
+
+// encodeJobs lists the encodes of a recording, one per bitrate and its
+// preview when one is wanted. The bitrates are all encoded from one
+// normalized copy when the encode format has a peak of its own.
+func encodeJobs(fileName string) []encode.Job {
+	prepareChapters(fileName)
+	input, err := normalizedCopy(fileName)
+	if err != nil {
+		log.Println("[Processing] normalizing", fileName, "for", cfg.Encode.Format, err, "- encoding it as it is")
+		input = fileName
+	}
+	var jobs []encode.Job
+	if cfg.Encode.TargetSize != "" {
+		jobs = append(jobs, encode.Job{Source: fileName, Input: input, Bitrate: targetBitrateFor(fileName)})
+	} else {
+		for _, bitrate := range encodeBitrates() {
+			jobs = append(jobs, encode.Job{Source: fileName, Input: input, Bitrate: bitrate})
+		}
+	}
+	if input != fileName {
+		users := int32(len(jobs))
+		inputUsers.Store(input, &users)
+	}
+	if cfg.Encode.Preview > 0 {
+		jobs = append(jobs, encode.Job{Source: fileName, Preview: true})
+	}
+	return jobs
+}
+
+// inputUsers counts, for each normalized copy, the encodes yet to finish
+// reading it, as they may run at once on different workers
+var inputUsers sync.Map
+
+// releaseInput removes a normalized copy once the last encode reading it
+// has finished, whether or not it succeeded
+func releaseInput(input string) {
+	users, ok := inputUsers.Load(input)
+	if !ok || atomic.AddInt32(users.(*int32), -1) > 0 {
+		return
+	}
+	inputUsers.Delete(input)
+	os.Remove(input)
+}
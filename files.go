@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1hitsong/Go-Record-Audio/recorder"
+)
+
+// createFile creates or truncates name with the configured permissions. An
+// explicitly configured mode is applied as is rather than through the umask.
+func createFile(name string) (*os.File, error) {
+	return recorder.CreateFile(name, fileMode, cfg.Output.FileMode != "")
+}
+
+// fileOpener creates recordings as files the way createFile does
+func fileOpener() recorder.Opener {
+	return recorder.FileOpener(fileMode, cfg.Output.FileMode != "")
+}
+
+// writeFile saves data to name using createFile
+func writeFile(name string, data []byte) error {
+	f, err := createFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// encodedName is the file a recording is encoded to, or with several
+// bitrates the one at the first bitrate
+func encodedName(fileName string) string {
+	return encodedNameAt(fileName, encodeBitrates()[0])
+}
+
+// encodedNameAt is the file a recording is encoded to at a bitrate. With a
+// bitrates list each name carries its bitrate, as in "name.128k.mp3".
+func encodedNameAt(fileName, bitrate string) string {
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if cfg.Encode.Bitrates == "" {
+		return base + "." + cfg.Encode.Format
+	}
+	return base + "." + bitrate + "k." + cfg.Encode.Format
+}
+
+// nextRecordingName returns the first numbered file name at or after n that
+// does not collide with an existing recording or encoded MP3, so segments
+// split in quick succession never overwrite each other. The number is padded
+// with zeros to the index width so the names sort in order.
+func nextRecordingName(base string, n int) (string, int) {
+	for {
+		name := filepath.Join(recordingDir(), fmt.Sprintf("%s%0*d%s", base, cfg.Output.IndexWidth, n, recordingExt()))
+		if !recordingExists(name) {
+			return name, n
+		}
+		n++
+	}
+}
+
+// recordingExists reports whether any file of a recording, or what it is
+// encoded to, is already there
+func recordingExists(fileName string) bool {
+	for _, name := range recordingFiles(fileName) {
+		if fileExists(name) || fileExists(encodedName(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// checkOutputDir makes sure recordings can be written before any audio is
+// captured, switching to the fallback directory when one is configured, and
+// that today's date directories can be made in it
+func checkOutputDir() error {
+	err := writable(cfg.Output.Dir)
+	if err == nil {
+		_, err = outputDir()
+		return err
+	}
+	if cfg.Output.FallbackDir == "" {
+		return fmt.Errorf("output directory %s is not writable: %v", cfg.Output.Dir, err)
+	}
+	if ferr := writable(cfg.Output.FallbackDir); ferr != nil {
+		return fmt.Errorf("neither output directory %s (%v) nor fallback %s (%v) is writable", cfg.Output.Dir, err, cfg.Output.FallbackDir, ferr)
+	}
+
+	log.Printf("[Output] %s is not writable (%v), recording to %s instead", cfg.Output.Dir, err, cfg.Output.FallbackDir)
+	cfg.Output.Dir = cfg.Output.FallbackDir
+	_, err = outputDir()
+	return err
+}
+
+// writable creates dir if needed and checks a file can be created in it
+func writable(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".write-test")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// outputDir returns the directory new recordings go in, creating it and any
+// year/month/day directories for today when date directories are enabled
+func outputDir() (string, error) {
+	dir := cfg.Output.Dir
+	if cfg.Output.DateDirs {
+		dir = filepath.Join(dir, time.Now().Format("2006/01/02"))
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// recordingDir is the directory a new recording goes in. Should a new day's
+// directories fail to be made mid-run, as on a disk remounted read-only,
+// the recording goes straight in the output directory rather than stopping
+// the run.
+func recordingDir() string {
+	dir, err := outputDir()
+	if err != nil {
+		log.Println("[Output] ", err, "- recording to", cfg.Output.Dir)
+		return cfg.Output.Dir
+	}
+	return dir
+}
+
+func numRecordedFiles() int {
+	files, _ := ioutil.ReadDir(recordingDir())
+	return len(files)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/1hitsong/Go-Record-Audio/config"
+)
+
+// parseFlags lets command line flags override values read from the config
+func parseFlags() {
+	chain, _ := defineFlags(flag.CommandLine, &cfg)
+	flag.Parse()
+	cfg.Processing.Chain = splitList(*chain)
+
+	if mode, err := strconv.ParseUint(cfg.Output.FileMode, 8, 32); err == nil {
+		fileMode = os.FileMode(mode)
+	}
+}
+
+// strictConfig reports whether --strict-config was given, or StrictConfig
+// set in the environment when it was not. The flags are parsed into a
+// scratch configuration, as this is needed before the configuration they
+// override is loaded; parseFlags reports any errors in them.
+func strictConfig() bool {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	_, strict := defineFlags(fs, &config.Config{})
+	fs.Parse(os.Args[1:])
+
+	given := false
+	fs.Visit(func(f *flag.Flag) {
+		given = given || f.Name == "strict-config"
+	})
+	if given {
+		return *strict
+	}
+	env, _ := strconv.ParseBool(os.Getenv("StrictConfig"))
+	return env
+}
+
+// defineFlags defines the command line flags on fs, each defaulting to and
+// setting its value in c, returning the processing chain and strict-config
+// flags, which are kept apart from c
+func defineFlags(fs *flag.FlagSet, c *config.Config) (chain *string, strict *bool) {
+	strict = fs.Bool("strict-config", false, "fail on fields config.yml has that no setting knows, or a missing config.yml, instead of warning")
+	fs.BoolVar(&c.Gate.Enabled, "gate", c.Gate.Enabled, "silence audio whose level falls below the gate threshold")
+	fs.Float64Var(&c.Gate.Threshold, "gate-threshold", c.Gate.Threshold, "level below which the gate closes")
+	fs.IntVar(&c.Gate.Attack, "gate-attack", c.Gate.Attack, "milliseconds taken to open the gate")
+	fs.IntVar(&c.Gate.Release, "gate-release", c.Gate.Release, "milliseconds taken to close the gate")
+	fs.StringVar(&c.Output.Annotation, "annotation", c.Output.Annotation, "text stored in an annotation chunk of each recording")
+	fs.BoolVar(&c.Transcribe.AutoName, "auto-name", c.Transcribe.AutoName, "rename each recording after the first words the transcription command hears in its opening seconds")
+	fs.DurationVar(&c.Transcribe.AutoNameLength, "auto-name-length", c.Transcribe.AutoNameLength, "length of the opening transcribed to name a recording")
+	fs.StringVar(&c.Transcribe.Command, "transcribe", c.Transcribe.Command, "command run with each encoded file whose output is saved as a .txt transcript")
+	fs.IntVar(&c.Retro.Seconds, "retro", c.Retro.Seconds, "keep only this many seconds of audio in memory and save them when s is pressed")
+	fs.StringVar(&c.Retro.MaxMemory, "retro-max-memory", c.Retro.MaxMemory, "most memory retro mode may hold, such as 256MB, refusing a longer retro window")
+	fs.BoolVar(&c.Messages.Quiet, "quiet", c.Messages.Quiet, "only print errors")
+	fs.StringVar(&c.Input.File, "input-file", c.Input.File, "replay an AIFF or WAV file instead of recording from the input device")
+	fs.StringVar(&c.Input.Devices, "devices", c.Input.Devices, "comma separated input devices recorded together into one multitrack file, each supplying an equal share of the channels")
+	fs.BoolVar(&c.Input.Loopback, "loopback", c.Input.Loopback, "record what the default output device plays instead of an input")
+	fs.StringVar(&c.Input.Overflow, "overflow", c.Input.Overflow, "when the input overflows and audio is lost: continue, silence to mark the gap, or fail")
+	fs.BoolVar(&c.Input.Negotiate, "negotiate", c.Input.Negotiate, "record the input device at a sample rate or channel count it supports and convert when it cannot record the configured one")
+	fs.StringVar(&c.Input.Resample, "resample", c.Input.Resample, "interpolation converting an input file at another sample rate: linear, cubic, sinc-fast or sinc-best")
+	fs.StringVar(&c.Input.ChannelMismatch, "channel-mismatch", c.Input.ChannelMismatch, "when the input file's channels differ from the configured channels: error, downmix or duplicate")
+	fs.StringVar(&c.Output.FileMode, "file-mode", c.Output.FileMode, "octal permissions for recordings and the files made from them")
+	fs.StringVar(&c.Output.Format, "format", c.Output.Format, "container recordings are written in, aiff, aifc or wav")
+	fs.IntVar(&c.Output.BitDepth, "bit-depth", c.Output.BitDepth, "bits per sample of recordings, 8, 16 or 32")
+	fs.StringVar(&c.Output.Dither, "dither", c.Output.Dither, "noise added when storing fewer than 32 bits per sample: none, rectangular or tpdf")
+	fs.BoolVar(&c.Upload.S3.Enabled, "upload-s3", c.Upload.S3.Enabled, "upload each encoded file to the S3 compatible bucket in the config")
+	fs.BoolVar(&c.Upload.Queue.Enabled, "publish-queue", c.Upload.Queue.Enabled, "publish each encoded file as a message to the queue in the config")
+	fs.DurationVar(&c.Upload.RetryDelay, "upload-retry-delay", c.Upload.RetryDelay, "wait before the first retry of a failed upload or publish, doubled before each one after")
+	fs.BoolVar(&c.Upload.KeepOnFail, "keep-on-upload-fail", c.Upload.KeepOnFail, "keep an encoded file whose upload still fails after its retries instead of deleting it with s3.deletelocal")
+	fs.IntVar(&c.SilenceDetection.Window, "silence-window", c.SilenceDetection.Window, "number of 64 sample buffers whose combined level decides silence")
+	fs.BoolVar(&c.SilenceDetection.NoSplit, "no-split", c.SilenceDetection.NoSplit, "keep recording one file when silence is detected")
+	fs.BoolVar(&c.SilenceDetection.MarkSplits, "mark-splits", c.SilenceDetection.MarkSplits, "write a cue sheet of where silence would have split a no-split recording")
+	fs.DurationVar(&c.SilenceDetection.MarkerInterval, "marker-interval", c.SilenceDetection.MarkerInterval, "add a numbered marker to the cue sheet every interval, such as 10m")
+	fs.StringVar(&c.Encode.Playlist, "playlist", c.Encode.Playlist, "JSON or CSV file giving the artist and title of each segment by index or start time")
+	fs.StringVar(&c.Input.Gain, "input-gain", c.Input.Gain, "gain applied to the input before anything else, in dB such as 6dB or as a factor such as 2")
+	fs.StringVar(&c.Input.Balance, "balance", c.Input.Balance, "gain for each input channel in order, such as 0dB,-3dB to bring down a hotter right channel")
+	fs.BoolVar(&c.Input.GainSilence, "gain-silence", c.Input.GainSilence, "judge silence after the input gain and processing; false judges it on the audio as captured")
+	fs.StringVar(&c.Input.FallbackDevice, "fallback-device", c.Input.FallbackDevice, "when the input device fails mid-run: stop, default to switch to the default device, or wait for it to come back")
+	fs.DurationVar(&c.Input.StallTimeout, "stall-timeout", c.Input.StallTimeout, "how long the input may deliver no audio before the recording is finished and the device reopened, 0 to never reopen it")
+	fs.DurationVar(&c.Input.LatencyOffset, "latency-offset", c.Input.LatencyOffset, "audio discarded at the start of recording to compensate for input latency")
+	fs.BoolVar(&c.Encode.KeepGoing, "continue-on-encode-error", c.Encode.KeepGoing, "in endless and retro mode, log a failed encode and keep its recording instead of exiting")
+	fs.IntVar(&c.Input.Channels, "channels", c.Input.Channels, "number of input channels recorded, interleaved in the output")
+	fs.StringVar(&c.SilenceDetection.Channels, "silence-channels", c.SilenceDetection.Channels, "with more than one channel, whether all or any channel must be quiet for silence")
+	fs.BoolVar(&c.AGC.Enabled, "agc", c.AGC.Enabled, "continuously adjust gain to keep the level near the target")
+	fs.Float64Var(&c.AGC.Target, "agc-target", c.AGC.Target, "RMS level in dBFS the gain control aims for")
+	fs.Float64Var(&c.AGC.MaxGain, "agc-max-gain", c.AGC.MaxGain, "largest boost in dB the gain control may apply")
+	fs.StringVar(&c.Output.Dir, "output-dir", c.Output.Dir, "directory recordings are written to")
+	fs.BoolVar(&c.Output.DateDirs, "date-dirs", c.Output.DateDirs, "place each recording in year/month/day directories under the output directory")
+	fs.BoolVar(&c.Limiter.Enabled, "limiter", c.Limiter.Enabled, "keep peaks below the ceiling so loud transients do not clip")
+	fs.Float64Var(&c.Limiter.Ceiling, "limiter-ceiling", c.Limiter.Ceiling, "highest peak level in dBFS the limiter lets through")
+	fs.StringVar(&c.SilenceDetection.RepeatedSilence, "repeated-silence", c.SilenceDetection.RepeatedSilence, "in endless mode, whether silence straight after a split discards the new segment and stops, keeps it and stops, or continues")
+	fs.IntVar(&c.SilenceDetection.MaxSilenceFiles, "max-silence-files", c.SilenceDetection.MaxSilenceFiles, "in endless mode, stop after this many segments in a row split off on silence with little sound, 0 for no limit")
+	fs.DurationVar(&c.SilenceDetection.ShortSegment, "short-segment", c.SilenceDetection.ShortSegment, "sound a segment needs to not count towards --max-silence-files")
+	fs.IntVar(&c.SilenceDetection.StopAfter, "stop-after", c.SilenceDetection.StopAfter, "seconds the silence after a split must last, beyond the start delay, before endless mode stops")
+	fs.BoolVar(&c.SilenceDetection.Compress, "compress-silence", c.SilenceDetection.Compress, "shorten long silences to a short gap instead of splitting, keeping one continuous file")
+	fs.DurationVar(&c.SilenceDetection.CompressAfter, "compress-after", c.SilenceDetection.CompressAfter, "silence longer than this is shortened by --compress-silence")
+	fs.DurationVar(&c.SilenceDetection.CompressGap, "compress-gap", c.SilenceDetection.CompressGap, "silence kept in place of each long silence by --compress-silence")
+	fs.BoolVar(&c.SilenceDetection.WaitForSound, "wait-for-sound", c.SilenceDetection.WaitForSound, "in endless mode, create the first recording only once sound is heard")
+	fs.BoolVar(&c.SilenceDetection.DiscardDelay, "discard-delay", c.SilenceDetection.DiscardDelay, "treat the start delay as a warm-up whose audio is processed but not recorded")
+	fs.BoolVar(&c.Input.ShowStream, "show-stream", c.Input.ShowStream, "log the device, host API, sample rate, channels, buffer size, sample format and latency each input stream is opened with")
+	fs.BoolVar(&c.Input.Exclusive, "exclusive", c.Input.Exclusive, "open the input device for exclusive, unprocessed access where the host API allows it")
+	fs.BoolVar(&c.Input.Float, "float-input", c.Input.Float, "read the input device as 32 bit float samples even when nothing processes them")
+	fs.BoolVar(&c.Output.Checksum, "checksum", c.Output.Checksum, "write a .sha256 sidecar next to each encoded file")
+	fs.BoolVar(&c.Utterances.Enabled, "utterances", c.Utterances.Enabled, "save each stretch of sound between silences as its own trimmed file")
+	fs.DurationVar(&c.Utterances.PreRoll, "pre-roll", c.Utterances.PreRoll, "audio from before the sound starts kept at the start of each utterance and of the first recording --wait-for-sound makes")
+	fs.DurationVar(&c.Utterances.PostRoll, "post-roll", c.Utterances.PostRoll, "audio after the sound stops kept at the end of each utterance")
+	fs.DurationVar(&c.Utterances.MinLength, "min-utterance", c.Utterances.MinLength, "utterances with less sound than this are dropped as clicks")
+	fs.DurationVar(&c.Output.MaxDuration, "max-duration", c.Output.MaxDuration, "stop recording after this much audio, counting down the time left, 0 for no limit")
+	fs.IntVar(&c.Output.MinFreeSpace, "min-free-space", c.Output.MinFreeSpace, "megabytes of free disk space below which recording stops, 0 to never check")
+	fs.StringVar(&c.Encode.Bitrates, "bitrates", c.Encode.Bitrates, "comma separated bitrates to encode each recording at, such as 64,128,192")
+	fs.StringVar(&c.Input.Device, "device", c.Input.Device, "input device to record from by name or list-devices number")
+	fs.BoolVar(&c.Keys.NoStdin, "no-stdin", c.Keys.NoStdin, "do not read keys from stdin, stopping only on a signal or limit, as when running as a service")
+	fs.BoolVar(&c.Input.Interactive, "interactive", c.Input.Interactive, "ask which input device to record from when none is configured")
+	fs.BoolVar(&c.Tags.Provenance, "provenance", c.Tags.Provenance, "tag each encoded file with a comment naming the input device, machine and version it was recorded with and when")
+	fs.BoolVar(&c.Tags.Retag, "retag", c.Tags.Retag, "rewrite the tags of each encoded file with the artist, title and the fields under tags in the config")
+	fs.Float64Var(&c.SilenceDetection.Threshold, "silence-threshold", c.SilenceDetection.Threshold, "level in dBFS below which audio counts as silence")
+	fs.BoolVar(&c.SilenceDetection.Band, "silence-band", c.SilenceDetection.Band, "measure silence only between --silence-band-low and --silence-band-high, ignoring hum and hiss outside")
+	fs.Float64Var(&c.SilenceDetection.BandLow, "silence-band-low", c.SilenceDetection.BandLow, "lowest frequency in Hz measured for silence with --silence-band")
+	fs.Float64Var(&c.SilenceDetection.BandHigh, "silence-band-high", c.SilenceDetection.BandHigh, "highest frequency in Hz measured for silence with --silence-band")
+	fs.DurationVar(&c.Encode.Preview, "preview", c.Encode.Preview, "length of a low bitrate preview encoded from the start of each recording alongside the full file, 0 for none")
+	fs.StringVar(&c.Encode.PreviewBitrate, "preview-bitrate", c.Encode.PreviewBitrate, "bitrate previews are encoded at")
+	fs.BoolVar(&c.Encode.Chapters, "chapters", c.Encode.Chapters, "with ffmpeg, embed a chapter at each marker, or at each split point of a no-split recording, instead of splitting")
+	fs.StringVar(&c.Encode.ChapterFile, "chapter-file", c.Encode.ChapterFile, "file of chapter start times and names embedded in each file encoded with ffmpeg")
+	fs.BoolVar(&c.Encode.Auto, "auto-encode", c.Encode.Auto, "encode each recording as it finishes; false keeps the AIFF for the encode command")
+	fs.StringVar(&c.Encode.Encoder, "encoder", c.Encode.Encoder, "program that encodes recordings, lame or ffmpeg")
+	fs.StringVar(&c.Encode.Format, "encode-format", c.Encode.Format, "extension of encoded files, mp3, or with ffmpeg also m4a, ogg, opus or flac")
+	fs.StringVar(&c.Encode.TargetSize, "target-size", c.Encode.TargetSize, "largest size of each encoded file, such as 25MB, from which its bitrate is chosen by its length")
+	fs.StringVar(&c.Encode.Log, "encode-log", c.Encode.Log, "file each encoder run's command line, output and exit status is appended to")
+	fs.BoolVar(&c.Encode.Verify, "verify-encode", c.Encode.Verify, "decode each encoded file back and check its length before removing the recording")
+	fs.IntVar(&c.Encode.Nice, "encode-nice", c.Encode.Nice, "niceness from 0 to 19 the encoder runs at so it yields the CPU to recording")
+	fs.IntVar(&c.Encode.Retries, "encode-retries", c.Encode.Retries, "times a failed encode is run again on the kept recording before giving up")
+	fs.DurationVar(&c.Encode.RetryDelay, "encode-retry-delay", c.Encode.RetryDelay, "wait before the first encode retry, doubled before each one after")
+	fs.DurationVar(&c.Encode.ShutdownTimeout, "shutdown-timeout", c.Encode.ShutdownTimeout, "how long to wait on exit for background work before abandoning it, 0 to wait indefinitely")
+	fs.StringVar(&c.Output.FallbackDir, "fallback-dir", c.Output.FallbackDir, "directory recordings are written to when the output directory is not writable")
+	fs.BoolVar(&c.Markers.Enabled, "split-on-marker", c.Markers.Enabled, "split on lines from the marker FIFO or on SIGHUP instead of on silence")
+	fs.StringVar(&c.Markers.FIFO, "marker-fifo", c.Markers.FIFO, "named pipe whose lines each split the recording")
+	fs.DurationVar(&c.Output.FsyncInterval, "fsync-interval", c.Output.FsyncInterval, "flush each recording to disk at least this often, such as 5s, so a crash loses little; 0 leaves it to the system")
+	fs.StringVar(&c.Output.MirrorDir, "mirror-dir", c.Output.MirrorDir, "second directory every recording is also written to as it is made")
+	fs.BoolVar(&c.Output.Stdout, "stdout", c.Output.Stdout, "write raw PCM to standard output instead of recording files")
+	fs.StringVar(&c.Output.SampleFormat, "sample-format", c.Output.SampleFormat, "raw PCM sample format for --stdout or a named pipe, such as s16le, s24le, s32be, f32le or u8")
+	fs.IntVar(&c.Output.IndexWidth, "index-width", c.Output.IndexWidth, "digits the number of each numbered recording is padded to with zeros, 0 for no padding")
+	fs.BoolVar(&c.Output.SplitChannels, "split-channels", c.Output.SplitChannels, "write each input channel to its own mono file instead of one interleaved file")
+	fs.StringVar(&c.Output.PipeHeader, "pipe-header", c.Output.PipeHeader, "header written to a named pipe: wav or none")
+	fs.Float64Var(&c.QuietRecordings.Threshold, "delete-quiet-below", c.QuietRecordings.Threshold, "delete a finished recording unencoded when its level stays below this many dBFS, 0 to keep every recording")
+	fs.StringVar(&c.QuietRecordings.Measure, "quiet-measure", c.QuietRecordings.Measure, "level compared with --delete-quiet-below: peak or rms")
+	fs.BoolVar(&c.SyncTone.Enabled, "sync-tone", c.SyncTone.Enabled, "start the recording with a reference tone for lining it up with other recordings")
+	fs.Float64Var(&c.SyncTone.Frequency, "sync-tone-frequency", c.SyncTone.Frequency, "frequency of the sync tone in Hz")
+	fs.Float64Var(&c.SyncTone.Level, "sync-tone-level", c.SyncTone.Level, "peak level of the sync tone in dBFS")
+	fs.DurationVar(&c.SyncTone.Duration, "sync-tone-duration", c.SyncTone.Duration, "length of the sync tone")
+	fs.BoolVar(&c.Pop.Enabled, "skip-pop", c.Pop.Enabled, "remove a short pop or click from the opening of the recording")
+	fs.StringVar(&c.Take.Name, "take", c.Take.Name, "record numbered takes of the named piece, pressing the split key, t, to finish a take and start the next")
+	fs.StringVar(&c.OSC.Address, "osc", c.OSC.Address, "send OSC messages over UDP to this address, such as 127.0.0.1:9000, as recording starts, splits, hears silence and stops")
+	fs.StringVar(&c.Monitor.Address, "ws", c.Monitor.Address, "serve a live meter page and a WebSocket of levels and waveform on this address, such as :9000")
+	fs.BoolVar(&c.Icecast.Enabled, "icecast", c.Icecast.Enabled, "stream the live audio to the Icecast mount in the config")
+	fs.StringVar(&c.Icecast.Format, "icecast-format", c.Icecast.Format, "codec of the Icecast stream, mp3, ogg or opus")
+	fs.StringVar(&c.Spectrogram.File, "spectrogram", c.Spectrogram.File, "PNG spectrogram written for each recording, {name} is replaced by the recording's path without its extension")
+	fs.IntVar(&c.Spectrogram.FFTSize, "spectrogram-fft-size", c.Spectrogram.FFTSize, "samples in each spectrogram FFT frame, a power of two")
+	fs.StringVar(&c.Spectrogram.Window, "spectrogram-window", c.Spectrogram.Window, "window applied to each spectrogram FFT frame: hann, hamming, blackman or rectangular")
+	fs.IntVar(&c.Spectrogram.Width, "spectrogram-width", c.Spectrogram.Width, "width of the spectrogram in pixels")
+	fs.IntVar(&c.Spectrogram.Height, "spectrogram-height", c.Spectrogram.Height, "height of the spectrogram in pixels")
+	fs.StringVar(&c.Location.Latitude, "latitude", c.Location.Latitude, "latitude in decimal degrees written to each encoded file")
+	fs.StringVar(&c.Location.Longitude, "longitude", c.Location.Longitude, "longitude in decimal degrees written to each encoded file")
+	fs.StringVar(&c.Location.Command, "gps-command", c.Location.Command, "command run as each recording starts that prints the current latitude and longitude")
+	fs.BoolVar(&c.Location.Sidecar, "location-sidecar", c.Location.Sidecar, "also write the location to a .geojson file beside each encoded file")
+	chain = fs.String("chain", strings.Join(c.Processing.Chain, ","), "comma separated processing stages run in order, from highpass, lowpass, gate, agc, limiter and normalize")
+	return chain, strict
+}
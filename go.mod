@@ -0,0 +1,9 @@
+module github.com/1hitsong/Go-Record-Audio
+
+go 1.16
+
+require (
+	github.com/gordonklaus/portaudio v0.0.0-20250206071425-98a94950218b
+	github.com/ilyakaznacheev/cleanenv v1.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
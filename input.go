@@ -0,0 +1,1113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/1hitsong/Go-Record-Audio/audio"
+	"github.com/1hitsong/Go-Record-Audio/recorder"
+	"github.com/gordonklaus/portaudio"
+)
+
+// sampleSource fills the input buffer each time Read is called, either
+// from PortAudio or from a file being replayed
+type sampleSource interface {
+	Read() error
+	Close() error
+}
+
+// openSource starts reading into in as openInput does, exiting when it
+// cannot
+func openSource(in []int32) sampleSource {
+	src, err := openInput(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return src
+}
+
+// openInput starts reading into in from the input file when one is set,
+// otherwise from the input device or devices
+func openInput(in []int32) (sampleSource, error) {
+	if cfg.Input.File != "" {
+		src, err := openInputFile(cfg.Input.File, in)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBalance(cfg.Input.File, src.channels); err != nil {
+			src.Close()
+			return nil, err
+		}
+		setInputName("file " + filepath.Base(cfg.Input.File))
+		return src, nil
+	}
+
+	portaudio.Initialize()
+	if names := multitrackDevices(); names != nil {
+		src, err := openMultitrack(names, in)
+		if err != nil {
+			return nil, err
+		}
+		setInputName(strings.Join(names, " + "))
+		return src, nil
+	}
+	return openDevice(in)
+}
+
+// openDevice starts reading into in from the configured input device
+func openDevice(in []int32) (sampleSource, error) {
+	device, err := inputDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	var src sampleSource
+	mode := "shared"
+	if cfg.Input.Exclusive {
+		if exclusive, err := openExclusive(device, in); err != nil {
+			log.Println("[Exclusive] falling back to shared mode:", err)
+		} else {
+			src = exclusive
+			mode = "exclusive"
+		}
+	}
+	if src == nil {
+		if src, err = openNegotiated(device, in); err != nil {
+			return nil, err
+		}
+	}
+
+	channels := cfg.Input.Channels
+	if c, ok := src.(*convertingSource); ok {
+		channels = c.channels
+	}
+	if err := checkBalance(device.Name, channels); err != nil {
+		src.Close()
+		return nil, err
+	}
+	stream := src.(startable)
+	if err = stream.Start(); err != nil {
+		src.Close()
+		return nil, err
+	}
+	format := "32 bit integer"
+	if _, ok := src.(*floatStream); ok {
+		format = "32 bit float"
+	}
+	showStream(device, mode, channels, len(in)/cfg.Input.Channels, format, stream.Info())
+	setInputName(device.Name)
+	say("Input latency reported by the device:", stream.Info().InputLatency)
+	return src, nil
+}
+
+// checkBalance refuses an input read at another channel count than the
+// recording's while input.balance is set, as the converted channels the
+// gains would land on are not the input's own
+func checkBalance(name string, channels int) error {
+	if cfg.Input.Balance == "" || channels == cfg.Input.Channels {
+		return nil
+	}
+	return fmt.Errorf("input.balance gives a gain for each of %d channels, but %s is read with %d and converted, so it cannot be balanced",
+		cfg.Input.Channels, name, channels)
+}
+
+// showStream logs the parameters a device's stream was opened with when
+// asked to, for telling apart machines where the same settings behave
+// differently. Samples are read as 32 bit integers or floats, which
+// PortAudio converts the device's own format to.
+func showStream(device *portaudio.DeviceInfo, mode string, channels, frames int, format string, info *portaudio.StreamInfo) {
+	if !cfg.Input.ShowStream {
+		return
+	}
+	log.Printf("[Stream] %s (%s, %s mode): %v Hz, %d channels, %d frames per buffer, %s samples, %v input latency",
+		device.Name, device.HostApi.Name, mode, info.SampleRate, channels, frames, format, info.InputLatency)
+}
+
+// startable is a device stream, which a PortAudio stream, a float stream and
+// a converting source all are
+type startable interface {
+	Start() error
+	Info() *portaudio.StreamInfo
+}
+
+// floatInput reports whether a device is read as float32 samples, as it is
+// when asked to and whenever the input is processed, so samples beyond full
+// scale reach the processing unclipped
+func floatInput() bool {
+	gain, _ := audio.ParseGain(cfg.Input.Gain)
+	return cfg.Input.Float || len(processingChain()) > 0 || cfg.Input.Balance != "" || (cfg.Input.Gain != "" && gain != 1)
+}
+
+// openStream checks and opens a device stream reading into in, as float32
+// samples converted into in when float is set
+func openStream(p portaudio.StreamParameters, in []int32, float bool) (sampleSource, error) {
+	if float {
+		s := &floatStream{floats: make([]float32, len(in)), in: in}
+		err := portaudio.IsFormatSupported(p, s.floats)
+		if err == nil {
+			s.Stream, err = portaudio.OpenStream(p, s.floats)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if err := portaudio.IsFormatSupported(p, in); err != nil {
+		return nil, err
+	}
+	pa, err := portaudio.OpenStream(p, in)
+	if err != nil {
+		return nil, err
+	}
+	return pa, nil
+}
+
+// floatStream reads a device as float32 samples, filling the input buffer
+// with them clamped to integers and keeping them as read for the processing
+type floatStream struct {
+	*portaudio.Stream
+	floats []float32
+	in     []int32
+}
+
+func (s *floatStream) Read() error {
+	err := s.Stream.Read()
+	for i, v := range s.floats {
+		s.in[i] = audio.ClampSample(float64(v) * math.MaxInt32)
+	}
+	return err
+}
+
+// Floats returns the samples of the last Read as the device gave them
+func (s *floatStream) Floats() []float32 {
+	return s.floats
+}
+
+// floatSource is a sample source that also gives its samples as floats
+type floatSource interface {
+	Floats() []float32
+}
+
+// channelTest records for a few seconds without saving anything and reports
+// the level of each channel, to check which physical input lands in which
+// channel of the recordings
+func channelTest(seconds int) {
+	in := make([]int32, 64*cfg.Input.Channels)
+	stream := openSource(in)
+	defer portaudio.Terminate()
+	defer stream.Close()
+
+	say(fmt.Sprintf("Listening for %d seconds, play something into each input in turn.", seconds))
+	peaks := make([]float64, cfg.Input.Channels)
+	sums := make([]float64, cfg.Input.Channels)
+	levels := make([]float64, cfg.Input.Channels)
+	band := newSilenceBand()
+	frames := 0
+	for frames < seconds*sampleRate {
+		if err := stream.Read(); err == io.EOF {
+			break
+		} else {
+			chk(err)
+		}
+		measured := in
+		if band != nil {
+			measured = band.Filter(in)
+		}
+		for i, n := range in {
+			x := math.Abs(float64(n) / math.MaxInt32)
+			peaks[i%len(peaks)] = math.Max(peaks[i%len(peaks)], x)
+			sums[i%len(sums)] += x * x
+			levels[i%len(levels)] += audio.SquareLevel(measured[i])
+		}
+		frames += len(in) / cfg.Input.Channels
+	}
+	if frames == 0 {
+		log.Fatal("no audio was read")
+	}
+
+	names := map[int]string{}
+	if cfg.Input.Channels == 2 {
+		names = map[int]string{0: " (left)", 1: " (right)"}
+	}
+	for c := range peaks {
+		// signal is judged the same way silence detection judges it
+		presence := "silent"
+		if math.Sqrt(levels[c]/float64(frames)) >= silenceThreshold() {
+			presence = "signal"
+		}
+		fmt.Printf("channel %d%s: %s, peak %.1f dBFS, RMS %.1f dBFS\n", c+1, names[c], presence,
+			20*math.Log10(peaks[c]), 20*math.Log10(math.Sqrt(sums[c]/float64(frames))))
+	}
+}
+
+// openExclusive opens the input device at low latency without
+// clipping or dithering. PortAudio's Go binding cannot pass the host specific
+// stream info that WASAPI exclusive mode or CoreAudio hog mode need, so only
+// host APIs that always own the device are accepted: ASIO, WDM-KS and ALSA
+// hw devices.
+func openExclusive(device *portaudio.DeviceInfo, in []int32) (sampleSource, error) {
+	switch api := device.HostApi; {
+	case api.Type == portaudio.ASIO || api.Type == portaudio.WDMkS:
+	case api.Type == portaudio.ALSA && strings.Contains(device.Name, "(hw:"):
+	default:
+		return nil, fmt.Errorf("%s on %s cannot be opened exclusively", device.Name, api.Name)
+	}
+
+	p := portaudio.LowLatencyParameters(device, nil)
+	p.Input.Channels = cfg.Input.Channels
+	p.SampleRate = sampleRate
+	p.FramesPerBuffer = len(in) / cfg.Input.Channels
+	p.Flags = portaudio.ClipOff | portaudio.DitherOff
+	return openStream(p, in, floatInput())
+}
+
+// inputDevices lists the devices that can record, numbered by their PortAudio
+// index
+func inputDevices() ([]*portaudio.DeviceInfo, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []*portaudio.DeviceInfo
+	for _, device := range devices {
+		if device.MaxInputChannels > 0 {
+			inputs = append(inputs, device)
+		}
+	}
+	return inputs, nil
+}
+
+// inputDevice resolves the configured input device by its number or name,
+// or returns the loopback of the default output device in loopback mode and
+// otherwise the default input device when none is configured
+func inputDevice() (*portaudio.DeviceInfo, error) {
+	if cfg.Input.Loopback {
+		return loopbackDevice()
+	}
+	if cfg.Input.Device == "" {
+		return portaudio.DefaultInputDevice()
+	}
+	return findInputDevice(cfg.Input.Device)
+}
+
+// findInputDevice looks up an input device by its list-devices number or
+// its name
+func findInputDevice(name string) (*portaudio.DeviceInfo, error) {
+	devices, err := inputDevices()
+	if err != nil {
+		return nil, err
+	}
+	index, err := strconv.Atoi(name)
+	for _, device := range devices {
+		if (err == nil && device.Index == index) || strings.EqualFold(device.Name, name) {
+			return device, nil
+		}
+	}
+	return nil, fmt.Errorf("no input device %q, run list-devices to see them", name)
+}
+
+// multitrackDevices lists the devices recorded together, or nil when one
+// device is recorded
+func multitrackDevices() []string {
+	if cfg.Input.Devices == "" {
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(cfg.Input.Devices, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
+
+// loopbackDevice finds an input device carrying what the default output
+// device plays. PortAudio's Go binding cannot set the WASAPI loopback flag
+// on a stream, but PortAudio 19.7 and later list a "[Loopback]" input for
+// each WASAPI output. CoreAudio has no loopback of its own, so a loopback
+// driver the output is routed to is looked for, and PulseAudio and PipeWire
+// offer a monitor of each output.
+func loopbackDevice() (*portaudio.DeviceInfo, error) {
+	output, err := portaudio.DefaultOutputDevice()
+	if err != nil {
+		return nil, err
+	}
+	devices, err := inputDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	// a loopback driver is only used when the output has no loopback of
+	// its own, as the output may not be routed to it
+	var driver *portaudio.DeviceInfo
+	outputName := strings.ToLower(output.Name)
+	for _, device := range devices {
+		name := strings.ToLower(device.Name)
+		switch {
+		case device.HostApi.Type == portaudio.WASAPI && strings.Contains(name, "[loopback]"):
+			if strings.HasPrefix(name, outputName) {
+				return device, nil
+			}
+		case strings.HasPrefix(name, "monitor of "):
+			if strings.Contains(name, outputName) {
+				return device, nil
+			}
+		case driver == nil && (strings.Contains(name, "blackhole") || strings.Contains(name, "soundflower") || strings.Contains(name, "loopback")):
+			driver = device
+		}
+	}
+	if driver != nil {
+		return driver, nil
+	}
+
+	switch runtime.GOOS {
+	case "windows":
+		return nil, fmt.Errorf("no loopback input for %s: loopback needs PortAudio 19.7 or later built with WASAPI, or enable Stereo Mix and pass it to --device", output.Name)
+	case "darwin":
+		return nil, errors.New("macOS cannot record its output directly: install a loopback driver such as BlackHole, route the output to it and run again, or pass it to --device")
+	default:
+		return nil, fmt.Errorf("no monitor input for %s: record the output's monitor source with PulseAudio or PipeWire, passing it to --device", output.Name)
+	}
+}
+
+// listDevices prints the input devices with their numbers, marking the
+// default
+func listDevices() error {
+	if err := portaudio.Initialize(); err != nil {
+		return err
+	}
+	defer portaudio.Terminate()
+
+	devices, err := inputDevices()
+	if err != nil {
+		return err
+	}
+	printDevices(devices)
+	return nil
+}
+
+func printDevices(devices []*portaudio.DeviceInfo) {
+	def, _ := portaudio.DefaultInputDevice()
+	for _, device := range devices {
+		mark := " "
+		if def != nil && device.Index == def.Index {
+			mark = "*"
+		}
+		fmt.Printf("%s%3d: %s (%s, %d channels)\n", mark, device.Index, device.Name, device.HostApi.Name, device.MaxInputChannels)
+	}
+}
+
+// pickDevice asks on stdin which input device to record from, offering to
+// save the choice to config.yml so it is not asked again
+func pickDevice(stdin *bufio.Reader) error {
+	if err := portaudio.Initialize(); err != nil {
+		return err
+	}
+	defer portaudio.Terminate()
+
+	devices, err := inputDevices()
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return errors.New("no input devices found")
+	}
+	printDevices(devices)
+
+	var chosen *portaudio.DeviceInfo
+	for chosen == nil {
+		fmt.Print("Record from device number: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(line))
+		for _, device := range devices {
+			if err == nil && device.Index == index {
+				chosen = device
+			}
+		}
+	}
+	cfg.Input.Device = strconv.Itoa(chosen.Index)
+
+	fmt.Print("Save this device to config.yml? [y/N] ")
+	line, err := stdin.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(strings.TrimSpace(line), "y") {
+		return saveInputDevice("config.yml", chosen.Name)
+	}
+	return nil
+}
+
+// saveInputDevice sets input.device in the config file, replacing the line
+// in the input section or adding one at its start
+func saveInputDevice(configFile, name string) error {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	setting := "  device: " + strconv.Quote(name)
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if line != "input:" {
+			continue
+		}
+		j := i + 1
+		for ; j < len(lines) && strings.HasPrefix(lines[j], "  "); j++ {
+			if strings.HasPrefix(lines[j], "  device:") {
+				lines[j] = setting
+				return ioutil.WriteFile(configFile, []byte(strings.Join(lines, "\n")), 0666)
+			}
+		}
+		lines = append(lines[:i+1], append([]string{setting}, lines[i+1:]...)...)
+		return ioutil.WriteFile(configFile, []byte(strings.Join(lines, "\n")), 0666)
+	}
+
+	lines = append(lines, "input:", setting)
+	return ioutil.WriteFile(configFile, []byte(strings.Join(lines, "\n")), 0666)
+}
+
+// fileSource replays the PCM data of an AIFF or WAV file as if it had been
+// captured from the input device
+type fileSource struct {
+	f          *os.File
+	data       *bufio.Reader
+	in         []int32
+	order      binary.ByteOrder
+	bits       int
+	unsigned   bool
+	channels   int
+	sampleRate float64
+
+	// size is the number of bytes of sample data
+	size int64
+
+	// resampler converts a file at another sample rate, nil when the rates
+	// match
+	resampler *audio.Resampler
+	sample    [4]byte
+	raw       []int32 // a frame as stored
+	frame     []int32 // a frame converted to the recording's channels
+
+	// err is why readFrame stopped before the end of the file, nil when it
+	// reached the end cleanly
+	err error
+}
+
+// openInputFile detects whether name is an AIFF or WAV file from its magic
+// bytes, reads its format and checks it matches the mono recording pipeline
+func openInputFile(name string, in []int32) (*fileSource, error) {
+	src, err := openAudioFile(name, in)
+	if err != nil {
+		return nil, err
+	}
+	if err := src.checkFormat(); err != nil {
+		src.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return src, nil
+}
+
+// openAudioFile reads the format of an AIFF or WAV file, whatever it is
+func openAudioFile(name string, in []int32) (*fileSource, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &fileSource{f: f, in: in}
+	magic := make([]byte, 12)
+	if _, err = io.ReadFull(f, magic); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	switch {
+	case string(magic[0:4]) == "FORM" && (string(magic[8:12]) == "AIFF" || string(magic[8:12]) == "AIFC"):
+		err = src.readAIFFHeader(string(magic[8:12]) == "AIFC")
+	case string(magic[0:4]) == "RIFF" && string(magic[8:12]) == "WAVE":
+		err = src.readWAVHeader()
+	default:
+		err = errors.New("not an AIFF or WAV file")
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return src, nil
+}
+
+// readAIFFHeader reads the chunks of an AIFF file, or of an AIFF-C file
+// holding uncompressed samples
+func (s *fileSource) readAIFFHeader(aifc bool) error {
+	s.order = binary.BigEndian
+	foundCOMM := false
+	for {
+		id, size, err := readChunkHeader(s.f, s.order)
+		if err == io.EOF {
+			return errors.New("no SSND chunk")
+		} else if err != nil {
+			return err
+		}
+
+		switch id {
+		case "COMM":
+			var comm struct {
+				Channels   int16
+				Frames     uint32
+				SampleSize int16
+				SampleRate [10]byte
+			}
+			if err := binary.Read(s.f, s.order, &comm); err != nil {
+				return err
+			}
+			s.channels = int(comm.Channels)
+			s.bits = int(comm.SampleSize)
+			s.sampleRate = extendedToFloat(comm.SampleRate)
+			foundCOMM = true
+			read := int64(18)
+			if aifc {
+				compression := make([]byte, 4)
+				if _, err := io.ReadFull(s.f, compression); err != nil {
+					return err
+				}
+				if c := string(compression); c != "NONE" && c != "twos" {
+					return fmt.Errorf("AIFF-C compression %q is not supported", c)
+				}
+				read += 4
+			}
+			if err := skipChunk(s.f, size-read); err != nil {
+				return err
+			}
+		case "SSND":
+			if !foundCOMM {
+				return errors.New("SSND chunk before COMM chunk")
+			}
+			var offset, block uint32
+			if err := binary.Read(s.f, s.order, &offset); err != nil {
+				return err
+			}
+			if err := binary.Read(s.f, s.order, &block); err != nil {
+				return err
+			}
+			if _, err := s.f.Seek(int64(offset), io.SeekCurrent); err != nil {
+				return err
+			}
+			s.size = size - 8 - int64(offset)
+			s.data = bufio.NewReader(io.LimitReader(s.f, s.size))
+			return nil
+		default:
+			if err := skipChunk(s.f, size); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *fileSource) readWAVHeader() error {
+	s.order = binary.LittleEndian
+	foundFmt := false
+	for {
+		id, size, err := readChunkHeader(s.f, s.order)
+		if err == io.EOF {
+			return errors.New("no data chunk")
+		} else if err != nil {
+			return err
+		}
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return fmt.Errorf("fmt chunk of %d bytes is too short", size)
+			}
+			var format struct {
+				AudioFormat   uint16
+				Channels      uint16
+				SampleRate    uint32
+				ByteRate      uint32
+				BlockAlign    uint16
+				BitsPerSample uint16
+			}
+			if err := binary.Read(s.f, s.order, &format); err != nil {
+				return err
+			}
+			read := int64(16)
+			switch format.AudioFormat {
+			case 1:
+			case 0xFFFE:
+				// WAVE_FORMAT_EXTENSIBLE names its encoding by a GUID after
+				// the size of the extension, valid bits and channel mask
+				if size < 40 {
+					return fmt.Errorf("extensible fmt chunk of %d bytes is too short", size)
+				}
+				var ext struct {
+					Size        uint16
+					ValidBits   uint16
+					ChannelMask uint32
+					SubFormat   [16]byte
+				}
+				if err := binary.Read(s.f, s.order, &ext); err != nil {
+					return err
+				}
+				if ext.SubFormat != recorder.PCMSubFormat {
+					return fmt.Errorf("unsupported WAV subformat %x, only PCM can be replayed", ext.SubFormat)
+				}
+				read += 24
+			default:
+				return fmt.Errorf("unsupported WAV encoding %d, only PCM can be replayed", format.AudioFormat)
+			}
+			s.channels = int(format.Channels)
+			s.bits = int(format.BitsPerSample)
+			s.sampleRate = float64(format.SampleRate)
+			s.unsigned = s.bits == 8
+			foundFmt = true
+			if err := skipChunk(s.f, size-read); err != nil {
+				return err
+			}
+		case "data":
+			if !foundFmt {
+				return errors.New("data chunk before fmt chunk")
+			}
+			s.size = size
+			s.data = bufio.NewReader(io.LimitReader(s.f, s.size))
+			return nil
+		default:
+			if err := skipChunk(s.f, size); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *fileSource) checkFormat() error {
+	if s.channels != cfg.Input.Channels {
+		switch {
+		case cfg.Input.ChannelMismatch == "downmix" && cfg.Input.Channels == 1:
+		case cfg.Input.ChannelMismatch == "duplicate" && s.channels == 1:
+		case cfg.Input.ChannelMismatch == "error":
+			return fmt.Errorf("file has %d channels but recordings have %d", s.channels, cfg.Input.Channels)
+		default:
+			return fmt.Errorf("file has %d channels but recordings have %d, which input.channelmismatch %s cannot convert", s.channels, cfg.Input.Channels, cfg.Input.ChannelMismatch)
+		}
+	}
+	if s.bits != 8 && s.bits != 16 && s.bits != 24 && s.bits != 32 {
+		return fmt.Errorf("unsupported bit depth %d", s.bits)
+	}
+	s.raw = make([]int32, s.channels)
+	s.frame = make([]int32, cfg.Input.Channels)
+	if s.sampleRate != sampleRate {
+		var err error
+		if s.resampler, err = audio.NewResampler(s.sampleRate, sampleRate, cfg.Input.Channels, cfg.Input.Resample); err != nil {
+			return fmt.Errorf("file is sampled at %v Hz but recordings use %d Hz: %v", s.sampleRate, sampleRate, err)
+		}
+	}
+	return nil
+}
+
+// Read fills the input buffer with the next frames of the file, padding the
+// final buffer with silence. It returns io.EOF once the file is exhausted.
+func (s *fileSource) Read() error {
+	channels := cfg.Input.Channels
+	for i := 0; i+channels <= len(s.in); i += channels {
+		if !s.nextFrame(s.in[i : i+channels]) {
+			if i == 0 {
+				return io.EOF
+			}
+			for ; i < len(s.in); i++ {
+				s.in[i] = 0
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// nextFrame fills out with the next frame at the recording's channels and
+// sample rate, returning false at the end of the file
+func (s *fileSource) nextFrame(out []int32) bool {
+	if s.resampler == nil {
+		return s.readFrame(out)
+	}
+	for s.resampler.Need() {
+		if s.readFrame(s.frame) {
+			s.resampler.Write(s.frame)
+		} else {
+			s.resampler.End()
+		}
+	}
+	return s.resampler.Next(out)
+}
+
+// readFrame reads the next frame of the file into out, converted to the
+// recording's channels, returning false at the end of the file or a frame
+// cut short, which along with any read error is kept in err
+func (s *fileSource) readFrame(out []int32) bool {
+	width := s.bits / 8
+	for c := range s.raw {
+		if _, err := io.ReadFull(s.data, s.sample[:width]); err != nil {
+			if c > 0 || err != io.EOF {
+				s.err = fmt.Errorf("frame cut short: %v", err)
+				if err != io.EOF && err != io.ErrUnexpectedEOF {
+					s.err = err
+				}
+			}
+			return false
+		}
+		s.raw[c] = s.decode(s.sample[:width])
+	}
+	convertFrame(s.raw, out)
+	return true
+}
+
+// convertFrame copies a frame of the file into a frame of the recording,
+// averaging the file's channels into a mono recording or copying a mono
+// file to each channel of the recording when their channel counts differ
+func convertFrame(frame, out []int32) {
+	switch {
+	case len(frame) == len(out):
+		copy(out, frame)
+	case len(out) == 1:
+		sum := int64(0)
+		for _, n := range frame {
+			sum += int64(n)
+		}
+		out[0] = int32(sum / int64(len(frame)))
+	default:
+		for c := range out {
+			out[c] = frame[0]
+		}
+	}
+}
+
+// decode converts one stored sample into a full scale int32
+func (s *fileSource) decode(b []byte) int32 {
+	var v uint32
+	for i := range b {
+		if s.order == binary.BigEndian {
+			v = v<<8 | uint32(b[i])
+		} else {
+			v = v<<8 | uint32(b[len(b)-1-i])
+		}
+	}
+	v <<= uint(32 - s.bits)
+	if s.unsigned {
+		v ^= 0x80000000
+	}
+	return int32(v)
+}
+
+func (s *fileSource) Close() error {
+	return s.f.Close()
+}
+
+// measureFile reads a whole file for its peak and RMS level relative to full
+// scale across all of its channels
+func measureFile(name string) (peak, rms float64, err error) {
+	src, err := openAudioFile(name, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	src.raw = make([]int32, src.channels)
+	sum, n := 0.0, 0
+	for src.readFrame(src.raw) {
+		for _, v := range src.raw {
+			x := float64(v) / -math.MinInt32
+			peak = math.Max(peak, math.Abs(x))
+			sum += x * x
+			n++
+		}
+	}
+	if n > 0 {
+		rms = math.Sqrt(sum / float64(n))
+	}
+	return peak, rms, nil
+}
+
+// length is how long the file plays for
+func (s *fileSource) length() time.Duration {
+	return time.Duration(float64(s.frames()) / s.sampleRate * float64(time.Second))
+}
+
+// frames is how many sample frames the file holds
+func (s *fileSource) frames() int {
+	return int(s.size / int64(s.bits/8*s.channels))
+}
+
+func readChunkHeader(r io.Reader, order binary.ByteOrder) (string, int64, error) {
+	id := make([]byte, 4)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return "", 0, err
+	}
+	var size uint32
+	if err := binary.Read(r, order, &size); err == io.EOF {
+		return "", 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return "", 0, err
+	}
+	return string(id), int64(size), nil
+}
+
+// skipChunk moves past n bytes of chunk data and its pad byte if n is odd
+func skipChunk(f *os.File, n int64) error {
+	_, err := f.Seek(n+n%2, io.SeekCurrent)
+	return err
+}
+
+// extendedToFloat decodes the 80-bit IEEE 754 extended sample rate used by AIFF
+func extendedToFloat(b [10]byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7fff)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+	rate := float64(mantissa) * math.Pow(2, float64(exponent-16383-63))
+	if b[0]&0x80 != 0 {
+		rate = -rate
+	}
+	return rate
+}
+
+// streamReader reads buffers from a sample source on its own goroutine and
+// hands out copies, so the recording loops wait on audio, key presses and
+// signals in one select instead of spinning between reads
+type streamReader struct {
+	stream  sampleSource // nil until a device being waited for is opened
+	buffers chan inputBuffer
+	err     error // why reading stopped, set before buffers is closed
+	done    chan struct{}
+	exited  chan struct{}
+
+	// waiting is set while the reader waits for a device to open
+	waiting int32
+}
+
+func newStreamReader(stream sampleSource, in []int32) *streamReader {
+	r := &streamReader{
+		stream:  stream,
+		buffers: make(chan inputBuffer, 16),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.exited)
+		defer close(r.buffers)
+		r.read(in)
+	}()
+	return r
+}
+
+// deviceRetryInterval is how often a device that cannot be opened is tried
+// again, and maxRetryInterval the longest a failing reopen backs off to
+const (
+	deviceRetryInterval = 2 * time.Second
+	maxRetryInterval    = 30 * time.Second
+)
+
+// abandonWait is how long a reopen waits for an abandoned stream to close,
+// so the same device is not opened while it is still held
+const abandonWait = time.Second
+
+// waitForInput returns a reader that keeps trying to open the input with
+// open until it can, then reads from it. The wait between tries starts at
+// deviceRetryInterval and doubles up to maxInterval.
+func waitForInput(in []int32, open func(in []int32) (sampleSource, error), maxInterval time.Duration) *streamReader {
+	r := &streamReader{
+		buffers: make(chan inputBuffer, 16),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+		waiting: 1,
+	}
+
+	go func() {
+		defer close(r.exited)
+		defer close(r.buffers)
+		interval := deviceRetryInterval
+		for {
+			select {
+			case <-time.After(interval):
+			case <-r.done:
+				return
+			}
+			refreshDevices()
+			if stream, err := open(in); err == nil {
+				r.stream = stream
+				break
+			}
+			if interval *= 2; interval > maxInterval {
+				interval = maxInterval
+			}
+		}
+		atomic.StoreInt32(&r.waiting, 0)
+		say("[Input] the input device is back, recording again")
+		r.read(in)
+	}()
+	return r
+}
+
+// read hands out each buffer read from the stream until it fails or the
+// reader is closed
+func (r *streamReader) read(in []int32) {
+	for {
+		err := r.stream.Read()
+		if err != nil && !inputOverflowed(err) {
+			r.err = err
+			return
+		}
+		if err != nil && cfg.Input.Overflow == "silence" {
+			for n := 0; n < samplesIn(cfg.Input.OverflowGap); n += len(in) {
+				select {
+				case r.buffers <- inputBuffer{samples: make([]int32, len(in))}:
+				case <-r.done:
+					return
+				}
+			}
+		}
+		b := inputBuffer{samples: append([]int32(nil), in...)}
+		if f, ok := r.stream.(floatSource); ok {
+			b.floats = append([]float32(nil), f.Floats()...)
+		}
+		select {
+		case r.buffers <- b:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// inputBuffer is one buffer read from the input. When the device is read as
+// float32 samples, floats holds them as read, beyond full scale where the
+// device gave that, and samples holds them clamped to integers.
+type inputBuffer struct {
+	samples []int32
+	floats  []float32
+}
+
+// process runs dsp over the buffer's samples in place, starting from its
+// floats when it has them
+func (b inputBuffer) process(dsp *audio.Processing) {
+	if b.floats != nil {
+		dsp.RunFloats(b.floats, b.samples)
+		return
+	}
+	dsp.Run(b.samples)
+}
+
+// abandonedStreams counts the streams given up on whose stalled read has
+// not returned yet, which PortAudio must not be terminated under
+var abandonedStreams int32
+
+// abandon stops reading without waiting for a stalled read to return. The
+// stream is closed whenever the read does return. The returned channel is closed once it has been.
+func (r *streamReader) abandon() <-chan struct{} {
+	close(r.done)
+	atomic.AddInt32(&abandonedStreams, 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		defer atomic.AddInt32(&abandonedStreams, -1)
+		<-r.exited
+		if r.stream != nil {
+			r.stream.Close()
+		}
+	}()
+	return closed
+}
+
+// reopenStream gives up on a stalled or failed reader and opens the input
+// again. Unless it is a file or several devices, a device that cannot be
+// opened is replaced by the default device or waited for as
+// input.fallbackdevice says; otherwise an input that cannot be opened is
+// tried again, backing off, rather than ending the run.
+func reopenStream(input *streamReader) *streamReader {
+	select {
+	case <-input.abandon():
+	case <-time.After(abandonWait):
+	}
+	in := make([]int32, 64*cfg.Input.Channels)
+	if cfg.Input.File != "" || multitrackDevices() != nil || cfg.Input.FallbackDevice == "stop" {
+		stream, err := openInput(in)
+		if err == nil {
+			return newStreamReader(stream, in)
+		}
+		log.Println("[Input] ", err, "- trying to open the input again")
+		return waitForInput(in, openInput, maxRetryInterval)
+	}
+
+	refreshDevices()
+	if cfg.Input.FallbackDevice == "default" && (cfg.Input.Device != "" || cfg.Input.Loopback) {
+		if _, err := inputDevice(); err != nil {
+			log.Println("[Input] ", err, "- switching to the default input device")
+			cfg.Input.Device, cfg.Input.Loopback = "", false
+		}
+	}
+	stream, err := openDevice(in)
+	if err == nil {
+		return newStreamReader(stream, in)
+	}
+	log.Println("[Input] ", err, "- waiting for the input device to come back")
+	return waitForInput(in, openDevice, deviceRetryInterval)
+}
+
+// refreshDevices starts PortAudio again, as it only lists the devices
+// plugged in when it started, closing any streams still open. While an
+// abandoned stream's read is stalled it does nothing, as terminating would
+// close that stream under the read and again once it returns; the devices
+// are refreshed on a later try.
+func refreshDevices() {
+	if atomic.LoadInt32(&abandonedStreams) > 0 {
+		return
+	}
+	for portaudio.Terminate() == nil {
+	}
+	portaudio.Initialize()
+}
+
+// reconnecting reports whether the reader is waiting for a device to open
+func (r *streamReader) reconnecting() bool {
+	return atomic.LoadInt32(&r.waiting) == 1
+}
+
+// close stops reading, waiting for a read in progress to finish so the
+// stream is never closed under it, and then closes the stream
+func (r *streamReader) close() error {
+	close(r.done)
+	<-r.exited
+	if n := atomic.LoadInt64(&overflows); n > 0 {
+		log.Printf("[Input] the input overflowed %d times while recording, losing audio each time", n)
+	}
+	if r.stream == nil {
+		return nil
+	}
+	return r.stream.Close()
+}
+
+// overflows counts the input overflows since recording began
+var overflows int64
+
+// inputOverflowed reports whether err is an input overflow to carry on
+// after, counting it. The buffer read is still good, but audio before it
+// was lost because it was not read in time.
+func inputOverflowed(err error) bool {
+	if err != portaudio.InputOverflowed || cfg.Input.Overflow == "fail" {
+		return false
+	}
+	if atomic.AddInt64(&overflows, 1) == 1 {
+		log.Println("[Input] the input overflowed and some audio was lost, carrying on; a busy system or a slow disk can cause this")
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1hitsong/Go-Record-Audio/recorder"
+)
+
+// joinArgs splits the join command's arguments into the recordings to join
+// and the file given with -o to join them into
+func joinArgs(args []string) (names []string, out string, err error) {
+	for i := 0; i < len(args); i++ {
+		if args[i] != "-o" {
+			names = append(names, args[i])
+			continue
+		}
+		if i+1 == len(args) {
+			return nil, "", errors.New("-o needs the file to join into")
+		}
+		i++
+		out = args[i]
+	}
+	if out == "" {
+		return nil, "", errors.New("give the file to join into with -o, as in join a.aiff b.aiff -o whole.aiff")
+	}
+	if len(names) < 2 {
+		return nil, "", errors.New("give at least two recordings to join")
+	}
+	return names, out, nil
+}
+
+// joinRecordings writes the samples of recordings, in the order given, one
+// after another into a new AIFF, AIFF-C or WAV file as out's extension
+// says, such as the segments silence split a session into. The recordings
+// must share a sample rate, channel count and bit depth, which out keeps.
+func joinRecordings(names []string, out string) error {
+	var sources []*fileSource
+	defer func() {
+		for _, src := range sources {
+			src.Close()
+		}
+	}()
+	for _, name := range names {
+		src, err := openAudioFile(name, nil)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+		if first := sources[0]; src.sampleRate != first.sampleRate || src.channels != first.channels || src.bits != first.bits {
+			return fmt.Errorf("%s is %s but %s is %s, so they cannot be joined", name, describeFormat(src), names[0], describeFormat(first))
+		}
+	}
+	first := sources[0]
+	if fileExists(out) {
+		return fmt.Errorf("%s already exists", out)
+	}
+
+	container := "aiff"
+	switch strings.ToLower(filepath.Ext(out)) {
+	case ".wav":
+		container = "wav"
+	case ".aifc":
+		container = "aifc"
+	}
+	r, err := recorder.Create(fileOpener(), out, recorder.Format{Container: container, Channels: first.channels, SampleRate: int(first.sampleRate), BitDepth: first.bits})
+	if err != nil {
+		os.Remove(out)
+		return err
+	}
+
+	n := 0
+	err = func() error {
+		buf := make([]int32, 0, 64*first.channels)
+		for i, src := range sources {
+			src.raw = make([]int32, src.channels)
+			frames := 0
+			for src.readFrame(src.raw) {
+				frames++
+				if buf = append(buf, src.raw...); len(buf) == cap(buf) {
+					if err := r.WriteSamples(buf); err != nil {
+						return err
+					}
+					n += len(buf)
+					buf = buf[:0]
+				}
+			}
+			if src.err != nil {
+				return fmt.Errorf("%s: %v", names[i], src.err)
+			}
+			if frames < src.frames() {
+				return fmt.Errorf("%s ends after %d of its %d frames", names[i], frames, src.frames())
+			}
+		}
+		n += len(buf)
+		return r.WriteSamples(buf)
+	}()
+	if closeErr := r.Close(n); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out)
+		return err
+	}
+
+	length := time.Duration(float64(n/first.channels) / first.sampleRate * float64(time.Second))
+	say(fmt.Sprintf("Joined %d recordings into %s, %v long", len(names), out, length.Round(time.Millisecond)))
+	return nil
+}
+
+// describeFormat names a file's sample rate, channels and bit depth
+func describeFormat(src *fileSource) string {
+	return fmt.Sprintf("%v Hz, %d channels, %d bit", src.sampleRate, src.channels, src.bits)
+}
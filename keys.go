@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// keyNames are keys given in the key map by name rather than as typed
+var keyNames = map[string]string{"space": " ", "tab": "\t", "enter": ""}
+
+// typedKey is what a key in the key map is typed as, before Enter
+func typedKey(key string) string {
+	if typed, ok := keyNames[strings.ToLower(key)]; ok {
+		return typed
+	}
+	return key
+}
+
+// isKey reports whether a line read from stdin is the key followed by Enter
+func isKey(line, key string) bool {
+	return strings.TrimRight(line, "\r\n") == typedKey(key)
+}
+
+// readsStdin reports whether keys are read from stdin: not with --no-stdin,
+// nor when stdin is closed or the null device, as under systemd, where
+// nothing can ever be typed
+func readsStdin() bool {
+	if cfg.Keys.NoStdin {
+		return false
+	}
+	in, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(in, null)
+}
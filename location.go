@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gpsTimeout is how long the GPS command may take to print a fix
+const gpsTimeout = 30 * time.Second
+
+// location is where a recording was made, in decimal degrees
+type location struct {
+	lat, lon float64
+}
+
+// iso6709 formats the location as ISO 6709, as in +51.500700-000.124600/
+func (l location) iso6709() string {
+	return fmt.Sprintf("%+010.6f%+011.6f/", l.lat, l.lon)
+}
+
+// locationFix is the result of a GPS command run for one recording, ready
+// once done is closed
+type locationFix struct {
+	done chan struct{}
+	loc  location
+	ok   bool
+}
+
+// locations holds the GPS fix taken when each recording started
+var locations sync.Map
+
+// locateRecording runs the GPS command in the background as a recording
+// starts, so a slow fix does not hold up recording
+func locateRecording(fileName string) {
+	if cfg.Location.Command == "" {
+		return
+	}
+	fix := &locationFix{done: make(chan struct{})}
+	locations.Store(fileName, fix)
+	go func() {
+		defer close(fix.done)
+		var err error
+		if fix.loc, err = runGPSCommand(); err != nil {
+			log.Println("[Location] ", fileName, err, "- not tagging its location")
+			return
+		}
+		fix.ok = true
+	}()
+}
+
+// locationFor is the fix taken when a recording started, or else the
+// configured coordinates. Missing or invalid coordinates give no location.
+func locationFor(fileName string) (location, bool) {
+	if v, ok := locations.Load(fileName); ok {
+		fix := v.(*locationFix)
+		<-fix.done
+		return fix.loc, fix.ok
+	}
+	if cfg.Location.Latitude == "" && cfg.Location.Longitude == "" {
+		return location{}, false
+	}
+	loc, err := parseLocation(cfg.Location.Latitude, cfg.Location.Longitude)
+	if err != nil {
+		log.Println("[Location] ", err, "- not tagging", fileName)
+		return location{}, false
+	}
+	return loc, true
+}
+
+// runGPSCommand runs the GPS command and reads the latitude and longitude
+// from the start of what it prints, separated by a comma or spaces
+func runGPSCommand() (location, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gpsTimeout)
+	defer cancel()
+	args, err := commandArgs(cfg.Location.Command)
+	if err != nil {
+		return location{}, err
+	}
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		return location{}, err
+	}
+	fields := strings.FieldsFunc(string(out), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(fields) < 2 {
+		return location{}, fmt.Errorf("GPS command printed %q, not a latitude and longitude", strings.TrimSpace(string(out)))
+	}
+	return parseLocation(fields[0], fields[1])
+}
+
+// parseLocation reads a latitude and longitude in decimal degrees
+func parseLocation(lat, lon string) (location, error) {
+	var loc location
+	var err error
+	if loc.lat, err = strconv.ParseFloat(strings.TrimSpace(lat), 64); err != nil || loc.lat < -90 || loc.lat > 90 {
+		return location{}, fmt.Errorf("latitude %q must be decimal degrees from -90 to 90", lat)
+	}
+	if loc.lon, err = strconv.ParseFloat(strings.TrimSpace(lon), 64); err != nil || loc.lon < -180 || loc.lon > 180 {
+		return location{}, fmt.Errorf("longitude %q must be decimal degrees from -180 to 180", lon)
+	}
+	return loc, nil
+}
+
+// writeLocationSidecar saves where a recording was made as a GeoJSON point
+// beside a file encoded from it
+func writeLocationSidecar(out string, loc location) error {
+	point := fmt.Sprintf("{\"type\": \"Point\", \"coordinates\": [%.6f, %.6f]}\n", loc.lon, loc.lat)
+	return writeFile(strings.TrimSuffix(out, filepath.Ext(out))+".geojson", []byte(point))
+}
@@ -2,246 +2,757 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"math"
 	"os"
-	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/1hitsong/Go-Record-Audio/audio"
+	"github.com/1hitsong/Go-Record-Audio/config"
+	"github.com/1hitsong/Go-Record-Audio/encode"
 	"github.com/gordonklaus/portaudio"
-	"github.com/ilyakaznacheev/cleanenv"
 )
 
-// Config is a application configuration structure
-type Config struct {
-	SilenceDetection struct {
-		Delayatstartofcapture int `yaml:"delayatstartofcapture" env:"SilenceDelay" env-description:"Seconds to wait at start of capture before listening for silence" env-default:"5"`
-	} `yaml:"silencedetection"`
-	Encode struct {
-		Bitrate       string `yaml:"bitrate" env:"BitRate" env-description:"Bitrate to encode the resulting MP3 at"`
-		DefaultArtist string `yaml:"defaultartist" env:"DefaultArtist" env-description:"Default value to use if Artist is not specified"`
-		DefaultTitle  string `yaml:"defaulttitle" env:"DefaultTitle" env-description:"Default value to use if Title is not specified"`
-	} `yaml:"encode"`
-}
+const sampleRate = 44100
+
+var cfg config.Config
+
+// fileMode is applied to every file the recorder creates
+var fileMode os.FileMode = 0666
+
+// continueOnEncodeError is set for long running modes where a failed encode
+// should not end the recording
+var continueOnEncodeError bool
+
+// background tracks post processing that must finish before exiting
+var background taskGroup
 
-var cfg Config
+// recordingEncodes encodes finished recordings in the background so the
+// recording loop never waits on an encoder
+var recordingEncodes *encode.Queue
+
+// showProgress draws a progress bar while encoding. Parallel encodes turn it
+// off since their bars would overwrite each other.
+var showProgress = true
+
+// encodeLog records every encoder run when an encode log is configured
+var encodeLog *encode.Log
 
 func main() {
 
 	// read configuration from the file and environment variables
-	if err := cleanenv.ReadConfig("config.yml", &cfg); err != nil {
-		fmt.Println(err)
+	warnings, err := config.Load("config.yml", &cfg, strictConfig())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	for _, warning := range warnings {
+		log.Println("[Config] ", warning)
+	}
+
+	parseFlags()
+	defer shutdown(cfg.Encode.ShutdownTimeout)
+	audio.WrapOverflow = cfg.Processing.Overflow == "wrap"
+	if audio.WrapOverflow {
+		log.Println("[Processing] overflowing samples wrap around instead of being clamped, expect loud clicks")
+	}
+
+	if flag.Arg(0) == "check-config" {
+		os.Exit(checkConfig())
+	}
+	if flag.Arg(0) == "dump-config" {
+		chk(dumpConfig(os.Stdout, flag.Arg(1) == "json"))
+		return
+	}
+	if flag.Arg(0) == "list-devices" {
+		chk(listDevices())
+		return
+	}
+	if flag.Arg(0) == "channel-test" {
+		seconds := 3
+		if flag.NArg() > 1 {
+			var err error
+			if seconds, err = strconv.Atoi(flag.Arg(1)); err != nil || seconds < 1 {
+				log.Fatalf("channel-test: %q is not a number of seconds", flag.Arg(1))
+			}
+		}
+		channelTest(seconds)
+		return
+	}
+	if problems := configProblems(); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
 		os.Exit(2)
 	}
 
+	// standard output carries the audio, so nothing else may be printed there
+	if cfg.Output.Stdout {
+		cfg.Messages.Quiet = true
+	}
+
+	if cfg.Encode.Playlist != "" {
+		var err error
+		if playlist, err = loadPlaylist(cfg.Encode.Playlist); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.Encode.Log != "" {
+		var err error
+		if encodeLog, err = encode.NewLog(cfg.Encode.Log); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if flag.Arg(0) == "encode" {
+		if !encodeFiles(flag.Args()[1:]) {
+			background.drain(cfg.Encode.ShutdownTimeout)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "join" {
+		names, out, err := joinArgs(flag.Args()[1:])
+		if err == nil {
+			err = joinRecordings(names, out)
+		}
+		if err != nil {
+			log.Fatal("join: ", err)
+		}
+		return
+	}
+
+	// a named pipe given as the recording is streamed to instead, as a pipe
+	// cannot seek back to finish a file's header. Opening it waits for a
+	// reader, so that is done before the input starts.
+	var pipe *os.File
+	if flag.NArg() == 1 && isNamedPipe(flag.Arg(0)) {
+		var err error
+		if pipe, err = openPipe(flag.Arg(0)); err != nil {
+			log.Fatal(err)
+		}
+		defer pipe.Close()
+	} else if err := checkOutputDir(); err != nil {
+		log.Fatal(err)
+	}
+
 	fileName := ""
 	endlessmode := false
-	silenceCount := 0
 
-	if len(os.Args) < 2 {
+	if flag.NArg() < 1 {
 		fileName = "Unnamed Recording"
 		endlessmode = true
 	} else {
-		fileName = os.Args[1]
+		fileName = flag.Arg(0)
 	}
 
 	nRecordedFiles := numRecordedFiles()
+	continueOnEncodeError = cfg.Encode.KeepGoing && (endlessmode || cfg.Retro.Seconds > 0)
+	recordingEncodes = newRecordingQueue(cfg.Encode.Workers)
 
-	if endlessmode {
-		fileName = fmt.Sprint(fileName, nRecordedFiles, ".aiff")
-	}
+	if cfg.Take.Name != "" {
+		// takes are only split by the split key, never by silence
+		if flag.NArg() > 0 {
+			log.Fatal("take mode names each take after --take, so no recording name is given")
+		}
+		endlessmode = false
+		cfg.SilenceDetection.NoSplit = true
+		fileName = nextTake()
+	} else if endlessmode {
+		fileName, nRecordedFiles = nextRecordingName(fileName, nRecordedFiles)
+	} else {
+		if !strings.HasSuffix(fileName, recordingExt()) {
+			fileName += recordingExt()
+		}
 
-	if !strings.HasSuffix(fileName, ".aiff") {
-		fileName += ".aiff"
+		fileName = filepath.Join(recordingDir(), fileName)
 	}
 
-	fileName = "recordings/" + fileName
+	// stdin is shared by the device picker and the key commands read below
+	reader := bufio.NewReader(os.Stdin)
+	stdin := readsStdin()
+	if cfg.Input.Interactive && cfg.Input.Device == "" && cfg.Input.File == "" && !cfg.Input.Loopback && cfg.Input.Devices == "" {
+		if !stdin {
+			log.Fatal("--interactive needs stdin to ask which device to record from")
+		}
+		chk(pickDevice(reader))
+	}
 
-	fmt.Println("Recording.  Press q to stop.")
+	if cfg.Retro.Seconds > 0 {
+		say(fmt.Sprintf(cfg.Messages.Listening, cfg.Retro.Seconds))
+	} else {
+		say(cfg.Messages.Recording)
+	}
 
-	ch := make(chan string)
-	go func(ch chan string) {
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			s, err := reader.ReadString('\n')
-			if err != nil {
-				close(ch)
-				return
+	// without stdin ch stays nil, so only signals and limits stop recording
+	var ch chan string
+	if stdin {
+		ch = make(chan string)
+		go func(ch chan string) {
+			for {
+				s, err := reader.ReadString('\n')
+				if err != nil {
+					close(ch)
+					return
+				}
+				ch <- s
 			}
-			ch <- s
-		}
-		close(ch)
-	}(ch)
+			close(ch)
+		}(ch)
+	}
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, os.Kill)
+	// SIGTERM is how a service manager such as systemd stops the recording
+	signal.Notify(sig, os.Interrupt, os.Kill, syscall.SIGTERM)
+
+	in := make([]int32, 64*cfg.Input.Channels)
+	stream := openSource(in)
+	input := newStreamReader(stream, in)
+	dsp, err := newProcessing()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.Monitor.Address != "" {
+		var err error
+		if live, err = startLiveMonitor(cfg.Monitor.Address); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.OSC.Address != "" {
+		var err error
+		if events, err = startOSC(cfg.OSC.Address); err != nil {
+			log.Fatal(err)
+		}
+		defer events.close()
+		defer events.send(cfg.OSC.Stop, "")
+	}
+
+	var ice *icecastStream
+	if cfg.Icecast.Enabled {
+		var err error
+		if ice, err = startIcecast(); err != nil {
+			log.Fatal(err)
+		}
+		defer ice.close()
+
+		if !cfg.Icecast.RecordFile {
+			broadcast(input, dsp, ice, ch, sig)
+			return
+		}
+	}
+
+	if cfg.Output.Stdout {
+		format, _ := parseSampleFormat(cfg.Output.SampleFormat)
+		pipeSamples(input, dsp, ch, sig, bufio.NewWriter(os.Stdout), format)
+		return
+	}
+	if pipe != nil {
+		format, _ := parseSampleFormat(cfg.Output.SampleFormat)
+		pipeSamples(input, dsp, ch, sig, bufio.NewWriter(pipe), format)
+		return
+	}
+
+	if cfg.Retro.Seconds > 0 || cfg.Utterances.Enabled {
+		base := "Unnamed Recording"
+		if !endlessmode {
+			base = strings.TrimSuffix(flag.Arg(0), recordingExt())
+		}
+		if cfg.Utterances.Enabled {
+			recordUtterances(input, dsp, ch, sig, base)
+		} else {
+			recordRetro(input, dsp, ch, sig, base)
+		}
+		return
+	}
+
+	// endless mode can hold off creating the first file until there is
+	// something to record
+	var opening []int32
+	if endlessmode && cfg.SilenceDetection.WaitForSound {
+		say("[Waiting] for sound before starting the first recording")
+		var heard bool
+		if opening, heard = waitForSound(input, dsp, ch, sig); !heard {
+			return
+		}
+	}
 
 	f := startNewRecording(fileName)
 	nSamples := 0
+	silence := newSilenceDetector()
+	if cfg.SyncTone.Enabled {
+		tone := syncTone()
+		writeSamples(f, tone)
+		nSamples += len(tone)
+	}
+	writeSamples(f, opening)
+	nSamples += len(opening)
+
+	// latency compensation discards whole buffers from the start
+	discard := int(cfg.Input.LatencyOffset.Seconds() * float64(samplesPerSecond()))
+
+	// delay is how long a segment records before silence is looked for. With
+	// discarddelay the first segment's delay becomes a warm-up that runs
+	// through the processing without being recorded, so the device and gain
+	// control settle before capture begins.
+	delay := cfg.SilenceDetection.Delayatstartofcapture
+	warmup := 0
+	if cfg.SilenceDetection.DiscardDelay {
+		warmup = delay * samplesPerSecond()
+		delay = 0
+	}
 
-	portaudio.Initialize()
+	// silenceStart is where the current run of silence began in the file and
+	// skipped counts leading silence left out of a segment after a split
+	silenceStart := -1
+	skipped := 0
+	leadingSilence := false
+	stopper := &endlessStop{}
+
+	// the pop guard holds back the opening of the recording, and of the
+	// first segment after the input is reopened, to remove a pop as the
+	// stream starts. Silence does not split the recording while it holds.
+	var pop *audio.PopGuard
+	newPopGuard := func() {
+		if cfg.Pop.Enabled {
+			pop = audio.NewPopGuard(samplesIn(cfg.Pop.Window), int(cfg.Pop.MaxLength.Seconds()*sampleRate), cfg.Input.Channels, cfg.Pop.Threshold, cfg.Pop.Mode == "drop")
+		}
+	}
+	newPopGuard()
+	filterPop := func(out []int32) []int32 {
+		if pop == nil {
+			return out
+		}
+		out = pop.Filter(out)
+		if !pop.Holding() {
+			if pop.Removed > 0 {
+				say("[Pop] removed a", samplesDuration(pop.Removed*cfg.Input.Channels), "pop from the start")
+			}
+			pop = nil
+		}
+		return out
+	}
+	releasePop := func() {
+		if pop != nil {
+			out := filterPop(pop.Flush())
+			writeSamples(f, out)
+			nSamples += len(out)
+		}
+	}
+
+	// a duration limit stops recording after that much audio, counting down
+	// on the status line
+	var limit *countdown
+	if cfg.Output.MaxDuration > 0 {
+		limit = &countdown{max: cfg.Output.MaxDuration}
+		if cfg.Encode.TargetSize != "" {
+			say("Recordings of", cfg.Output.MaxDuration, "fit", cfg.Encode.TargetSize, "at", targetBitrate(cfg.Output.MaxDuration, "A full recording"), "kbps")
+		}
+	}
+	recorded := 0
+
+	// compress shortens long silences in place of splitting on them
+	var compress *audio.SilenceCompressor
+	if cfg.SilenceDetection.Compress {
+		compress = audio.NewSilenceCompressor(samplesIn(cfg.SilenceDetection.CompressAfter), samplesIn(cfg.SilenceDetection.CompressGap))
+	}
+
+	// splitMarks are the sample offsets where silence would have split a
+	// recording made with no-split
+	var splitMarks []int
+	marked := false
+
+	// chapters are embedded in the encoded file in place of splits
+	var chapters []chapter
+	saveChapters := func(end int) {
+		if len(chapters) == 0 {
+			return
+		}
+		if err := writeChapters(fileName, chapters, samplesDuration(end)); err != nil {
+			log.Println("[Chapters] ", err)
+		}
+	}
+
+	// free disk space is checked every few seconds rather than every buffer
+	diskChecked := time.Now()
+
+	// the watchdog reopens a device that stops delivering audio without
+	// reporting an error, as flaky USB interfaces can
+	var watchdog <-chan time.Time
+	if cfg.Input.StallTimeout > 0 && cfg.Input.File == "" {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	lastBuffer := time.Now()
+
+	// markers carry split requests, each naming the next segment or empty
+	// for a numbered one
+	markers := make(chan string)
+	if cfg.Markers.Enabled {
+		if cfg.Markers.FIFO != "" {
+			go readMarkers(cfg.Markers.FIFO, markers)
+		}
+		hup := make(chan os.Signal, 1)
+		notifyMarker(hup)
+		go func() {
+			for range hup {
+				markers <- ""
+			}
+		}()
+	}
+
+	// startSegment begins the next file after a split
+	startSegment := func(name string) {
+		events.send(cfg.OSC.Split, fileName)
+		if name == "" {
+			nRecordedFiles++
+			fileName, nRecordedFiles = nextRecordingName("Unnamed Recording", nRecordedFiles)
+		} else {
+			fileName = filepath.Join(recordingDir(), name+recordingExt())
+			if recordingExists(fileName) {
+				fileName, _ = nextRecordingName(name+" ", 1)
+			}
+		}
+		f = startNewRecording(fileName)
+		nSamples = 0
+		silenceStart = -1
+		skipped = 0
+		delay = cfg.SilenceDetection.Delayatstartofcapture
+		splitMarks = nil
+		marked = false
+		chapters = nil
+	}
+
+	// nextSegment carries on in a new file after the input is reopened,
+	// numbered in endless mode and otherwise named after the last
+	nextSegment := func() {
+		if endlessmode {
+			startSegment("")
+		} else {
+			startSegment(strings.TrimSuffix(filepath.Base(fileName), recordingExt()))
+		}
+	}
+
+	stop := func() {
+		clearStatus()
+		input.close()
+		portaudio.Terminate()
+		releasePop()
+		CloseRecording(f, nSamples)
+		saveChapters(nSamples)
+
+		fileName = encodeRecording(fileName)
 
-	in := make([]int32, 64)
-	stream, err := portaudio.OpenDefaultStream(1, 0, 44100, len(in), in)
-	chk(err)
+		if compress != nil && compress.Saved > 0 {
+			say("Silence compressed by", samplesDuration(compress.Saved))
+		}
 
-	chk(stream.Start())
+		if cfg.SilenceDetection.MarkSplits || cfg.SilenceDetection.MarkerInterval > 0 {
+			marks := intervalMarks(nSamples)
+			if cfg.SilenceDetection.MarkSplits {
+				for _, mark := range splitMarks {
+					marks = append(marks, cueMark{offset: mark})
+				}
+			}
+			if err := writeCue(encodedName(fileName), marks); err != nil {
+				log.Println("[Cue] ", err)
+			}
+		}
+	}
 
 	for {
 		select {
-		case stdin := <-ch:
-			if stdin == "q\n" {
-
-				stream.Close()
-				portaudio.Terminate()
+		case stdin, ok := <-ch:
+			if !ok {
+				ch = nil
+			} else if isKey(stdin, cfg.Keys.Stop) {
+				stop()
+				return
+			} else if isKey(stdin, cfg.Keys.Save) {
+				endlessmode = false
+			} else if isKey(stdin, cfg.Keys.Split) && cfg.Take.Name != "" {
+				clearStatus()
+				releasePop()
 				CloseRecording(f, nSamples)
+				saveChapters(nSamples)
+				encodeRecording(fileName)
+				startSegment(strings.TrimSuffix(filepath.Base(nextTake()), recordingExt()))
+			} else if isKey(stdin, cfg.Keys.Split) {
+				// split as a marker does, without holding up the loop that
+				// receives it
+				go func() { markers <- "" }()
+			}
 
-				encode(fileName)
+		case buf, ok := <-input.buffers:
+			in := buf.samples
+			if !ok && input.err == io.EOF {
+				stop()
 				return
-			} else if stdin == "s\n" {
-				endlessmode = false
+			} else if !ok && (cfg.Input.File != "" || multitrackDevices() != nil) {
+				chk(input.err)
+			} else if !ok && cfg.Input.FallbackDevice == "stop" {
+				log.Println("[Input] ", input.err, "- finishing the recording")
+				stop()
+				return
+			} else if !ok {
+				// the device failed, as when it is unplugged, so the
+				// recording is finished and the next segment starts on
+				// whatever input.fallbackdevice finds
+				log.Println("[Input] ", input.err)
+				releasePop()
+				CloseRecording(f, nSamples)
+				saveChapters(nSamples)
+				encodeRecording(fileName)
+
+				input = reopenStream(input)
+				newPopGuard()
+				lastBuffer = time.Now()
+				nextSegment()
+				continue
+			}
+			lastBuffer = time.Now()
+			if discard > 0 {
+				discard -= len(in)
+				continue
+			}
+			// silence can be judged on the audio as it was captured
+			captured := in
+			if !cfg.Input.GainSilence {
+				captured = append([]int32(nil), in...)
+			}
+			buf.process(dsp)
+			live.send(in)
+			if warmup > 0 {
+				warmup -= len(in)
+				continue
+			}
+			if ice != nil {
+				ice.write(in)
+			}
+			recorded += len(in)
+
+			if cfg.Output.MinFreeSpace > 0 && time.Since(diskChecked) > 10*time.Second {
+				diskChecked = time.Now()
+				if diskFull(filepath.Dir(fileName)) {
+					stop()
+					return
+				}
 			}
 
-		default:
-			chk(stream.Read())
-			chk(binary.Write(f, binary.BigEndian, in))
+			silent := silence.IsSilent(captured)
+			if cfg.SilenceDetection.Trim && leadingSilence && silent {
+				skipped += len(in)
+			} else {
+				leadingSilence = false
+				out := in
+				if compress != nil {
+					out = compress.Filter(in, silent)
+				}
+				out = filterPop(out)
+				writeSamples(f, out)
+
+				if !silent {
+					silenceStart = -1
+				} else if silenceStart < 0 {
+					silenceStart = nSamples
+					events.send(cfg.OSC.Silence, fileName)
+				}
+				nSamples += len(out)
+			}
+			stopper.heard(silent, len(in))
 
 			// Start: detect silence after 5 seconds of recording
-			if (nSamples / 44100) > cfg.SilenceDetection.Delayatstartofcapture {
-				if steamIsSilent(in) {
-					// Stop recording after detecting silence twice
-					if silenceCount > 0 {
-						endlessmode = false
+			if pop == nil && ((nSamples+skipped)/samplesPerSecond()) > delay {
+				if silent && (cfg.SilenceDetection.NoSplit || cfg.SilenceDetection.Compress || cfg.Markers.Enabled) {
+					if !marked {
+						splitMarks = append(splitMarks, silenceStart)
+						if cfg.Encode.Chapters && !cfg.Markers.Enabled {
+							chapters = append(chapters, chapter{start: samplesDuration(silenceStart)})
+						}
+						marked = true
+					}
+				} else if silent && stopper.waiting {
+					// a segment that never heard sound is not split again
+					if stopper.shouldStop() {
 						CloseRecording(f, nSamples)
 
-						e := os.Remove(fileName)
-						if e != nil {
+						if cfg.SilenceDetection.RepeatedSilence == "keep" && nSamples > 0 {
+							encodeRecording(fileName)
+						} else if e := discardRecording(fileName); e != nil {
 							log.Fatal(e)
 						}
 						return
 					}
+				} else if silent {
+					capped := endlessmode && stopper.ended()
+					if cfg.SilenceDetection.Trim && silenceStart >= 0 {
+						CloseRecording(f, silenceStart)
+						saveChapters(silenceStart)
+					} else {
+						CloseRecording(f, nSamples)
+						saveChapters(nSamples)
+					}
 
-					CloseRecording(f, nSamples)
-					encode(fileName)
+					// the last of too many short segments is handled as
+					// repeated silence is
+					if capped {
+						say(fmt.Sprintf("[Stopping] %d short segments in a row", cfg.SilenceDetection.MaxSilenceFiles))
+						if cfg.SilenceDetection.RepeatedSilence == "discard" {
+							chk(discardRecording(fileName))
+						} else {
+							encodeRecording(fileName)
+						}
+						return
+					}
+					encodeRecording(fileName)
 
 					if !endlessmode {
 						return
 					}
 
-					silenceCount++
-					nRecordedFiles++
-					fileName = fmt.Sprint("recordings/Unnamed Recording", nRecordedFiles, ".aiff")
-					f = startNewRecording(fileName)
-					nSamples = 0
+					stopper.split()
+					startSegment("")
+					leadingSilence = true
 
 				} else {
-					silenceCount = 0
+					marked = false
 				}
 			}
 			// End: Determine Volume
 
-			nSamples += len(in)
-			select {
-			case <-sig:
+			if limit != nil && limit.update(samplesDuration(recorded)) {
+				stop()
 				return
-			default:
 			}
+
+		case name := <-markers:
+			if cfg.Encode.Chapters {
+				chapters = append(chapters, chapter{start: samplesDuration(nSamples), title: name})
+				continue
+			}
+			releasePop()
+			CloseRecording(f, nSamples)
+			encodeRecording(fileName)
+			// an unnamed marker carries on under the current name as a
+			// reopened input does, numbered only in endless mode
+			if name == "" {
+				nextSegment()
+			} else {
+				startSegment(name)
+			}
+			leadingSilence = false
+
+		case <-watchdog:
+			if time.Since(lastBuffer) < cfg.Input.StallTimeout || input.reconnecting() {
+				continue
+			}
+			log.Printf("[Watchdog] no audio for %v, reopening the input device", cfg.Input.StallTimeout)
+			releasePop()
+			CloseRecording(f, nSamples)
+			saveChapters(nSamples)
+			encodeRecording(fileName)
+
+			input = reopenStream(input)
+			newPopGuard()
+			lastBuffer = time.Now()
+			nextSegment()
+
+		case <-sig:
+			// finish the segment being recorded rather than lose it
+			stop()
+			return
 		}
 	}
+}
 
-	chk(stream.Stop())
+// samplesPerSecond counts every channel's samples, as nSamples does
+func samplesPerSecond() int {
+	return sampleRate * cfg.Input.Channels
 }
 
-func startNewRecording(fileName string) *os.File {
-	f, err := os.Create(fileName)
-	chk(err)
-
-	// form chunk
-	_, err = f.WriteString("FORM")
-	chk(err)
-	chk(binary.Write(f, binary.BigEndian, int32(0))) //total bytes
-	_, err = f.WriteString("AIFF")
-	chk(err)
-
-	// common chunk
-	_, err = f.WriteString("COMM")
-	chk(err)
-	chk(binary.Write(f, binary.BigEndian, int32(18)))                  //size
-	chk(binary.Write(f, binary.BigEndian, int16(1)))                   //channels
-	chk(binary.Write(f, binary.BigEndian, int32(0)))                   //number of samples
-	chk(binary.Write(f, binary.BigEndian, int16(32)))                  //bits per sample
-	_, err = f.Write([]byte{0x40, 0x0e, 0xac, 0x44, 0, 0, 0, 0, 0, 0}) //80-bit sample rate 44100
-	chk(err)
-
-	// sound chunk
-	_, err = f.WriteString("SSND")
-	chk(err)
-	chk(binary.Write(f, binary.BigEndian, int32(0))) //size
-	chk(binary.Write(f, binary.BigEndian, int32(0))) //offset
-	chk(binary.Write(f, binary.BigEndian, int32(0))) //block
-
-	return f
+// samplesIn is the number of interleaved samples lasting d
+func samplesIn(d time.Duration) int {
+	return int(d.Seconds() * float64(samplesPerSecond()))
 }
 
-// CloseRecording is run when file is closed
-func CloseRecording(f *os.File, nSamples int) {
-	// fill in missing sizes
-	totalBytes := 4 + 8 + 18 + 8 + 8 + 4*nSamples
-	_, err := f.Seek(4, 0)
-	chk(err)
-	chk(binary.Write(f, binary.BigEndian, int32(totalBytes)))
-	_, err = f.Seek(22, 0)
-	chk(err)
-	chk(binary.Write(f, binary.BigEndian, int32(nSamples)))
-	_, err = f.Seek(42, 0)
-	chk(err)
-	chk(binary.Write(f, binary.BigEndian, int32(4*nSamples+8)))
-	chk(f.Close())
+// samplesDuration is how long n interleaved samples last
+func samplesDuration(n int) time.Duration {
+	return time.Duration(n) * time.Second / time.Duration(samplesPerSecond())
 }
 
-func steamIsSilent(in []int32) bool {
-	bufLength := float64(len(in))
-	sum := float64(0)
-	for _, n := range in {
-		x := math.Abs(float64(n) / math.MaxInt32)
-		sum += math.Pow(math.Min(float64(x)/0.1, 1), 2)
-	}
-	rms := math.Sqrt(sum / bufLength)
-	return (rms < .0001)
+// syncTone is the reference tone a recording starts with
+func syncTone() []int32 {
+	frames := int(cfg.SyncTone.Duration.Seconds() * sampleRate)
+	return audio.Tone(cfg.SyncTone.Frequency, cfg.SyncTone.Level, frames, sampleRate, cfg.Input.Channels)
 }
 
-func encode(fileName string) {
-	artist := cfg.Encode.DefaultArtist
-	title := cfg.Encode.DefaultTitle
+// recordingExt is the file extension of the configured recording format
+func recordingExt() string {
+	return "." + cfg.Output.Format
+}
 
-	if strings.Index(fileName, " - ") > 1 {
-		spl := strings.Split(strings.Replace(fileName, ".aiff", "", 1), " - ")
-		if len(spl) > 1 {
-			artist = spl[0]
-			title = spl[1]
-		}
+// say prints a message for the user unless running quietly, errors are
+// logged to stderr instead
+func say(a ...interface{}) {
+	if !cfg.Messages.Quiet {
+		clearStatus()
+		fmt.Println(a...)
 	}
+}
 
-	fmt.Println("[Encoding] ", artist, title)
+// statusWidth is the length of the status line last drawn, zero when none
+// is showing
+var statusWidth int
 
-	_, err := exec.Command("lame", fileName, "-b", ``+cfg.Encode.Bitrate, "--ta", ``+artist, "--tt", ``+title).Output()
-	if err != nil {
-		log.Fatal(err)
+// status draws text on the status line in place of what was there
+func status(text string) {
+	if !cfg.Messages.Quiet {
+		fmt.Printf("\r%-*s", statusWidth, text)
+		statusWidth = len(text)
 	}
+}
 
-	e := os.Remove(fileName)
-	if e != nil {
-		log.Fatal(e)
+// clearStatus blanks the status line so a message can be printed in its
+// place
+func clearStatus() {
+	if statusWidth > 0 {
+		fmt.Printf("\r%s\r", strings.Repeat(" ", statusWidth))
+		statusWidth = 0
 	}
 }
 
-func numRecordedFiles() int {
-	files, _ := ioutil.ReadDir("recordings/")
-	return len(files)
+// silenceThreshold converts the configured silence threshold to the scale of
+// audio.Level. A linear threshold is already on that scale.
+func silenceThreshold() float64 {
+	if cfg.SilenceDetection.LinearThreshold {
+		return cfg.SilenceDetection.Threshold
+	}
+	return audio.LevelFromDB(cfg.SilenceDetection.Threshold)
+}
+
+// newSilenceDetector judges silence as configured
+func newSilenceDetector() *audio.SilenceDetector {
+	d := audio.NewSilenceDetector(cfg.SilenceDetection.Window, cfg.Input.Channels, cfg.SilenceDetection.Channels == "any", silenceThreshold())
+	d.Band = newSilenceBand()
+	return d
+}
+
+// newSilenceBand is the band pass silence is measured through, or nil when
+// silence is measured on the full band
+func newSilenceBand() *audio.BandPass {
+	if !cfg.SilenceDetection.Band {
+		return nil
+	}
+	return audio.NewBandPass(cfg.SilenceDetection.BandLow, cfg.SilenceDetection.BandHigh, sampleRate, cfg.Input.Channels)
 }
 
 func chk(err error) {
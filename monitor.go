@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// monitorPCMRate is the rate in Hz the waveform sent to monitoring clients
+// is downsampled to, plenty to draw and small enough to send many times a
+// second
+const monitorPCMRate = 2000
+
+// monitorWriteTimeout drops a client that cannot take a message in time
+const monitorWriteTimeout = 5 * time.Second
+
+// live is the WebSocket monitor fed each buffer recorded, nil when off
+var live *liveMonitor
+
+// liveMonitor serves levels and a downsampled waveform of the audio to
+// browsers over WebSocket. Buffers are summarised on the recording
+// goroutine, which only ever hands a finished message to the broadcast
+// channel without waiting, so slow or many clients cannot hold up
+// recording; each client drops messages it falls behind on.
+type liveMonitor struct {
+	broadcast   chan []byte
+	join, leave chan chan []byte
+
+	every  int // frames per message
+	step   int // frames per waveform sample
+	frames int
+	peak   []float64
+	sumSq  []float64
+	sum    float64
+	summed int
+	pcm    []int16
+}
+
+// monitorMessage is sent as JSON text for every message period, with levels
+// in dBFS for each channel and the mono waveform as 16 bit samples at
+// about monitorPCMRate
+type monitorMessage struct {
+	Peak    []float64 `json:"peak"`
+	RMS     []float64 `json:"rms"`
+	Rate    int       `json:"rate"`
+	Samples []int16   `json:"samples"`
+}
+
+// startLiveMonitor listens on address, such as :9000, serving a meter page
+// at / and the WebSocket at /ws
+func startLiveMonitor(address string) (*liveMonitor, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("monitor: %v", err)
+	}
+
+	m := &liveMonitor{
+		broadcast: make(chan []byte, 8),
+		join:      make(chan chan []byte),
+		leave:     make(chan chan []byte),
+		every:     sampleRate / cfg.Monitor.Rate,
+		step:      sampleRate / monitorPCMRate,
+		peak:      make([]float64, cfg.Input.Channels),
+		sumSq:     make([]float64, cfg.Input.Channels),
+	}
+	go m.run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, monitorPage)
+	})
+	mux.HandleFunc("/ws", m.serveWebSocket)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Println("[Monitor] ", err)
+		}
+	}()
+
+	say("Live monitor at http://" + ln.Addr().String() + "/")
+	return m, nil
+}
+
+// send adds a processed buffer to the message being summarised, passing the
+// message on once it covers its period
+func (m *liveMonitor) send(in []int32) {
+	if m == nil {
+		return
+	}
+	channels := len(m.peak)
+	for i := 0; i+channels <= len(in); i += channels {
+		mono := 0.0
+		for c, n := range in[i : i+channels] {
+			v := float64(n) / -math.MinInt32
+			m.peak[c] = math.Max(m.peak[c], math.Abs(v))
+			m.sumSq[c] += v * v
+			mono += v
+		}
+		m.sum += mono / float64(channels)
+		m.summed++
+		if m.summed == m.step {
+			m.pcm = append(m.pcm, int16(m.sum/float64(m.summed)*math.MaxInt16))
+			m.sum, m.summed = 0, 0
+		}
+
+		m.frames++
+		if m.frames == m.every {
+			m.flush()
+		}
+	}
+}
+
+// flush hands the finished message to the broadcast and starts the next
+func (m *liveMonitor) flush() {
+	msg := monitorMessage{Rate: sampleRate / m.step, Samples: m.pcm}
+	for c := range m.peak {
+		msg.Peak = append(msg.Peak, monitorDB(m.peak[c]))
+		msg.RMS = append(msg.RMS, monitorDB(math.Sqrt(m.sumSq[c]/float64(m.frames))))
+		m.peak[c], m.sumSq[c] = 0, 0
+	}
+	data, _ := json.Marshal(msg)
+	select {
+	case m.broadcast <- data:
+	default:
+	}
+	m.frames = 0
+	m.pcm = m.pcm[:0]
+}
+
+// monitorDB is a level in dBFS, rounded for sending and floored at -120
+func monitorDB(level float64) float64 {
+	return math.Round(math.Max(-120, 20*math.Log10(level+1e-12))*10) / 10
+}
+
+// run passes each message to every connected client that has room for it
+func (m *liveMonitor) run() {
+	clients := map[chan []byte]bool{}
+	for {
+		select {
+		case c := <-m.join:
+			clients[c] = true
+		case c := <-m.leave:
+			delete(clients, c)
+		case data := <-m.broadcast:
+			for c := range clients {
+				select {
+				case c <- data:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// serveWebSocket upgrades the request as RFC 6455 describes and sends the
+// client every message until it goes away
+func (m *liveMonitor) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade this connection", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	accept := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]))
+
+	// the client only ever closes, so its frames are read just to notice that
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		readUntilClose(rw.Reader)
+	}()
+
+	c := make(chan []byte, 4)
+	m.join <- c
+	defer func() { m.leave <- c }()
+	for {
+		select {
+		case data := <-c:
+			conn.SetWriteDeadline(time.Now().Add(monitorWriteTimeout))
+			if err := writeFrame(conn, 0x1, data); err != nil {
+				return
+			}
+		case <-closed:
+			conn.SetWriteDeadline(time.Now().Add(monitorWriteTimeout))
+			writeFrame(conn, 0x8, nil)
+			return
+		}
+	}
+}
+
+// writeFrame sends one unmasked, unfragmented frame with the given opcode
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= math.MaxUint16:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readUntilClose discards the client's frames until it sends a close frame
+// or the connection fails
+func readUntilClose(r *bufio.Reader) {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return
+		}
+		if head[0]&0x0f == 0x8 {
+			return
+		}
+
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if head[1]&0x80 != 0 {
+			n += 4 // the mask key
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
+			return
+		}
+	}
+}
+
+// monitorPage draws a peak meter for each channel and the waveform from the
+// WebSocket on the same address
+const monitorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Go-Record-Audio</title>
+<style>body { margin: 0; background: #111; } canvas { display: block; width: 100vw; height: 100vh; }</style>
+</head>
+<body>
+<canvas id="c"></canvas>
+<script>
+const canvas = document.getElementById("c"), ctx = canvas.getContext("2d");
+let wave = [], msg = null;
+function connect() {
+	const ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+	ws.onmessage = e => {
+		msg = JSON.parse(e.data);
+		wave = wave.concat(msg.samples).slice(-msg.rate * 5);
+	};
+	ws.onclose = () => setTimeout(connect, 1000);
+}
+function draw() {
+	const w = canvas.width = canvas.clientWidth, h = canvas.height = canvas.clientHeight;
+	ctx.strokeStyle = "#4c4";
+	ctx.beginPath();
+	wave.forEach((s, i) => ctx.lineTo(i * w / wave.length, h / 2 - s / 32768 * h / 2));
+	ctx.stroke();
+	if (msg) {
+		const bar = 24;
+		msg.peak.forEach((db, c) => {
+			const level = Math.max(0, 1 + db / 60);
+			ctx.fillStyle = db > -1 ? "#e33" : db > -12 ? "#ec3" : "#4c4";
+			ctx.fillRect(0, c * (bar + 4), level * w, bar);
+			ctx.fillStyle = "#fff";
+			ctx.fillText(db.toFixed(1) + " dB peak, " + msg.rms[c].toFixed(1) + " dB RMS", 6, c * (bar + 4) + 16);
+		});
+	}
+	requestAnimationFrame(draw);
+}
+connect();
+draw();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// multitrackQueue is how many buffers each device may get ahead of the
+// slowest before its oldest audio is dropped
+const multitrackQueue = 8
+
+// multitrackSource records several input devices together, each supplying
+// an equal share of the channels of every frame, such as one USB microphone
+// per channel of a podcast. Each device is read on its own goroutine into a
+// short queue so their buffers, which arrive at slightly different times,
+// are combined in lockstep.
+type multitrackSource struct {
+	in       []int32
+	channels int // channels each device supplies
+	tracks   []*track
+	errs     chan error
+	done     chan struct{}
+	readers  sync.WaitGroup
+}
+
+// track is one device of a multitrack recording
+type track struct {
+	name   string
+	stream *portaudio.Stream
+	buf    []int32 // filled by each read of the stream
+	queue  chan []int32
+}
+
+// openMultitrack starts a stream on each named device and begins reading
+// them for in
+func openMultitrack(names []string, in []int32) (*multitrackSource, error) {
+	s := &multitrackSource{
+		in:       in,
+		channels: cfg.Input.Channels / len(names),
+		errs:     make(chan error, len(names)),
+		done:     make(chan struct{}),
+	}
+	frames := len(in) / cfg.Input.Channels
+	for _, name := range names {
+		device, err := findInputDevice(name)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		t := &track{name: device.Name, buf: make([]int32, frames*s.channels), queue: make(chan []int32, multitrackQueue)}
+		p := portaudio.HighLatencyParameters(device, nil)
+		p.Input.Channels = s.channels
+		p.SampleRate = sampleRate
+		p.FramesPerBuffer = frames
+		if t.stream, err = portaudio.OpenStream(p, t.buf); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("%s: %v", device.Name, err)
+		}
+		showStream(device, "shared", s.channels, frames, "32 bit integer", t.stream.Info())
+		s.tracks = append(s.tracks, t)
+	}
+
+	// start the streams together so they begin as close in time as they can
+	for _, t := range s.tracks {
+		if err := t.stream.Start(); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("%s: %v", t.name, err)
+		}
+		say("Input latency reported by", t.name+":", t.stream.Info().InputLatency)
+	}
+	for _, t := range s.tracks {
+		s.readers.Add(1)
+		go s.read(t)
+	}
+	return s, nil
+}
+
+// read queues each buffer a device delivers. A device whose clock runs
+// fast fills its queue, and its oldest buffer is then dropped so the
+// tracks stay in step.
+func (s *multitrackSource) read(t *track) {
+	defer s.readers.Done()
+	dropped := false
+	for {
+		if err := t.stream.Read(); err != nil && !inputOverflowed(err) {
+			s.errs <- fmt.Errorf("%s: %v", t.name, err)
+			return
+		}
+		buf := append([]int32(nil), t.buf...)
+		select {
+		case <-s.done:
+			return
+		case t.queue <- buf:
+			continue
+		default:
+		}
+
+		select {
+		case <-t.queue:
+		default:
+		}
+		t.queue <- buf
+		if !dropped {
+			log.Println("[Multitrack] ", t.name, "is running ahead of the other devices, dropping audio to keep them in step")
+			dropped = true
+		}
+	}
+}
+
+// Read fills the input buffer with the next buffer of every device,
+// interleaving each device's channels in the order the devices were given
+func (s *multitrackSource) Read() error {
+	total := len(s.tracks) * s.channels
+	for d, t := range s.tracks {
+		var buf []int32
+		select {
+		case buf = <-t.queue:
+		case err := <-s.errs:
+			return err
+		}
+		for i, n := range buf {
+			frame, c := i/s.channels, i%s.channels
+			s.in[frame*total+d*s.channels+c] = n
+		}
+	}
+	return nil
+}
+
+// Close stops reading and closes every stream once its reader has finished
+// with it
+func (s *multitrackSource) Close() error {
+	close(s.done)
+	s.readers.Wait()
+	var first error
+	for _, t := range s.tracks {
+		if err := t.stream.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
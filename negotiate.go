@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/1hitsong/Go-Record-Audio/audio"
+	"github.com/gordonklaus/portaudio"
+)
+
+// streamFormat is a sample rate and channel count a device is opened at
+type streamFormat struct {
+	rate     float64
+	channels int
+}
+
+func (f streamFormat) String() string {
+	return fmt.Sprintf("%v Hz with %d channels", f.rate, f.channels)
+}
+
+// streamFormats lists the formats a device is tried at in order: the
+// recording's, then the device's own sample rate, then mono and, for a mono
+// recording, stereo at either rate. Other channel counts could not be
+// converted to the recording's.
+func streamFormats(device *portaudio.DeviceInfo) []streamFormat {
+	var formats []streamFormat
+	seen := map[streamFormat]bool{}
+	for _, channels := range []int{cfg.Input.Channels, 1, 2} {
+		if channels != cfg.Input.Channels && channels != 1 && cfg.Input.Channels != 1 {
+			continue
+		}
+		for _, rate := range []float64{sampleRate, device.DefaultSampleRate} {
+			f := streamFormat{rate, channels}
+			if rate > 0 && channels <= device.MaxInputChannels && !seen[f] {
+				seen[f] = true
+				formats = append(formats, f)
+			}
+		}
+	}
+	return formats
+}
+
+// openNegotiated opens the device at the recording's format or, when the
+// device does not support that, at the first of streamFormats it does,
+// converting what it reads to the recording's format
+func openNegotiated(device *portaudio.DeviceInfo, in []int32) (sampleSource, error) {
+	frames := len(in) / cfg.Input.Channels
+	want := streamFormat{sampleRate, cfg.Input.Channels}
+	formats := []streamFormat{want}
+	if cfg.Input.Negotiate {
+		formats = streamFormats(device)
+	}
+
+	var first error
+	for _, f := range formats {
+		buf := in
+		if f != want {
+			buf = make([]int32, frames*f.channels)
+		}
+		p := portaudio.HighLatencyParameters(device, nil)
+		p.Input.Channels = f.channels
+		p.SampleRate = f.rate
+		p.FramesPerBuffer = frames
+		// converted audio is read as integers, as the resampler works on them
+		src, err := openStream(p, buf, f == want && floatInput())
+		if err != nil {
+			if first == nil {
+				first = fmt.Errorf("%s at %v: %v", device.Name, f, err)
+			}
+			continue
+		}
+
+		if f == want {
+			return src, nil
+		}
+		log.Printf("[Input] %s cannot record at %v, recording it at %v and converting", device.Name, want, f)
+		return newConvertingSource(src.(*portaudio.Stream), buf, f, in)
+	}
+	return nil, first
+}
+
+// convertingSource reads a device opened at another sample rate or channel
+// count than recordings use, converting it frame by frame as an input file
+// at another format is
+type convertingSource struct {
+	*portaudio.Stream
+	raw       []int32 // the device's buffer
+	pos       int     // frame of raw read next
+	channels  int     // the device's channels
+	in        []int32
+	frame     []int32 // a frame converted to the recording's channels
+	resampler *audio.Resampler
+	overflow  error // an overflow during the current Read
+}
+
+func newConvertingSource(pa *portaudio.Stream, raw []int32, f streamFormat, in []int32) (*convertingSource, error) {
+	s := &convertingSource{
+		Stream:   pa,
+		raw:      raw,
+		pos:      len(raw) / f.channels,
+		channels: f.channels,
+		in:       in,
+		frame:    make([]int32, cfg.Input.Channels),
+	}
+	if f.rate != sampleRate {
+		var err error
+		if s.resampler, err = audio.NewResampler(f.rate, sampleRate, cfg.Input.Channels, cfg.Input.Resample); err != nil {
+			pa.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Read fills the input buffer with converted frames, reading the device as
+// often as that needs. An overflow is returned once the buffer is full, as
+// the audio read is still good.
+func (s *convertingSource) Read() error {
+	s.overflow = nil
+	channels := cfg.Input.Channels
+	for i := 0; i+channels <= len(s.in); i += channels {
+		if err := s.nextFrame(s.in[i : i+channels]); err != nil {
+			return err
+		}
+	}
+	return s.overflow
+}
+
+// nextFrame fills out with the next frame at the recording's channels and
+// sample rate
+func (s *convertingSource) nextFrame(out []int32) error {
+	if s.resampler == nil {
+		return s.readFrame(out)
+	}
+	for s.resampler.Need() {
+		if err := s.readFrame(s.frame); err != nil {
+			return err
+		}
+		s.resampler.Write(s.frame)
+	}
+	s.resampler.Next(out)
+	return nil
+}
+
+// readFrame converts the next frame of the device's buffer into out,
+// reading the device again once the buffer is used up
+func (s *convertingSource) readFrame(out []int32) error {
+	if s.pos == len(s.raw)/s.channels {
+		if err := s.Stream.Read(); err == portaudio.InputOverflowed {
+			s.overflow = err
+		} else if err != nil {
+			return err
+		}
+		s.pos = 0
+	}
+	convertFrame(s.raw[s.pos*s.channels:(s.pos+1)*s.channels], out)
+	s.pos++
+	return nil
+}
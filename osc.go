@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+)
+
+// events is the OSC sender told of recording events, nil when off
+var events *oscSender
+
+// oscSender sends an OSC message over UDP as recording starts, splits,
+// hears silence and stops, for live performance software to follow along.
+// UDP never waits on the receiver, so a missing one cannot hold up
+// recording; a failed send is logged once.
+type oscSender struct {
+	conn   net.Conn
+	failed bool
+}
+
+// startOSC sends events to address, such as 127.0.0.1:9000
+func startOSC(address string) (*oscSender, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("osc: %v", err)
+	}
+	return &oscSender{conn: conn}, nil
+}
+
+// send sends the message for an event to its address pattern, with the
+// recording it concerns as a string argument when there is one. An empty
+// pattern leaves the event out.
+func (o *oscSender) send(pattern, fileName string) {
+	if o == nil || pattern == "" {
+		return
+	}
+	var args []string
+	if fileName != "" {
+		args = append(args, fileName)
+	}
+	if _, err := o.conn.Write(oscMessage(pattern, args...)); err != nil && !o.failed {
+		log.Println("[OSC] ", err)
+		o.failed = true
+	}
+}
+
+func (o *oscSender) close() {
+	if o != nil {
+		o.conn.Close()
+	}
+}
+
+// oscMessage encodes an OSC 1.0 message with string arguments: the address
+// pattern, the type tags and each argument, every one a null terminated
+// string padded to a multiple of four bytes
+func oscMessage(pattern string, args ...string) []byte {
+	var msg bytes.Buffer
+	oscString(&msg, pattern)
+	tags := ","
+	for range args {
+		tags += "s"
+	}
+	oscString(&msg, tags)
+	for _, arg := range args {
+		oscString(&msg, arg)
+	}
+	return msg.Bytes()
+}
+
+func oscString(b *bytes.Buffer, s string) {
+	b.WriteString(s)
+	b.Write(make([]byte, 4-len(s)%4))
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/1hitsong/Go-Record-Audio/audio"
+)
+
+// taskGroup is a WaitGroup that counts its tasks so shutdown can report
+// how many finished
+type taskGroup struct {
+	wg       sync.WaitGroup
+	started  int32
+	finished int32
+}
+
+func (t *taskGroup) Add(n int) {
+	atomic.AddInt32(&t.started, int32(n))
+	t.wg.Add(n)
+}
+
+func (t *taskGroup) Done() {
+	atomic.AddInt32(&t.finished, 1)
+	t.wg.Done()
+}
+
+// shutdown closes the queue of recordings to encode and waits for it, then
+// for the background tasks its encodes started, reporting how many encodes
+// completed. Both share the one timeout, unless it is 0, after which the
+// program exits with the rest abandoned; an abandoned encode leaves its
+// recording in place.
+func shutdown(timeout time.Duration) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	if q := recordingEncodes; q != nil {
+		if q.Unfinished() > 0 {
+			say("Waiting for encodes to finish.")
+		}
+		select {
+		case <-q.Close():
+			if q.Completed() > 0 || q.Failed() > 0 {
+				say(fmt.Sprintf("[Shutdown] %d encodes completed, %d failed", q.Completed(), q.Failed()))
+			}
+		case <-expired:
+			log.Printf("[Shutdown] gave up after %v: %d encodes completed, %d failed, %d abandoned", timeout, q.Completed(), q.Failed(), q.Unfinished())
+			background.report(timeout)
+			os.Exit(1)
+		}
+	}
+	background.drainUntil(timeout, expired)
+}
+
+// drain waits for the tasks before exiting. After timeout, unless it is 0,
+// the program exits with the unfinished tasks abandoned; encodes remove a
+// recording only once they succeed, so abandoned ones leave it in place.
+func (t *taskGroup) drain(timeout time.Duration) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	t.drainUntil(timeout, expired)
+}
+
+// drainUntil drains the tasks until expired fires, timeout after shutdown
+// began
+func (t *taskGroup) drainUntil(timeout time.Duration, expired <-chan time.Time) {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	if atomic.LoadInt32(&t.started) > atomic.LoadInt32(&t.finished) {
+		say("Waiting for background work to finish.")
+	}
+
+	select {
+	case <-done:
+		if started := atomic.LoadInt32(&t.started); started > 0 {
+			say(fmt.Sprintf("[Shutdown] %d of %d background tasks finished", started, started))
+		}
+		reportUploads()
+	case <-expired:
+		t.report(timeout)
+		os.Exit(1)
+	}
+}
+
+// report logs how many tasks finished and were abandoned when shutdown gave
+// up after timeout
+func (t *taskGroup) report(timeout time.Duration) {
+	started, finished := atomic.LoadInt32(&t.started), atomic.LoadInt32(&t.finished)
+	log.Printf("[Shutdown] gave up after %v: %d of %d background tasks finished, %d abandoned", timeout, finished, started, started-finished)
+	reportUploads()
+}
+
+// transfers counts the uploads or publishes that finished, after any
+// retries, for the summary on exit
+type transfers struct {
+	succeeded, failed int32
+}
+
+var uploads, publishes transfers
+
+// report adds how many transfers succeeded and failed to the summary on
+// exit, as an error when any failed
+func (t *transfers) report(tag, what string) {
+	succeeded, failed := atomic.LoadInt32(&t.succeeded), atomic.LoadInt32(&t.failed)
+	switch {
+	case failed > 0:
+		log.Printf("%s %d %s succeeded, %d failed", tag, succeeded, what, failed)
+	case succeeded > 0:
+		say(fmt.Sprintf("%s %d %s succeeded, 0 failed", tag, succeeded, what))
+	}
+}
+
+// reportUploads adds the upload and publish counts to the summary on exit
+func reportUploads() {
+	uploads.report("[Upload]", "uploads")
+	publishes.report("[Publish]", "publishes")
+}
+
+// retryUpload runs an upload or publish of fileName, retrying failures it
+// reports as transient up to retries times after a delay that starts at
+// upload.retrydelay and doubles each time, and counts how it ended
+func retryUpload(tag, fileName string, retries int, count *transfers, upload func() (bool, error)) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := upload()
+		if err == nil {
+			atomic.AddInt32(&count.succeeded, 1)
+			return nil
+		}
+		if !retry || attempt >= retries {
+			atomic.AddInt32(&count.failed, 1)
+			log.Println(tag+" ", fileName, err)
+			return err
+		}
+		log.Println(tag+" ", fileName, err, "- retrying")
+		time.Sleep(cfg.Upload.RetryDelay << uint(attempt))
+	}
+}
+
+// postProcess runs the optional steps that follow a successful encode in
+// the background so recording can continue
+func postProcess(fileName, recording string) {
+	defer background.Done()
+
+	if cfg.Output.Checksum {
+		writeChecksum(fileName)
+	}
+	if cfg.Transcribe.Command != "" {
+		transcribe(fileName)
+	}
+	// publish first, as uploading may delete the file
+	var published error
+	if cfg.Upload.Queue.Enabled {
+		published = publishFile(fileName, recording)
+	}
+	if cfg.Upload.S3.Enabled {
+		uploadS3(fileName, published != nil)
+	}
+}
+
+// commandArgs splits a configured command into the program to run and its
+// arguments, adding extra arguments after them
+func commandArgs(command string, extra ...string) ([]string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("no command to run")
+	}
+	return append(args, extra...), nil
+}
+
+// transcribe runs the speech to text command on an encoded recording and
+// saves what it prints to a .txt file beside it
+func transcribe(fileName string) {
+	args, err := commandArgs(cfg.Transcribe.Command, fileName)
+	if err != nil {
+		log.Println("[Transcribe] ", fileName, err)
+		return
+	}
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		log.Println("[Transcribe] ", fileName, err)
+		return
+	}
+
+	err = writeFile(strings.TrimSuffix(fileName, filepath.Ext(fileName))+".txt", out)
+	if err != nil {
+		log.Println("[Transcribe] ", fileName, err)
+	}
+}
+
+// autoName renames a finished recording after the opening words the
+// transcription command hears in its first few seconds, moving its
+// chapters and what is known about it along with it. The recording keeps
+// its name when transcription fails or hears nothing.
+func autoName(fileName string) string {
+	excerpt, err := writeExcerpt(fileName, ".opening", cfg.Transcribe.AutoNameLength)
+	if err != nil {
+		log.Println("[Auto name] ", fileName, err)
+		return fileName
+	}
+	args, err := commandArgs(cfg.Transcribe.Command, excerpt)
+	var out []byte
+	if err == nil {
+		out, err = exec.Command(args[0], args[1:]...).Output()
+	}
+	os.Remove(excerpt)
+	if err != nil {
+		log.Println("[Auto name] ", fileName, err)
+		return fileName
+	}
+	snippet := nameSnippet(string(out), cfg.Transcribe.AutoNameWords)
+	if snippet == "" {
+		return fileName
+	}
+
+	dir, ext := filepath.Dir(fileName), filepath.Ext(fileName)
+	name := filepath.Join(dir, snippet+ext)
+	for n := 2; fileExists(name) || fileExists(encodedName(name)); n++ {
+		name = filepath.Join(dir, fmt.Sprint(snippet, " ", n, ext))
+	}
+	if err := os.Rename(fileName, name); err != nil {
+		log.Println("[Auto name] ", fileName, err)
+		return fileName
+	}
+	if fileExists(chaptersName(fileName)) {
+		if err := os.Rename(chaptersName(fileName), chaptersName(name)); err != nil {
+			log.Println("[Auto name] ", err)
+		}
+	}
+	shareRecordingState(fileName, name)
+	say("[Auto name] ", filepath.Base(fileName), "is now", filepath.Base(name))
+	return name
+}
+
+// nameSnippet makes a file name from the first words of a transcript,
+// keeping only letters, digits, apostrophes and hyphens in each. Words
+// without a letter or digit are left out so a lone dash cannot split the
+// name into an artist and title.
+func nameSnippet(transcript string, words int) string {
+	var kept []string
+	for _, word := range strings.Fields(transcript) {
+		word = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '-' {
+				return r
+			}
+			return -1
+		}, word)
+		if strings.IndexFunc(word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) < 0 {
+			continue
+		}
+		kept = append(kept, word)
+		if len(kept) == words {
+			break
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// writeChecksum saves the SHA-256 of a file to a .sha256 sidecar in the
+// "<hash>  <filename>" format sha256sum -c reads
+func writeChecksum(fileName string) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		log.Println("[Checksum] ", err)
+		return
+	}
+	sum, _, err := hashFile(f)
+	f.Close()
+	if err != nil {
+		log.Println("[Checksum] ", fileName, err)
+		return
+	}
+
+	line := sum + "  " + filepath.Base(fileName) + "\n"
+	if err := writeFile(fileName+".sha256", []byte(line)); err != nil {
+		log.Println("[Checksum] ", err)
+	}
+}
+
+// hashFile streams r through SHA-256, returning the hex digest and the
+// number of bytes read
+func hashFile(r io.Reader) (string, int64, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// uploadS3 puts an encoded file in the configured bucket, retrying transient
+// failures with a growing delay. With s3.deletelocal the file is deleted once
+// uploaded, unless keep is set because publishing it failed, and once its
+// retries run out too unless upload.keeponfail keeps it.
+func uploadS3(fileName string, keep bool) {
+	if err := retryUpload("[Upload]", fileName, cfg.Upload.S3.Retries, &uploads, func() (bool, error) {
+		return putS3Object(fileName)
+	}); err != nil {
+		if cfg.Upload.KeepOnFail || !cfg.Upload.S3.DeleteLocal {
+			log.Println("[Upload] ", fileName, "kept after its upload failed")
+		} else if err := os.Remove(fileName); err != nil {
+			log.Println("[Upload] ", err)
+		} else {
+			log.Println("[Upload] ", fileName, "removed though its upload failed, as upload.keeponfail is off")
+		}
+		return
+	}
+
+	if keep {
+		log.Println("[Upload] ", fileName, "kept as publishing it failed")
+	} else if cfg.Upload.S3.DeleteLocal {
+		if err := os.Remove(fileName); err != nil {
+			log.Println("[Upload] ", err)
+		}
+	}
+}
+
+// putS3Object uploads a file with a SigV4 signed PUT request. It reports
+// whether a failure is worth retrying.
+func putS3Object(fileName string) (bool, error) {
+	s3 := cfg.Upload.S3
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	payloadHash, size, err := hashFile(f)
+	if err != nil {
+		return false, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	u, err := url.Parse(s3.Endpoint)
+	if err != nil {
+		return false, err
+	}
+	key := filepath.Base(fileName)
+	u.Path = "/" + s3.Bucket + "/" + key
+	u.RawPath = "/" + s3URIEncode(s3.Bucket) + "/" + s3URIEncode(key)
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), f)
+	if err != nil {
+		return false, err
+	}
+	req.ContentLength = size
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s3.Region + "/s3/aws4_request"
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		http.MethodPut,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + s3.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s3.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKey, scope, signedHeaders, signature))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return false, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode escapes everything but unreserved characters as SigV4 requires
+func s3URIEncode(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// writeSpectrogram draws a PNG spectrogram of a finished recording, mixing
+// its channels to mono, at the channel count and sample rate of its header
+func writeSpectrogram(fileName string) error {
+	src, err := openAudioFile(fileName, nil)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	s, err := audio.NewSpectrogram(src.frames(), int(src.sampleRate), cfg.Spectrogram.FFTSize, cfg.Spectrogram.Window, cfg.Spectrogram.Width, cfg.Spectrogram.Height)
+	if err != nil {
+		return err
+	}
+	// the file is read as it is stored, whatever the input settings now
+	src.raw = make([]int32, src.channels)
+	for src.readFrame(src.raw) {
+		sum := 0.0
+		for _, v := range src.raw {
+			sum += float64(v)
+		}
+		s.Add(sum / float64(src.channels) / math.MaxInt32)
+	}
+	if src.err != nil {
+		return src.err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, s.Image()); err != nil {
+		return err
+	}
+	name := strings.Replace(cfg.Spectrogram.File, "{name}", strings.TrimSuffix(fileName, filepath.Ext(fileName)), -1)
+	return writeFile(name, buf.Bytes())
+}
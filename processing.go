@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/1hitsong/Go-Record-Audio/audio"
+	"github.com/1hitsong/Go-Record-Audio/recorder"
+)
+
+// processors are the stages a processing chain can name, each made from its
+// settings in the configuration
+var processors = map[string]func() audio.Processor{
+	"highpass": func() audio.Processor {
+		return audio.NewHighPass(cfg.Processing.HighPass, sampleRate, cfg.Input.Channels)
+	},
+	"lowpass": func() audio.Processor {
+		return audio.NewLowPass(cfg.Processing.LowPass, sampleRate, cfg.Input.Channels)
+	},
+	"gate": func() audio.Processor {
+		return audio.NewNoiseGate(cfg.Gate.Threshold, cfg.Gate.Attack, cfg.Gate.Release, samplesPerSecond())
+	},
+	"agc": func() audio.Processor {
+		return audio.NewAutoGain(cfg.AGC.Target, cfg.AGC.MaxGain, cfg.AGC.Attack, cfg.AGC.Release, samplesPerSecond(), silenceThreshold())
+	},
+	"limiter": func() audio.Processor {
+		return audio.NewLimiter(cfg.Limiter.Ceiling, cfg.Limiter.Lookahead, cfg.Limiter.Release, samplesPerSecond())
+	},
+	"normalize": func() audio.Processor {
+		return audio.NewNormalize(cfg.Processing.NormalizePeak, cfg.Processing.NormalizeMaxGain)
+	},
+}
+
+// newStage makes the named stage of a processing chain
+func newStage(name string) (audio.Processor, error) {
+	newStage, ok := processors[name]
+	if !ok {
+		return nil, fmt.Errorf("processing.chain stage %q must be one of highpass, lowpass, gate, agc, limiter or normalize", name)
+	}
+	return newStage(), nil
+}
+
+// processingChain names the stages to run in order. Without a configured
+// chain the gate, gain control and limiter run in that order when enabled.
+func processingChain() []string {
+	if len(cfg.Processing.Chain) > 0 {
+		return cfg.Processing.Chain
+	}
+	var chain []string
+	if cfg.Gate.Enabled {
+		chain = append(chain, "gate")
+	}
+	if cfg.AGC.Enabled {
+		chain = append(chain, "agc")
+	}
+	if cfg.Limiter.Enabled {
+		chain = append(chain, "limiter")
+	}
+	return chain
+}
+
+// splitList reads a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseBalance reads a gain for each input channel in order, separated by
+// commas and each given as ParseGain takes it, such as 0dB,-3dB
+func parseBalance(s string) ([]float64, error) {
+	var gains []float64
+	for _, item := range splitList(s) {
+		gain, err := audio.ParseGain(item)
+		if err != nil {
+			return nil, err
+		}
+		gains = append(gains, gain)
+	}
+	if len(gains) != cfg.Input.Channels {
+		return nil, fmt.Errorf("%q gives %d gains for %d channels", s, len(gains), cfg.Input.Channels)
+	}
+	return gains, nil
+}
+
+// newProcessing sets up the stages of the chain that run on each buffer as
+// it is recorded
+func newProcessing() (*audio.Processing, error) {
+	p := &audio.Processing{Gain: 1}
+	if cfg.Input.Gain != "" {
+		p.Gain, _ = audio.ParseGain(cfg.Input.Gain)
+	}
+	if cfg.Input.Balance != "" {
+		p.Balance, _ = parseBalance(cfg.Input.Balance)
+	}
+	for _, name := range processingChain() {
+		stage, err := newStage(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := stage.(audio.FileProcessor); !ok {
+			p.Stages = append(p.Stages, stage)
+		}
+	}
+	return p, nil
+}
+
+// fileStages sets up the stages of the chain that need a whole recording,
+// fresh for each recording
+func fileStages() ([]audio.FileProcessor, error) {
+	var stages []audio.FileProcessor
+	for _, name := range processingChain() {
+		stage, err := newStage(name)
+		if err != nil {
+			return nil, err
+		}
+		if stage, ok := stage.(audio.FileProcessor); ok {
+			stages = append(stages, stage)
+		}
+	}
+	return stages, nil
+}
+
+// processRecording runs the whole-file stages of the chain over a finished
+// recording in order, each reading it once to measure it and again to
+// rewrite it
+func processRecording(fileName string) error {
+	stages, err := fileStages()
+	if err != nil {
+		return err
+	}
+	for _, stage := range stages {
+		name := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".processing" + recordingExt()
+		if err := processInto(fileName, name, stage); err != nil {
+			return err
+		}
+		if err := os.Rename(name, fileName); err != nil {
+			os.Remove(name)
+			return err
+		}
+	}
+	return nil
+}
+
+// processInto measures a recording with a whole-file stage and writes what
+// the stage makes of it to the recording name, removed again on failure
+func processInto(fileName, name string, stage audio.FileProcessor) error {
+	if err := eachBuffer(fileName, func(in []int32) error {
+		stage.Measure(in)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	r, err := recorder.Create(fileOpener(), name, recordingFormat())
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+	n := 0
+	err = eachBuffer(fileName, func(in []int32) error {
+		out := stage.Process(in)
+		n += len(out)
+		return r.WriteSamples(out)
+	})
+	if closeErr := r.Close(n); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// normalizedCopy writes a copy of a recording beside it normalized to the
+// peak configured for the encode format, returning its name, or the
+// recording's own name when the format has no peak of its own
+func normalizedCopy(fileName string) (string, error) {
+	peak, ok := cfg.Processing.FormatPeaks[cfg.Encode.Format]
+	if !ok {
+		return fileName, nil
+	}
+	name := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".normalized" + recordingExt()
+	if err := processInto(fileName, name, audio.NewNormalize(peak, cfg.Processing.NormalizeMaxGain)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// eachBuffer passes every sample of a recording to fn a buffer at a time,
+// the last buffer holding only what is left
+func eachBuffer(fileName string, fn func(in []int32) error) error {
+	in := make([]int32, 64*cfg.Input.Channels)
+	src, err := openInputFile(fileName, in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	left := src.frames() * cfg.Input.Channels
+	for left > 0 {
+		if err := src.Read(); err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		buf := in
+		if left < len(buf) {
+			buf = buf[:left]
+		}
+		if err := fn(buf); err != nil {
+			return err
+		}
+		left -= len(buf)
+	}
+	return nil
+}
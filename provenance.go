@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// version is the release built, set with -ldflags "-X main.version=1.2.0"
+var version string
+
+// appVersion is the version set when building, else the module version Go
+// recorded, else dev for a build from a working copy
+func appVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// inputName names what is being recorded from, the device each stream is
+// opened on or the input file
+var inputName atomic.Value
+
+func setInputName(name string) {
+	inputName.Store(name)
+}
+
+// provenance is where and when a recording was made
+type provenance struct {
+	input string
+	at    time.Time
+}
+
+// provenances holds the provenance of each recording from when it started,
+// as the device may change before it is encoded
+var provenances sync.Map
+
+// noteProvenance remembers the input and time a recording starts at
+func noteProvenance(fileName string) {
+	if !cfg.Tags.Provenance {
+		return
+	}
+	name, _ := inputName.Load().(string)
+	provenances.Store(fileName, provenance{input: name, at: time.Now()})
+}
+
+// provenanceFor is the comment tagging a recording with the input, machine
+// and version it was recorded with and when, or empty when not tagging
+func provenanceFor(fileName string) string {
+	v, ok := provenances.Load(fileName)
+	if !ok {
+		return ""
+	}
+	p := v.(provenance)
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown host"
+	}
+	return fmt.Sprintf("Recorded from %s on %s with Go-Record-Audio %s at %s", p.input, host, appVersion(), p.at.Format(time.RFC3339))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// publishTimeout bounds connecting to the broker and each exchange with it
+const publishTimeout = 30 * time.Second
+
+// publisher sends a message to a message queue broker. Publish reports
+// whether a failure is worth retrying.
+type publisher interface {
+	Publish(subject string, message []byte) (bool, error)
+}
+
+// publishers are the brokers encoded files can be published to, each made
+// from the broker address
+var publishers = map[string]func(address string) publisher{
+	"nats":  func(address string) publisher { return natsPublisher{address} },
+	"redis": func(address string) publisher { return redisPublisher{address} },
+}
+
+// publishedFile is the message sent for an encoded file. Data is sent as
+// base64 unless only a reference to the file is published.
+type publishedFile struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+	Size   int64  `json:"size"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// publishFile sends an encoded file, or a reference to it, to the
+// configured broker, retrying transient failures with a growing delay
+func publishFile(fileName, recording string) error {
+	msg, err := publishMessage(fileName, recording)
+	if err != nil {
+		atomic.AddInt32(&publishes.failed, 1)
+		log.Println("[Publish] ", fileName, err)
+		return err
+	}
+
+	p := publishers[cfg.Upload.Queue.Broker](cfg.Upload.Queue.Address)
+	return retryUpload("[Publish]", fileName, cfg.Upload.Queue.Retries, &publishes, func() (bool, error) {
+		return p.Publish(cfg.Upload.Queue.Subject, msg)
+	})
+}
+
+// publishMessage builds the JSON message describing an encoded file
+func publishMessage(fileName, recording string) ([]byte, error) {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	artist, title := tagsFor(recording)
+	msg := publishedFile{Name: filepath.Base(fileName), Path: path, Artist: artist, Title: title, Size: info.Size()}
+	if !cfg.Upload.Queue.Reference {
+		if msg.Data, err = ioutil.ReadFile(fileName); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(msg)
+}
+
+// brokerConn dials a broker address given as host:port, optionally after a
+// scheme such as nats:// or redis://
+func brokerConn(address string) (net.Conn, error) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		address = address[i+3:]
+	}
+	conn, err := net.DialTimeout("tcp", strings.TrimSuffix(address, "/"), publishTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(publishTimeout))
+	return conn, nil
+}
+
+// natsPublisher publishes to a subject on a NATS server using its text
+// protocol, waiting for the server to acknowledge a PING so a rejected
+// message is noticed
+type natsPublisher struct {
+	address string
+}
+
+func (p natsPublisher) Publish(subject string, message []byte) (bool, error) {
+	conn, err := brokerConn(p.address)
+	if err != nil {
+		return true, err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return true, err
+	}
+	var info struct {
+		MaxPayload int64 `json:"max_payload"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		return false, fmt.Errorf("unexpected greeting %q from NATS server", strings.TrimSpace(line))
+	}
+	if info.MaxPayload > 0 && int64(len(message)) > info.MaxPayload {
+		return false, fmt.Errorf("message of %d bytes is over the NATS server's limit of %d, publish a reference instead", len(message), info.MaxPayload)
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false}
+	if cfg.Upload.Queue.Token != "" {
+		options["auth_token"] = cfg.Upload.Queue.Token
+	}
+	connect, _ := json.Marshal(options)
+	fmt.Fprintf(conn, "CONNECT %s\r\nPUB %s %d\r\n", connect, subject, len(message))
+	conn.Write(message)
+	if _, err := conn.Write([]byte("\r\nPING\r\n")); err != nil {
+		return true, err
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return true, err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return false, nil
+		case strings.HasPrefix(line, "-ERR"):
+			return false, errors.New("NATS server: " + strings.TrimSpace(line[4:]))
+		}
+	}
+}
+
+// redisPublisher pushes onto a Redis list named by the subject, which a
+// consumer pops as a queue, so messages wait while nothing is listening
+type redisPublisher struct {
+	address string
+}
+
+func (p redisPublisher) Publish(subject string, message []byte) (bool, error) {
+	conn, err := brokerConn(p.address)
+	if err != nil {
+		return true, err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if cfg.Upload.Queue.Token != "" {
+		if retry, err := redisCommand(conn, r, []byte("AUTH"), []byte(cfg.Upload.Queue.Token)); err != nil {
+			return retry, err
+		}
+	}
+	return redisCommand(conn, r, []byte("RPUSH"), []byte(subject), message)
+}
+
+// redisCommand sends a command as a RESP array of bulk strings and reads
+// the reply, returning any error the server gave
+func redisCommand(conn net.Conn, r *bufio.Reader, args ...[]byte) (bool, error) {
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(arg))
+		w.Write(arg)
+		w.WriteString("\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return true, err
+	}
+
+	reply, err := r.ReadString('\n')
+	if err != nil {
+		return true, err
+	}
+	if strings.HasPrefix(reply, "-") {
+		return false, errors.New("Redis: " + strings.TrimSpace(reply[1:]))
+	}
+	return false, nil
+}
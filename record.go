@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1hitsong/Go-Record-Audio/audio"
+	"github.com/1hitsong/Go-Record-Audio/recorder"
+	"github.com/gordonklaus/portaudio"
+)
+
+// readMarkers sends each line written to the FIFO at path as a marker,
+// reopening it whenever the writer closes it. A line that cannot name a
+// file in the output directory still splits, numbering the segment.
+func readMarkers(path string, markers chan<- string) {
+	for {
+		// opening a FIFO blocks until something opens it for writing
+		f, err := os.Open(path)
+		if err != nil {
+			log.Println("[Markers] ", err)
+			return
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			name := strings.TrimSpace(scanner.Text())
+			if !markerName(name) {
+				log.Printf("[Markers] %q cannot name a recording, numbering the segment instead", name)
+				name = ""
+			}
+			markers <- name
+		}
+		f.Close()
+	}
+}
+
+// markerName reports whether a marker can name a segment, which it cannot
+// when it holds a path separator or .. and so could leave the output
+// directory
+func markerName(name string) bool {
+	return !strings.ContainsAny(name, `/\`) && !strings.Contains(name, "..")
+}
+
+// diskFull reports whether the disk holding dir has less free space than
+// the configured minimum. A disk that cannot be measured is never full.
+func diskFull(dir string) bool {
+	free, err := freeSpace(dir)
+	if err != nil {
+		log.Println("[Disk] ", err)
+		return false
+	}
+	if free < uint64(cfg.Output.MinFreeSpace)<<20 {
+		log.Printf("[Disk] only %d MB free in %s, stopping the recording", free>>20, dir)
+		return true
+	}
+	return false
+}
+
+// endlessStop decides when endless mode gives up. Splitting on silence
+// starts a new segment that is waiting for sound. While it waits it is not
+// split again, and once its silence has lasted stopafter seconds past the
+// start delay the recording stops, unless repeatedsilence is continue.
+// Hearing sound ends the wait. It also counts segments in a row split off
+// with little sound in them, so a quiet room cannot produce them forever.
+type endlessStop struct {
+	waiting bool
+	quiet   int
+	sound   int // samples of sound in the current segment
+	short   int // short segments in a row
+}
+
+// split starts waiting for sound in a new segment
+func (s *endlessStop) split() {
+	s.waiting = true
+	s.quiet = 0
+}
+
+// heard records whether a buffer of n samples was silent
+func (s *endlessStop) heard(silent bool, n int) {
+	if !silent {
+		s.waiting = false
+		s.quiet = 0
+		s.sound += n
+	} else if s.waiting {
+		s.quiet += n
+	}
+}
+
+// ended notes that a segment was split off on silence, reporting whether it
+// makes maxsilencefiles segments in a row with less than shortsegment of
+// sound
+func (s *endlessStop) ended() bool {
+	if s.sound < samplesIn(cfg.SilenceDetection.ShortSegment) {
+		s.short++
+	} else {
+		s.short = 0
+	}
+	s.sound = 0
+	return cfg.SilenceDetection.MaxSilenceFiles > 0 && s.short >= cfg.SilenceDetection.MaxSilenceFiles
+}
+
+func (s *endlessStop) shouldStop() bool {
+	return s.waiting && cfg.SilenceDetection.RepeatedSilence != "continue" &&
+		s.quiet >= (cfg.SilenceDetection.Delayatstartofcapture+cfg.SilenceDetection.StopAfter)*samplesPerSecond()
+}
+
+// cueMark is a track of a cue sheet, starting at a sample offset and titled
+// when title is set
+type cueMark struct {
+	offset int
+	title  string
+}
+
+// intervalMarks are the marks every marker interval of a recording of end
+// samples, titled in sequence
+func intervalMarks(end int) []cueMark {
+	var marks []cueMark
+	every := samplesIn(cfg.SilenceDetection.MarkerInterval)
+	for n, offset := 1, every; every > 0 && offset < end; n, offset = n+1, offset+every {
+		marks = append(marks, cueMark{offset, fmt.Sprintf("Marker %d", n)})
+	}
+	return marks
+}
+
+// writeCue saves a cue sheet next to fileName with a track starting at the
+// beginning and at each of marks in order
+func writeCue(fileName string, marks []cueMark) error {
+	sort.SliceStable(marks, func(i, j int) bool { return marks[i].offset < marks[j].offset })
+	var cue bytes.Buffer
+	fmt.Fprintf(&cue, "FILE \"%s\" %s\n", filepath.Base(fileName), strings.ToUpper(strings.TrimPrefix(filepath.Ext(fileName), ".")))
+	for i, mark := range append([]cueMark{{}}, marks...) {
+		// cue times are minutes, seconds and frames of 1/75th of a second
+		frames := mark.offset * 75 / samplesPerSecond()
+		fmt.Fprintf(&cue, "  TRACK %02d AUDIO\n", i+1)
+		if mark.title != "" {
+			fmt.Fprintf(&cue, "    TITLE \"%s\"\n", mark.title)
+		}
+		fmt.Fprintf(&cue, "    INDEX 01 %02d:%02d:%02d\n", frames/75/60, frames/75%60, frames%75)
+	}
+	return writeFile(strings.TrimSuffix(fileName, filepath.Ext(fileName))+".cue", cue.Bytes())
+}
+
+// countdown shows how much of a recording limited to max is left on the
+// status line, redrawing it as each second passes
+type countdown struct {
+	max   time.Duration
+	shown time.Duration
+}
+
+// update shows the time left after elapsed, reporting whether none is left
+func (c *countdown) update(elapsed time.Duration) bool {
+	left := c.max - elapsed
+	if left <= 0 {
+		clearStatus()
+		return true
+	}
+	// round up so the last second shows 1s rather than 0s
+	if whole := (left + time.Second - 1).Truncate(time.Second); whole != c.shown {
+		c.shown = whole
+		status(fmt.Sprintf("Remaining %v", whole))
+	}
+	return false
+}
+
+// recordRetro keeps the most recent audio in a ring buffer and only writes
+// it to a new recording when s is pressed
+func recordRetro(input *streamReader, dsp *audio.Processing, ch chan string, sig chan os.Signal, base string) {
+	ring := newSampleRing(cfg.Retro.Seconds * samplesPerSecond())
+	nRecordedFiles := numRecordedFiles()
+
+	for {
+		select {
+		case stdin, ok := <-ch:
+			if !ok {
+				ch = nil
+			} else if isKey(stdin, cfg.Keys.Stop) {
+				input.close()
+				portaudio.Terminate()
+				return
+			} else if isKey(stdin, cfg.Keys.Save) {
+				fileName := ""
+				fileName, nRecordedFiles = nextRecordingName(base, nRecordedFiles)
+
+				samples := ring.samples()
+				f := startNewRecording(fileName)
+				writeSamples(f, samples)
+				CloseRecording(f, len(samples))
+
+				encodeRecording(fileName)
+			}
+
+		case buf, ok := <-input.buffers:
+			in := buf.samples
+			if !ok && input.err == io.EOF {
+				return
+			} else if !ok {
+				chk(input.err)
+			}
+			buf.process(dsp)
+			live.send(in)
+			ring.write(in)
+
+		case <-sig:
+			return
+		}
+	}
+}
+
+// waitForSound reads the input until it hears sound, returning the audio
+// that opens the first recording: the sound and the pre-roll before it,
+// so its start is not clipped. It
+// reports false when recording stops or the input ends first, in which
+// case nothing is recorded.
+func waitForSound(input *streamReader, dsp *audio.Processing, ch chan string, sig chan os.Signal) ([]int32, bool) {
+	silence := newSilenceDetector()
+	preroll := newSampleRing(samplesIn(cfg.Utterances.PreRoll))
+	for {
+		select {
+		case stdin, ok := <-ch:
+			if !ok {
+				ch = nil
+			} else if isKey(stdin, cfg.Keys.Stop) {
+				input.close()
+				portaudio.Terminate()
+				return nil, false
+			}
+
+		case buf, ok := <-input.buffers:
+			in := buf.samples
+			if !ok && input.err == io.EOF {
+				return nil, false
+			} else if !ok {
+				chk(input.err)
+			}
+			captured := in
+			if !cfg.Input.GainSilence {
+				captured = append([]int32(nil), in...)
+			}
+			buf.process(dsp)
+			live.send(in)
+			preroll.write(in)
+			if !silence.IsSilent(captured) {
+				return preroll.samples(), true
+			}
+
+		case <-sig:
+			input.close()
+			portaudio.Terminate()
+			return nil, false
+		}
+	}
+}
+
+// recordUtterances saves each stretch of sound bounded by silence to its own
+// file, with a pre-roll of the audio before the sound and a post-roll of the
+// audio after it. The pre-roll comes from a ring of recent silence; the file
+// ends once the silence after the sound lasts the configured gap, or the
+// post-roll if that is longer, and is trimmed back to the post-roll.
+func recordUtterances(input *streamReader, dsp *audio.Processing, ch chan string, sig chan os.Signal, base string) {
+	perDuration := func(d time.Duration) int {
+		return int(d.Seconds()*sampleRate) * cfg.Input.Channels
+	}
+	preRoll := perDuration(cfg.Utterances.PreRoll)
+	postRoll := perDuration(cfg.Utterances.PostRoll)
+	gap := perDuration(cfg.Utterances.Gap)
+	if gap < postRoll {
+		gap = postRoll
+	}
+	minLength := perDuration(cfg.Utterances.MinLength)
+
+	silence := newSilenceDetector()
+	preroll := newSampleRing(preRoll)
+	nRecordedFiles := numRecordedFiles()
+
+	// while an utterance is open, soundStart and soundEnd bound its sound
+	// within the file and quiet counts the silence since soundEnd
+	var f recording
+	fileName := ""
+	nSamples, soundStart, soundEnd, quiet := 0, 0, 0, 0
+
+	finish := func() {
+		if f == nil {
+			return
+		}
+		if soundEnd-soundStart < minLength {
+			CloseRecording(f, nSamples)
+			if err := discardRecording(fileName); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			if soundEnd+postRoll < nSamples {
+				nSamples = soundEnd + postRoll
+			}
+			CloseRecording(f, nSamples)
+			encodeRecording(fileName)
+		}
+		f = nil
+	}
+
+	for {
+		select {
+		case stdin, ok := <-ch:
+			if !ok {
+				ch = nil
+			} else if isKey(stdin, cfg.Keys.Stop) {
+				input.close()
+				portaudio.Terminate()
+				finish()
+				return
+			}
+
+		case buf, ok := <-input.buffers:
+			in := buf.samples
+			if !ok && input.err == io.EOF {
+				finish()
+				return
+			} else if !ok {
+				chk(input.err)
+			}
+			buf.process(dsp)
+			live.send(in)
+			silent := silence.IsSilent(in)
+
+			if f == nil && !silent {
+				if cfg.Utterances.Naming == "timestamp" {
+					fileName = filepath.Join(recordingDir(), base+" "+time.Now().Format("2006-01-02 15.04.05.000")+recordingExt())
+				} else {
+					fileName, nRecordedFiles = nextRecordingName(base, nRecordedFiles)
+					nRecordedFiles++
+				}
+				f = startNewRecording(fileName)
+
+				before := preroll.samples()
+				writeSamples(f, before)
+				nSamples, soundStart = len(before), len(before)
+				preroll = newSampleRing(preRoll)
+			}
+
+			if f == nil {
+				preroll.write(in)
+			} else {
+				writeSamples(f, in)
+				nSamples += len(in)
+				if silent {
+					quiet += len(in)
+				} else {
+					soundEnd, quiet = nSamples, 0
+				}
+				if quiet >= gap {
+					finish()
+				}
+			}
+
+		case <-sig:
+			finish()
+			return
+		}
+	}
+}
+
+// retroMemory is the most memory in bytes retro mode holds: the ring of
+// 32 bit samples, and as much again for the copy made to save it
+func retroMemory() int64 {
+	return 2 * int64(cfg.Retro.Seconds) * int64(samplesPerSecond()) * 4
+}
+
+// sampleRing is a fixed size circular buffer holding the latest samples
+type sampleRing struct {
+	buf  []int32
+	pos  int
+	full bool
+}
+
+func newSampleRing(size int) *sampleRing {
+	return &sampleRing{buf: make([]int32, size)}
+}
+
+func (r *sampleRing) write(in []int32) {
+	if len(r.buf) == 0 {
+		return
+	}
+	for _, n := range in {
+		r.buf[r.pos] = n
+		r.pos++
+		if r.pos == len(r.buf) {
+			r.pos = 0
+			r.full = true
+		}
+	}
+}
+
+// samples returns a copy of the buffered samples, oldest first
+func (r *sampleRing) samples() []int32 {
+	if !r.full {
+		return append([]int32(nil), r.buf[:r.pos]...)
+	}
+	return append(append([]int32(nil), r.buf[r.pos:]...), r.buf[:r.pos]...)
+}
+
+// mirrorWriter copies everything written to a recording into a second file
+// under the mirror directory. A failing mirror is logged and dropped so the
+// primary recording carries on.
+type mirrorWriter struct {
+	recorder.Writer
+	mirror *os.File
+}
+
+// newMirrorWriter opens the mirror of fileName at the same path relative to
+// the mirror directory as fileName has to the output directory
+func newMirrorWriter(primary recorder.Writer, fileName string) *mirrorWriter {
+	m := &mirrorWriter{Writer: primary}
+
+	rel, err := filepath.Rel(cfg.Output.Dir, fileName)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(fileName)
+	}
+	name := filepath.Join(cfg.Output.MirrorDir, rel)
+	if err = os.MkdirAll(filepath.Dir(name), 0777); err == nil {
+		m.mirror, err = createFile(name)
+	}
+	if err != nil {
+		log.Println("[Mirror] ", err)
+	}
+	return m
+}
+
+func (m *mirrorWriter) fail(err error) {
+	log.Println("[Mirror] ", err, "- continuing without the mirror")
+	m.mirror.Close()
+	m.mirror = nil
+}
+
+func (m *mirrorWriter) Write(p []byte) (int, error) {
+	n, err := m.Writer.Write(p)
+	if m.mirror != nil {
+		if _, merr := m.mirror.Write(p); merr != nil {
+			m.fail(merr)
+		}
+	}
+	return n, err
+}
+
+func (m *mirrorWriter) Seek(offset int64, whence int) (int64, error) {
+	pos, err := m.Writer.Seek(offset, whence)
+	if m.mirror != nil && err == nil {
+		if _, merr := m.mirror.Seek(pos, io.SeekStart); merr != nil {
+			m.fail(merr)
+		}
+	}
+	return pos, err
+}
+
+func (m *mirrorWriter) Truncate(size int64) error {
+	var err error
+	if t, ok := m.Writer.(interface{ Truncate(int64) error }); ok {
+		err = t.Truncate(size)
+	}
+	if m.mirror != nil {
+		if merr := m.mirror.Truncate(size); merr != nil {
+			m.fail(merr)
+		}
+	}
+	return err
+}
+
+// Sync flushes the primary recording to disk, and the mirror too while it
+// lasts, a failing mirror being dropped as on a failed write
+func (m *mirrorWriter) Sync() error {
+	var err error
+	if s, ok := m.Writer.(interface{ Sync() error }); ok {
+		err = s.Sync()
+	}
+	if m.mirror != nil {
+		if merr := m.mirror.Sync(); merr != nil {
+			m.fail(merr)
+		}
+	}
+	return err
+}
+
+func (m *mirrorWriter) Close() error {
+	if m.mirror != nil {
+		if err := m.mirror.Close(); err != nil {
+			log.Println("[Mirror] ", err)
+		}
+	}
+	return m.Writer.Close()
+}
+
+// syncWriter flushes a recording to disk at least every fsync interval as
+// it is written, and once more as it is closed, so a crash or power cut
+// loses at most the last interval instead of whatever the system had yet
+// to write. Destinations that cannot sync are written as usual.
+type syncWriter struct {
+	recorder.Writer
+	synced time.Time
+}
+
+func newSyncWriter(w recorder.Writer) *syncWriter {
+	return &syncWriter{Writer: w, synced: time.Now()}
+}
+
+// sync flushes the destination when it can be
+func (s *syncWriter) sync() error {
+	s.synced = time.Now()
+	if f, ok := s.Writer.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	n, err := s.Writer.Write(p)
+	if err == nil && time.Since(s.synced) >= cfg.Output.FsyncInterval {
+		err = s.sync()
+	}
+	return n, err
+}
+
+func (s *syncWriter) Truncate(size int64) error {
+	if t, ok := s.Writer.(interface{ Truncate(int64) error }); ok {
+		return t.Truncate(size)
+	}
+	return nil
+}
+
+func (s *syncWriter) Close() error {
+	if err := s.sync(); err != nil {
+		s.Writer.Close()
+		return err
+	}
+	return s.Writer.Close()
+}
+
+// recording is where a recording's samples are written, one file or with
+// split channels one file per channel
+type recording interface {
+	WriteSamples(samples []int32) error
+	Close(nSamples int) error
+}
+
+// channelRecording writes each channel of the input to its own mono file,
+// the de-interleaved counterpart of a multitrack recording
+type channelRecording struct {
+	files []*recorder.Recording
+	buf   []int32
+}
+
+func (c *channelRecording) WriteSamples(samples []int32) error {
+	channels := len(c.files)
+	if cap(c.buf) < len(samples)/channels {
+		c.buf = make([]int32, len(samples)/channels)
+	}
+	buf := c.buf[:len(samples)/channels]
+	for channel, f := range c.files {
+		for i := range buf {
+			buf[i] = samples[i*channels+channel]
+		}
+		if err := f.WriteSamples(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finishes every file, nSamples counting the samples of all channels
+// as for an interleaved recording
+func (c *channelRecording) Close(nSamples int) error {
+	var first error
+	for _, f := range c.files {
+		if err := f.Close(nSamples / len(c.files)); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// recordingFiles are the files a recording is written to, each channel's
+// named with its number as in "name.ch1.aiff" when channels are split
+func recordingFiles(fileName string) []string {
+	if !cfg.Output.SplitChannels {
+		return []string{fileName}
+	}
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	var names []string
+	for c := 1; c <= cfg.Input.Channels; c++ {
+		names = append(names, fmt.Sprintf("%s.ch%d%s", base, c, recordingExt()))
+	}
+	return names
+}
+
+// discardRecording deletes a finished recording that is not to be encoded
+func discardRecording(fileName string) error {
+	for _, name := range recordingFiles(fileName) {
+		if err := removeRecording(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shareRecordingState gives the recording to the segment start, location and
+// take noted for from, as when it is renamed or split into channels
+func shareRecordingState(from, to string) {
+	for _, m := range []*sync.Map{&segmentStarts, &locations, &takes, &provenances} {
+		if v, ok := m.Load(from); ok {
+			m.Store(to, v)
+		}
+	}
+}
+
+func startNewRecording(fileName string) recording {
+	events.send(cfg.OSC.Start, fileName)
+	noteSegmentStart(fileName)
+	locateRecording(fileName)
+	noteProvenance(fileName)
+	if !cfg.Output.SplitChannels {
+		return createRecording(fileName)
+	}
+
+	c := &channelRecording{}
+	for _, name := range recordingFiles(fileName) {
+		shareRecordingState(fileName, name)
+		c.files = append(c.files, createRecording(name))
+	}
+	return c
+}
+
+// createRecording opens a recording file and writes its header
+func createRecording(fileName string) *recorder.Recording {
+	f, err := fileOpener()(fileName)
+	chk(err)
+	if cfg.Output.MirrorDir != "" {
+		f = newMirrorWriter(f, fileName)
+	}
+	if cfg.Output.FsyncInterval > 0 {
+		f = newSyncWriter(f)
+	}
+
+	r, err := recorder.New(f, recordingFormat())
+	chk(err)
+	return r
+}
+
+// recordingFormat is how the configuration says samples are stored
+func recordingFormat() recorder.Format {
+	channels := cfg.Input.Channels
+	if cfg.Output.SplitChannels {
+		channels = 1
+	}
+	return recorder.Format{
+		Container:  cfg.Output.Format,
+		Channels:   channels,
+		SampleRate: sampleRate,
+		BitDepth:   cfg.Output.BitDepth,
+		Dither:     cfg.Output.Dither,
+		Annotation: cfg.Output.Annotation,
+	}
+}
+
+// writeSamples adds samples to a recording
+func writeSamples(f recording, samples []int32) {
+	chk(f.WriteSamples(samples))
+}
+
+// CloseRecording is run when file is closed
+func CloseRecording(f recording, nSamples int) {
+	chk(f.Close(nSamples))
+}
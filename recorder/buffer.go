@@ -0,0 +1,57 @@
+package recorder
+
+import (
+	"errors"
+	"io"
+)
+
+// Buffer is a Writer held in memory, for a recording that never touches the
+// filesystem. Its zero value is empty and ready to use.
+type Buffer struct {
+	data []byte
+	pos  int64
+}
+
+// Write writes p at the current position, growing the buffer as needed
+func (b *Buffer) Write(p []byte) (int, error) {
+	if end := b.pos + int64(len(p)); end > int64(len(b.data)) {
+		b.data = append(b.data, make([]byte, end-int64(len(b.data)))...)
+	}
+	n := copy(b.data[b.pos:], p)
+	b.pos += int64(n)
+	return n, nil
+}
+
+// Seek moves the position as io.Seeker describes. Seeking past the end is
+// allowed, and a later write fills the gap with zeros.
+func (b *Buffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += int64(len(b.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("recorder: seek before the start of the buffer")
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+// Truncate drops everything from size on
+func (b *Buffer) Truncate(size int64) error {
+	if size < int64(len(b.data)) {
+		b.data = b.data[:size]
+	}
+	return nil
+}
+
+// Close does nothing, leaving the bytes to be read
+func (b *Buffer) Close() error {
+	return nil
+}
+
+// Bytes returns what has been written
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
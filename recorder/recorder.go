@@ -0,0 +1,366 @@
+// Package recorder writes interleaved int32 samples to AIFF, AIFF-C and WAV
+// files, filling in the header sizes once the length is known.
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+
+	"github.com/1hitsong/Go-Record-Audio/audio"
+)
+
+// Writer is the destination of a recording's header and samples. Close
+// seeks back to fill in the header sizes once the length is known, so
+// destinations must be seekable. If the writer also has a Truncate(int64)
+// error method it is used to drop trimmed samples.
+type Writer interface {
+	io.WriteSeeker
+	io.Closer
+}
+
+// Format is how a recording stores its samples
+type Format struct {
+	Container  string // aiff, aifc or wav
+	Channels   int
+	SampleRate int
+	BitDepth   int    // 8, 16, 24 or 32
+	Dither     string // none, rectangular or tpdf noise when storing fewer than 32 bits
+	Annotation string // saved in an annotation chunk when not empty
+}
+
+// Recording is an open recording along with where the header fields that
+// depend on its length were written, so they can be filled in on close
+type Recording struct {
+	Writer
+	format     Format
+	order      binary.ByteOrder
+	formSize   int64 // FORM or RIFF size
+	frameCount int64 // AIFF COMM sample frames, -1 for WAV
+	dataSize   int64 // SSND or data chunk size
+	dataStart  int64 // first byte of sample data
+}
+
+// headerWriter writes header fields, remembering the first error so the
+// fields can be written one after another and checked once
+type headerWriter struct {
+	r     *Recording
+	order binary.ByteOrder
+	err   error
+}
+
+func (h *headerWriter) put(v interface{}) {
+	if h.err != nil {
+		return
+	}
+	switch v := v.(type) {
+	case string:
+		_, h.err = io.WriteString(h.r, v)
+	case []byte:
+		_, h.err = h.r.Write(v)
+	default:
+		h.err = binary.Write(h.r, h.order, v)
+	}
+}
+
+// mark returns the current write position
+func (h *headerWriter) mark() int64 {
+	if h.err != nil {
+		return 0
+	}
+	var pos int64
+	pos, h.err = h.r.Seek(0, io.SeekCurrent)
+	return pos
+}
+
+// New writes the header of an empty recording to w
+func New(w Writer, format Format) (*Recording, error) {
+	if format.SampleRate <= 0 {
+		return nil, errors.New("recorder: sample rate must be positive")
+	}
+	r := &Recording{Writer: w, format: format, order: binary.BigEndian, frameCount: -1}
+	if format.Container == "wav" {
+		return r, r.writeWAVHeader()
+	}
+
+	h := &headerWriter{r: r, order: binary.BigEndian}
+
+	// form chunk
+	h.put("FORM")
+	r.formSize = h.mark()
+	h.put(int32(0)) //total bytes
+	aifc := format.Container == "aifc"
+	if aifc {
+		h.put("AIFC")
+
+		// format version chunk, the only version defined
+		h.put("FVER")
+		h.put(int32(4))           //size
+		h.put(uint32(0xA2805140)) //AIFC version 1
+	} else {
+		h.put("AIFF")
+	}
+
+	// common chunk, which AIFF-C extends with a compression type and name
+	compressionName := "\x0enot compressed\x00"
+	h.put("COMM")
+	if aifc {
+		h.put(int32(18 + 4 + len(compressionName))) //size
+	} else {
+		h.put(int32(18)) //size
+	}
+	h.put(int16(format.Channels)) //channels
+	r.frameCount = h.mark()
+	h.put(int32(0))                    //number of samples
+	h.put(int16(format.BitDepth))      //bits per sample
+	h.put(extended(format.SampleRate)) //80-bit sample rate
+	if aifc {
+		h.put("NONE" + compressionName) //compression type and padded pascal string name
+	}
+
+	// sound chunk
+	h.put("SSND")
+	r.dataSize = h.mark()
+	h.put(int32(0)) //size
+	h.put(int32(0)) //offset
+	h.put(int32(0)) //block
+	r.dataStart = h.mark()
+
+	return r, h.err
+}
+
+// PCMSubFormat is the GUID of KSDATAFORMAT_SUBTYPE_PCM as stored in the
+// fmt chunk of a WAVE_FORMAT_EXTENSIBLE file
+var PCMSubFormat = [16]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71}
+
+// Extensible reports whether a WAV recording needs a WAVE_FORMAT_EXTENSIBLE
+// header, as one with more than two channels or 16 bits must have
+func (f Format) Extensible() bool {
+	return f.Channels > 2 || f.BitDepth > 16
+}
+
+// channelMask assigns the channels of an extensible WAV recording to
+// speakers in the standard order, front left and right first, or a mono
+// recording to front centre. Past the 18 speakers defined they are left
+// unassigned.
+func channelMask(channels int) uint32 {
+	switch {
+	case channels == 1:
+		return 0x4
+	case channels > 18:
+		return 0
+	}
+	return 1<<uint(channels) - 1
+}
+
+func (r *Recording) writeWAVHeader() error {
+	bytesPerFrame := r.format.BitDepth / 8 * r.format.Channels
+	r.order = binary.LittleEndian
+	h := &headerWriter{r: r, order: binary.LittleEndian}
+	extensible := r.format.Extensible()
+
+	// riff chunk
+	h.put("RIFF")
+	r.formSize = h.mark()
+	h.put(int32(0)) //total bytes
+	h.put("WAVE")
+
+	// format chunk
+	h.put("fmt ")
+	if extensible {
+		h.put(int32(40))      //size
+		h.put(uint16(0xFFFE)) //WAVE_FORMAT_EXTENSIBLE
+	} else {
+		h.put(int32(16)) //size
+		h.put(int16(1))  //PCM
+	}
+	h.put(int16(r.format.Channels))                   //channels
+	h.put(int32(r.format.SampleRate))                 //sample rate
+	h.put(int32(r.format.SampleRate * bytesPerFrame)) //bytes per second
+	h.put(int16(bytesPerFrame))                       //block align
+	h.put(int16(r.format.BitDepth))                   //bits per sample
+	if extensible {
+		h.put(int16(22))                      //size of the extension
+		h.put(int16(r.format.BitDepth))       //valid bits per sample
+		h.put(channelMask(r.format.Channels)) //speaker positions
+		h.put(PCMSubFormat[:])                //subformat GUID
+	}
+
+	// data chunk
+	h.put("data")
+	r.dataSize = h.mark()
+	h.put(int32(0)) //size
+	r.dataStart = h.mark()
+	return h.err
+}
+
+// extended encodes a sample rate as the 80-bit floating point number AIFF
+// stores it as
+func extended(rate int) []byte {
+	b := make([]byte, 10)
+	exponent := 16383 + 63
+	mantissa := uint64(rate)
+	for mantissa&(1<<63) == 0 {
+		mantissa <<= 1
+		exponent--
+	}
+	binary.BigEndian.PutUint16(b, uint16(exponent))
+	binary.BigEndian.PutUint64(b[2:], mantissa)
+	return b
+}
+
+// WriteSamples stores samples in the recording's format
+func (r *Recording) WriteSamples(samples []int32) error {
+	return WriteSamples(r, r.format, samples)
+}
+
+// WriteSamples stores samples at the format's bit depth, keeping the most
+// significant bits of each
+func WriteSamples(w io.Writer, format Format, samples []int32) error {
+	wav := format.Container == "wav"
+	var order binary.ByteOrder = binary.BigEndian
+	if wav {
+		order = binary.LittleEndian
+	}
+
+	if format.BitDepth < 32 && format.Dither != "" && format.Dither != "none" {
+		samples = dither(samples, format.BitDepth, format.Dither == "tpdf")
+	}
+
+	switch format.BitDepth {
+	case 8:
+		out := make([]byte, len(samples))
+		for i, n := range samples {
+			out[i] = byte(n >> 24)
+			if wav {
+				// 8 bit WAV samples are unsigned
+				out[i] += 128
+			}
+		}
+		_, err := w.Write(out)
+		return err
+	case 16:
+		out := make([]int16, len(samples))
+		for i, n := range samples {
+			out[i] = int16(n >> 16)
+		}
+		return binary.Write(w, order, out)
+	case 24:
+		out := make([]byte, 0, 3*len(samples))
+		for _, n := range samples {
+			if wav {
+				out = append(out, byte(n>>8), byte(n>>16), byte(n>>24))
+			} else {
+				out = append(out, byte(n>>24), byte(n>>16), byte(n>>8))
+			}
+		}
+		_, err := w.Write(out)
+		return err
+	default:
+		return binary.Write(w, order, samples)
+	}
+}
+
+// dither adds noise to samples about to be cut to bits and rounds them, so
+// the quantisation error becomes steady noise rather than distortion that
+// follows the signal. Rectangular noise spans one step of the reduced depth,
+// tpdf noise two.
+func dither(samples []int32, bits int, tpdf bool) []int32 {
+	step := float64(int64(1) << uint(32-bits))
+	out := make([]int32, len(samples))
+	for i, n := range samples {
+		noise := rand.Float64() - 0.5
+		if tpdf {
+			noise = rand.Float64() - rand.Float64()
+		}
+		// half a step makes the shift when writing round instead of truncate
+		out[i] = audio.ClampSample(float64(n) + (noise+0.5)*step)
+	}
+	return out
+}
+
+// Close fills in the header for nSamples samples, dropping anything written
+// after them, adds the annotation and closes the writer
+func (r *Recording) Close(nSamples int) error {
+	wav := r.format.Container == "wav"
+	dataEnd := r.dataStart + int64(nSamples*r.format.BitDepth/8)
+
+	// drop anything written past nSamples, such as trimmed silence
+	if t, ok := r.Writer.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(dataEnd); err != nil {
+			return err
+		}
+	}
+
+	// optional chunks follow the sound data, which needs a pad byte to keep
+	// them even aligned when it has an odd length
+	if _, err := r.Seek(dataEnd, io.SeekStart); err != nil {
+		return err
+	}
+	if dataEnd%2 == 1 {
+		if _, err := r.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if r.format.Annotation != "" {
+		var err error
+		if wav {
+			var info bytes.Buffer
+			info.WriteString("INFO")
+			WriteChunk(&info, binary.LittleEndian, "ICMT", append([]byte(r.format.Annotation), 0))
+			_, err = WriteChunk(r, binary.LittleEndian, "LIST", info.Bytes())
+		} else {
+			_, err = WriteChunk(r, binary.BigEndian, "ANNO", []byte(r.format.Annotation))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// fill in missing sizes, the data chunk size also covers any fields
+	// between its size and the samples
+	h := &headerWriter{r: r, order: r.order}
+	end := h.mark()
+	patch := func(offset int64, value int) {
+		if h.err == nil {
+			_, h.err = r.Seek(offset, io.SeekStart)
+		}
+		h.put(int32(value))
+	}
+	patch(r.formSize, int(end-8))
+	if r.frameCount >= 0 {
+		patch(r.frameCount, nSamples/r.format.Channels)
+	}
+	patch(r.dataSize, int(dataEnd-r.dataSize-4))
+	if h.err != nil {
+		r.Writer.Close()
+		return h.err
+	}
+	return r.Writer.Close()
+}
+
+// WriteChunk writes an AIFF or RIFF chunk, padding odd sized data with a zero
+// byte so the next chunk stays even aligned. It returns the number of bytes
+// written.
+func WriteChunk(w io.Writer, order binary.ByteOrder, id string, data []byte) (int, error) {
+	if _, err := w.Write([]byte(id)); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, order, int32(len(data))); err != nil { //size excludes the pad byte
+		return 4, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return 8, err
+	}
+
+	n := 8 + len(data)
+	if len(data)%2 == 1 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
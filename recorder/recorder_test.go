@@ -0,0 +1,151 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// record writes samples to an in-memory recording and returns its bytes
+func record(t *testing.T, format Format, samples []int32) []byte {
+	t.Helper()
+	var b Buffer
+	r, err := New(&b, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WriteSamples(samples); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(len(samples)); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestOddAnnotationIsPadded(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		bitDepth int
+		samples  int
+	}{
+		{"even sound data", 16, 3},
+		{"odd sound data", 8, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			format := Format{Container: "aiff", Channels: 1, SampleRate: 44100, BitDepth: test.bitDepth, Annotation: "odd"}
+			data := record(t, format, make([]int32, test.samples))
+
+			anno := bytes.Index(data, []byte("ANNO"))
+			if anno < 0 {
+				t.Fatal("no ANNO chunk written")
+			}
+			if anno%2 != 0 {
+				t.Errorf("ANNO chunk starts at odd offset %d", anno)
+			}
+			if size := binary.BigEndian.Uint32(data[anno+4:]); size != 3 {
+				t.Errorf("ANNO size is %d, want 3 without the pad byte", size)
+			}
+			if text := string(data[anno+8 : anno+11]); text != "odd" {
+				t.Errorf("ANNO text is %q, want %q", text, "odd")
+			}
+			if len(data) != anno+12 {
+				t.Fatalf("recording is %d bytes, want %d ending with the pad byte", len(data), anno+12)
+			}
+			if pad := data[anno+11]; pad != 0 {
+				t.Errorf("pad byte is %#x, want 0", pad)
+			}
+			if size := binary.BigEndian.Uint32(data[4:]); int(size) != len(data)-8 {
+				t.Errorf("FORM size is %d, want %d counting the pad byte", size, len(data)-8)
+			}
+		})
+	}
+}
+
+func TestTwentyFourBitSamples(t *testing.T) {
+	samples := []int32{0x12345600, -0x100}
+	for _, test := range []struct {
+		container string
+		want      []byte
+	}{
+		{"aiff", []byte{0x12, 0x34, 0x56, 0xff, 0xff, 0xff}},
+		{"wav", []byte{0x56, 0x34, 0x12, 0xff, 0xff, 0xff}},
+	} {
+		t.Run(test.container, func(t *testing.T) {
+			format := Format{Container: test.container, Channels: 1, SampleRate: 44100, BitDepth: 24}
+			data := record(t, format, samples)
+			if !bytes.HasSuffix(data, test.want) {
+				t.Errorf("recording ends % x, want % x", data[len(data)-len(test.want):], test.want)
+			}
+		})
+	}
+}
+
+func TestWAVHeader(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		channels int
+		bitDepth int
+		wantTag  uint16
+		wantMask uint32 // checked for extensible headers only
+	}{
+		{"mono 16 bit", 1, 16, 1, 0},
+		{"stereo 16 bit", 2, 16, 1, 0},
+		{"stereo 8 bit", 2, 8, 1, 0},
+		{"mono 24 bit", 1, 24, 0xFFFE, 0x4},
+		{"stereo 32 bit", 2, 32, 0xFFFE, 0x3},
+		{"four channels", 4, 16, 0xFFFE, 0xF},
+		{"six channels 24 bit", 6, 24, 0xFFFE, 0x3F},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			format := Format{Container: "wav", Channels: test.channels, SampleRate: 48000, BitDepth: test.bitDepth}
+			frames := 3
+			data := record(t, format, make([]int32, frames*test.channels))
+
+			if string(data[12:16]) != "fmt " {
+				t.Fatalf("chunk %q after WAVE, want fmt", data[12:16])
+			}
+			le := binary.LittleEndian
+			size := le.Uint32(data[16:])
+			if tag := le.Uint16(data[20:]); tag != test.wantTag {
+				t.Errorf("format tag %#x, want %#x", tag, test.wantTag)
+			}
+			if channels := le.Uint16(data[22:]); int(channels) != test.channels {
+				t.Errorf("%d channels, want %d", channels, test.channels)
+			}
+			if align := le.Uint16(data[32:]); int(align) != test.channels*test.bitDepth/8 {
+				t.Errorf("block align %d, want %d", align, test.channels*test.bitDepth/8)
+			}
+			if test.wantTag == 0xFFFE {
+				if size != 40 {
+					t.Fatalf("fmt chunk of %d bytes, want 40", size)
+				}
+				if ext := le.Uint16(data[36:]); ext != 22 {
+					t.Errorf("extension of %d bytes, want 22", ext)
+				}
+				if valid := le.Uint16(data[38:]); int(valid) != test.bitDepth {
+					t.Errorf("%d valid bits, want %d", valid, test.bitDepth)
+				}
+				if mask := le.Uint32(data[40:]); mask != test.wantMask {
+					t.Errorf("channel mask %#x, want %#x", mask, test.wantMask)
+				}
+				if !bytes.Equal(data[44:60], PCMSubFormat[:]) {
+					t.Errorf("subformat % x, want PCM", data[44:60])
+				}
+			} else if size != 16 {
+				t.Fatalf("fmt chunk of %d bytes, want 16", size)
+			}
+
+			dataChunk := 20 + int(size)
+			if string(data[dataChunk:dataChunk+4]) != "data" {
+				t.Fatalf("chunk %q after fmt, want data", data[dataChunk:dataChunk+4])
+			}
+			if n := le.Uint32(data[dataChunk+4:]); int(n) != frames*test.channels*test.bitDepth/8 {
+				t.Errorf("data chunk of %d bytes, want %d", n, frames*test.channels*test.bitDepth/8)
+			}
+			if riff := le.Uint32(data[4:]); int(riff) != len(data)-8 {
+				t.Errorf("RIFF size %d, want %d", riff, len(data)-8)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package recorder
+
+import "os"
+
+// Opener creates the destination of a recording by name. Recordings are
+// files unless a program supplies its own Opener, such as one writing to a
+// database blob, which must be able to seek for Close to fill in the
+// header. A destination that cannot seek needs a streamed header instead.
+type Opener func(name string) (Writer, error)
+
+// CreateFile creates or truncates the file name with perm, which the umask
+// limits unless exact is set
+func CreateFile(name string, perm os.FileMode, exact bool) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	if exact {
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// FileOpener is the Opener writing each recording to a file as CreateFile
+// creates it
+func FileOpener(perm os.FileMode, exact bool) Opener {
+	return func(name string) (Writer, error) {
+		return CreateFile(name, perm, exact)
+	}
+}
+
+// Create opens the destination name with open and writes the header of an
+// empty recording to it, closing the destination again if that fails
+func Create(open Opener, name string, format Format) (*Recording, error) {
+	w, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := New(w, format)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,96 @@
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateFileTruncates(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "take.aiff")
+	if err := ioutil.WriteFile(name, []byte("an older, longer recording"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := CreateFile(name, 0640, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("file is %d bytes, want it truncated", info.Size())
+	}
+	if perm := info.Mode().Perm(); perm != 0640 {
+		t.Errorf("file mode is %v, want exactly %v", perm, os.FileMode(0640))
+	}
+}
+
+func TestFileOpenerWritesRecording(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "take.wav")
+	format := Format{Container: "wav", Channels: 2, SampleRate: 44100, BitDepth: 16}
+	r, err := Create(FileOpener(0666, false), name, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := []int32{1 << 16, -1 << 16, 2 << 16, -2 << 16}
+	if err := r.WriteSamples(samples); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(len(samples)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := record(t, format, samples)
+	if !bytes.Equal(got, want) {
+		t.Errorf("file holds % x, want % x", got, want)
+	}
+}
+
+// failingWriter fails every write, counting how often it is closed
+type failingWriter struct {
+	Buffer
+	closed int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (w *failingWriter) Close() error {
+	w.closed++
+	return nil
+}
+
+func TestCreateClosesOnHeaderError(t *testing.T) {
+	w := &failingWriter{}
+	open := func(name string) (Writer, error) {
+		return w, nil
+	}
+	if _, err := Create(open, "blob", Format{Container: "aiff", Channels: 1, SampleRate: 44100, BitDepth: 16}); err == nil {
+		t.Fatal("Create succeeded writing to a failing destination")
+	}
+	if w.closed != 1 {
+		t.Errorf("destination closed %d times, want once", w.closed)
+	}
+}
+
+func TestCreateReturnsOpenError(t *testing.T) {
+	want := errors.New("no such blob")
+	open := func(name string) (Writer, error) {
+		return nil, want
+	}
+	if _, err := Create(open, "blob", Format{Container: "aiff", Channels: 1, SampleRate: 44100, BitDepth: 16}); err != want {
+		t.Errorf("Create returned %v, want %v", err, want)
+	}
+}
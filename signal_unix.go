@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyMarker relays SIGHUP, which marker mode treats as a split
+func notifyMarker(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// notifyMarker does nothing as Windows has no SIGHUP; use the marker FIFO
+// setting instead
+func notifyMarker(c chan<- os.Signal) {}
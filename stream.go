@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/1hitsong/Go-Record-Audio/audio"
+	"github.com/gordonklaus/portaudio"
+)
+
+// broadcast streams to Icecast without recording any files
+func broadcast(input *streamReader, dsp *audio.Processing, ice *icecastStream, ch chan string, sig chan os.Signal) {
+	for {
+		select {
+		case stdin, ok := <-ch:
+			if !ok {
+				ch = nil
+			} else if isKey(stdin, cfg.Keys.Stop) {
+				input.close()
+				portaudio.Terminate()
+				return
+			}
+
+		case buf, ok := <-input.buffers:
+			in := buf.samples
+			if !ok && input.err == io.EOF {
+				return
+			} else if !ok {
+				chk(input.err)
+			}
+			buf.process(dsp)
+			live.send(in)
+			ice.write(in)
+
+		case <-sig:
+			return
+		}
+	}
+}
+
+// pipeSamples writes the processed audio to w as raw PCM in the given format
+// instead of recording files
+func pipeSamples(input *streamReader, dsp *audio.Processing, ch chan string, sig chan os.Signal, w *bufio.Writer, format sampleFormat) {
+	defer w.Flush()
+
+	var out []byte
+	if cfg.SyncTone.Enabled {
+		out = format.encode(out, syncTone())
+		if _, err := w.Write(out); err != nil {
+			log.Println("[Pipe] ", err)
+			return
+		}
+	}
+	for {
+		select {
+		case stdin, ok := <-ch:
+			if !ok {
+				ch = nil
+			} else if isKey(stdin, cfg.Keys.Stop) {
+				input.close()
+				portaudio.Terminate()
+				return
+			}
+
+		case buf, ok := <-input.buffers:
+			in := buf.samples
+			if !ok && input.err == io.EOF {
+				return
+			} else if !ok {
+				chk(input.err)
+			}
+			buf.process(dsp)
+			live.send(in)
+
+			out = format.encode(out[:0], in)
+			if _, err := w.Write(out); err != nil {
+				// the reader went away, as when a pipe is closed
+				log.Println("[Pipe] ", err)
+				return
+			}
+
+		case <-sig:
+			return
+		}
+	}
+}
+
+// isNamedPipe reports whether name is an existing FIFO
+func isNamedPipe(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// openPipe opens a named pipe for writing, waiting for another process to
+// open it for reading, and writes the pipe header
+func openPipe(name string) (*os.File, error) {
+	format, _ := parseSampleFormat(cfg.Output.SampleFormat)
+	var header []byte
+	if cfg.Output.PipeHeader == "wav" {
+		var err error
+		if header, err = streamingWAVHeader(format); err != nil {
+			return nil, err
+		}
+	}
+
+	say("Waiting for a reader on", name)
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	say("Streaming to", name)
+	return f, nil
+}
+
+// streamingWAVHeader heads a WAV stream of unknown length, giving the
+// largest sizes as ffmpeg and sox do when writing WAV to a pipe
+func streamingWAVHeader(format sampleFormat) ([]byte, error) {
+	if format.order == binary.BigEndian || (format.bits == 8) != format.unsigned {
+		return nil, fmt.Errorf("a WAV pipe header needs little endian samples, or u8, not %s", cfg.Output.SampleFormat)
+	}
+	tag := uint16(1) // PCM
+	if format.float {
+		tag = 3 // IEEE float
+	}
+	blockAlign := format.bits / 8 * cfg.Input.Channels
+
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(0xFFFFFFFF))
+	b.WriteString("WAVEfmt ")
+	for _, v := range []interface{}{
+		uint32(16), tag, uint16(cfg.Input.Channels), uint32(sampleRate),
+		uint32(sampleRate * blockAlign), uint16(blockAlign), uint16(format.bits),
+	} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(0xFFFFFFFF))
+	return b.Bytes(), nil
+}
+
+// sampleFormat is a raw PCM sample layout, named as ffmpeg and sox name them
+type sampleFormat struct {
+	bits     int
+	float    bool
+	unsigned bool
+	order    binary.ByteOrder
+}
+
+// parseSampleFormat reads names like s16le, s24be, f32le and u8
+func parseSampleFormat(name string) (sampleFormat, error) {
+	m := regexp.MustCompile(`^([suf])(8|16|24|32)(le|be)?$`).FindStringSubmatch(name)
+	if m == nil {
+		return sampleFormat{}, fmt.Errorf("unknown sample format %q", name)
+	}
+
+	f := sampleFormat{float: m[1] == "f", unsigned: m[1] == "u", order: binary.LittleEndian}
+	f.bits, _ = strconv.Atoi(m[2])
+	if m[3] == "be" {
+		f.order = binary.BigEndian
+	}
+	if (f.float && f.bits != 32) || (f.bits > 8 && m[3] == "") || (f.bits == 8 && m[3] != "") {
+		return sampleFormat{}, fmt.Errorf("unknown sample format %q", name)
+	}
+	return f, nil
+}
+
+// encode appends samples to dst in the format
+func (f sampleFormat) encode(dst []byte, samples []int32) []byte {
+	var b [4]byte
+	size := f.bits / 8
+	for _, n := range samples {
+		var v uint32
+		switch {
+		case f.float:
+			v = math.Float32bits(float32(float64(n) / -math.MinInt32))
+		case f.unsigned:
+			v = uint32(n) ^ 0x80000000
+		default:
+			v = uint32(n)
+		}
+
+		// keep the most significant bytes of the 32 bit sample
+		f.order.PutUint32(b[:], v)
+		if f.float || f.order == binary.BigEndian {
+			dst = append(dst, b[:size]...)
+		} else {
+			dst = append(dst, b[4-size:]...)
+		}
+	}
+	return dst
+}
+
+// icecastQueue is how many buffers, about a second and a half of audio,
+// wait for the Icecast encoder before further ones are dropped
+const icecastQueue = 1024
+
+// icecastStream encodes live samples by piping them through lame or ffmpeg
+// and sends what it produces to an Icecast mount over a source connection.
+// Buffers are queued for the encoder so a slow encoder or server never
+// holds up recording.
+type icecastStream struct {
+	cmd    *exec.Cmd
+	pcm    io.WriteCloser
+	conn   net.Conn
+	queue  chan []byte
+	done   chan struct{}
+	failed int32
+
+	// dropped counts buffers dropped from a full queue since the last warning
+	dropped int
+	warned  time.Time
+}
+
+// icecastEncoder is the command encoding 16 bit little endian PCM on stdin
+// to the stream's format on stdout
+func icecastEncoder() []string {
+	bitrate := cfg.Encode.Bitrate
+	if cfg.Icecast.Format != "mp3" {
+		args := []string{"ffmpeg", "-nostdin", "-loglevel", "error", "-f", "s16le", "-ar", strconv.Itoa(sampleRate),
+			"-ac", strconv.Itoa(cfg.Input.Channels), "-i", "pipe:0"}
+		if cfg.Icecast.Format == "opus" {
+			// Opus only runs at 48 kHz and a few lower rates
+			args = append(args, "-c:a", "libopus", "-ar", "48000")
+		} else {
+			args = append(args, "-c:a", "libvorbis")
+		}
+		return append(args, "-b:a", bitrate+"k", "-f", "ogg", "pipe:1")
+	}
+	mode := "m"
+	if cfg.Input.Channels > 1 {
+		mode = "j"
+	}
+	return []string{"lame", "-r", "-s", "44.1", "--bitwidth", "16", "--signed", "--little-endian",
+		"-m", mode, "-b", bitrate, "-", "-"}
+}
+
+// startIcecast connects to the mount with a PUT request, as Icecast 2.4
+// accepts, and starts the encoder feeding it
+func startIcecast() (*icecastStream, error) {
+	u, err := url.Parse(strings.TrimSuffix(cfg.Icecast.URL, "/") + cfg.Icecast.Mount)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var conn net.Conn
+	if u.Scheme == "https" {
+		conn, err = tls.Dial("tcp", host, nil)
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("icecast: %v", err)
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(cfg.Icecast.User + ":" + cfg.Icecast.Password))
+	contentType := "audio/mpeg"
+	if cfg.Icecast.Format != "mp3" {
+		contentType = "audio/ogg"
+	}
+	fmt.Fprintf(conn, "PUT %s HTTP/1.1\r\nHost: %s\r\nAuthorization: Basic %s\r\nContent-Type: %s\r\nIce-Public: 0\r\nUser-Agent: Go-Record-Audio\r\n\r\n",
+		u.RequestURI(), u.Host, auth, contentType)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("icecast: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("icecast: %s refused the stream: %s", u, resp.Status)
+	}
+
+	args := icecastEncoder()
+	cmd := exec.Command(args[0], args[1:]...)
+	pcm, err := cmd.StdinPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cmd.Stdout = conn
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("icecast: %v", err)
+	}
+
+	say("Streaming to", u)
+	s := &icecastStream{cmd: cmd, pcm: pcm, conn: conn, queue: make(chan []byte, icecastQueue), done: make(chan struct{})}
+	go s.feed()
+	return s, nil
+}
+
+// feed writes the queued buffers to the encoder. A failed stream is logged
+// once and then ignored so recording carries on.
+func (s *icecastStream) feed() {
+	defer close(s.done)
+	for pcm := range s.queue {
+		if _, err := s.pcm.Write(pcm); err != nil {
+			log.Println("[Icecast] stream stopped:", err)
+			atomic.StoreInt32(&s.failed, 1)
+			return
+		}
+	}
+}
+
+// write queues a buffer for the encoder as 16 bit PCM, dropping it with a
+// warning when the encoder has fallen so far behind that the queue is full
+func (s *icecastStream) write(in []int32) {
+	if atomic.LoadInt32(&s.failed) == 1 {
+		return
+	}
+
+	out := make([]byte, 2*len(in))
+	for i, n := range in {
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(n>>16))
+	}
+	select {
+	case s.queue <- out:
+	default:
+		s.dropped++
+		if time.Since(s.warned) > 10*time.Second {
+			log.Printf("[Icecast] the encoder or server is falling behind, %d buffers of live audio dropped", s.dropped)
+			s.dropped = 0
+			s.warned = time.Now()
+		}
+	}
+}
+
+func (s *icecastStream) close() {
+	close(s.queue)
+	<-s.done
+	s.pcm.Close()
+	if err := s.cmd.Wait(); err != nil && atomic.LoadInt32(&s.failed) == 0 {
+		log.Println("[Icecast] ", err)
+	}
+	s.conn.Close()
+}
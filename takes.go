@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// takes holds the take number of each recording made in take mode
+var takes sync.Map
+
+// nextTake names the next take of the piece, numbered after any takes
+// already recorded or encoded, and remembers its number for tagging
+func nextTake() string {
+	fileName, n := nextRecordingName(cfg.Take.Name+" - Take ", 1)
+	takes.Store(fileName, n)
+	say(fmt.Sprintf("Take %d of %s", n, cfg.Take.Name))
+	return fileName
+}
+
+// takeNumber is the take a recording is, when it was made in take mode
+func takeNumber(recording string) (int, bool) {
+	if v, ok := takes.Load(recording); ok {
+		return v.(int), true
+	}
+	return 0, false
+}
+
+// albumFor is the album a recording is tagged with, the piece's name for
+// takes when no album is configured
+func albumFor(recording string) string {
+	if _, ok := takeNumber(recording); ok && cfg.Tags.Album == "" {
+		return cfg.Take.Name
+	}
+	return cfg.Tags.Album
+}
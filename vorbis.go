@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// vorbisVendor names the program writing Vorbis comments when the file had
+// none to keep
+const vorbisVendor = "Go-Record-Audio"
+
+// vorbisComments are the tags as Vorbis comment fields. The cover is a
+// METADATA_BLOCK_PICTURE field as Ogg files carry it; FLAC files hold it in
+// a picture block instead.
+func vorbisComments(t fileTags, cover bool) []string {
+	var fields []string
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+value)
+		}
+	}
+	add("ARTIST", t.artist)
+	add("TITLE", t.title)
+	add("ALBUM", t.album)
+	add("ALBUMARTIST", t.albumArtist)
+	add("COMPOSER", t.composer)
+	if t.track > 0 {
+		add("TRACKNUMBER", strconv.Itoa(t.track))
+	}
+	if t.trackTotal > 0 {
+		add("TRACKTOTAL", strconv.Itoa(t.trackTotal))
+	}
+	add("LOCATION", t.location)
+	add("COMMENT", t.comment)
+	add("PROVENANCE", t.provenance)
+	if cover && t.cover != nil {
+		add("METADATA_BLOCK_PICTURE", base64.StdEncoding.EncodeToString(flacPicture(t.cover)))
+	}
+	return fields
+}
+
+// commentBody encodes Vorbis comment fields after the vendor string, as FLAC
+// stores them and Ogg headers hold them after their magic
+func commentBody(vendor string, fields []string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(len(vendor)))
+	b.WriteString(vendor)
+	binary.Write(&b, binary.LittleEndian, uint32(len(fields)))
+	for _, field := range fields {
+		binary.Write(&b, binary.LittleEndian, uint32(len(field)))
+		b.WriteString(field)
+	}
+	return b.Bytes()
+}
+
+// commentVendor reads the vendor string of a Vorbis comment body, or the
+// default one when it cannot be read
+func commentVendor(body []byte) string {
+	if len(body) < 4 {
+		return vorbisVendor
+	}
+	n := binary.LittleEndian.Uint32(body)
+	if uint64(n) > uint64(len(body)-4) {
+		return vorbisVendor
+	}
+	return string(body[4 : 4+n])
+}
+
+// flacPicture encodes an image as a front cover picture block, the form
+// Ogg files also carry it in
+func flacPicture(img []byte) []byte {
+	mime := http.DetectContentType(img)
+	size, _, _ := image.DecodeConfig(bytes.NewReader(img))
+
+	var b bytes.Buffer
+	for _, v := range []interface{}{uint32(3), uint32(len(mime)), []byte(mime), uint32(0),
+		uint32(size.Width), uint32(size.Height), uint32(0), uint32(0), uint32(len(img)), img} {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	return b.Bytes()
+}
+
+// FLAC metadata block types retag reads or writes
+const (
+	flacPadding       = 1
+	flacVorbisComment = 4
+	flacPictureBlock  = 6
+)
+
+// flacBlock is a FLAC metadata block
+type flacBlock struct {
+	kind byte
+	body []byte
+}
+
+// writeFLACTags copies a FLAC file to w with its Vorbis comments, pictures
+// and padding replaced by the tags
+func writeFLACTags(src io.Reader, w io.Writer, t fileTags) error {
+	var magic [4]byte
+	if _, err := io.ReadFull(src, magic[:]); err != nil || string(magic[:]) != "fLaC" {
+		return errors.New("not a FLAC file")
+	}
+
+	var blocks []flacBlock
+	vendor := vorbisVendor
+	for last := false; !last; {
+		var header [4]byte
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			return fmt.Errorf("reading metadata: %v", err)
+		}
+		last = header[0]&0x80 != 0
+		block := flacBlock{kind: header[0] & 0x7f}
+		block.body = make([]byte, int(header[1])<<16|int(header[2])<<8|int(header[3]))
+		if _, err := io.ReadFull(src, block.body); err != nil {
+			return fmt.Errorf("reading metadata: %v", err)
+		}
+		switch block.kind {
+		case flacVorbisComment:
+			vendor = commentVendor(block.body)
+		case flacPadding, flacPictureBlock:
+		default:
+			blocks = append(blocks, block)
+		}
+	}
+	blocks = append(blocks, flacBlock{flacVorbisComment, commentBody(vendor, vorbisComments(t, false))})
+	if t.cover != nil {
+		blocks = append(blocks, flacBlock{flacPictureBlock, flacPicture(t.cover)})
+	}
+
+	if _, err := w.Write(magic[:]); err != nil {
+		return err
+	}
+	for i, block := range blocks {
+		size := len(block.body)
+		if size >= 1<<24 {
+			return fmt.Errorf("a metadata block of %d bytes is too large for FLAC", size)
+		}
+		kind := block.kind
+		if i == len(blocks)-1 {
+			kind |= 0x80
+		}
+		if _, err := w.Write([]byte{kind, byte(size >> 16), byte(size >> 8), byte(size)}); err != nil {
+			return err
+		}
+		if _, err := w.Write(block.body); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(w, src)
+	return err
+}
+
+// oggPage is a page of an Ogg stream
+type oggPage struct {
+	flags    byte
+	granule  uint64
+	serial   uint32
+	sequence uint32
+	lacing   []byte
+	data     []byte
+}
+
+// oggContinued flags a page that starts partway through a packet
+const oggContinued = 1
+
+// readOggPage reads the next page of an Ogg stream
+func readOggPage(r io.Reader) (*oggPage, error) {
+	var header [27]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "OggS" {
+		return nil, errors.New("not an Ogg page")
+	}
+	p := &oggPage{
+		flags:    header[5],
+		granule:  binary.LittleEndian.Uint64(header[6:]),
+		serial:   binary.LittleEndian.Uint32(header[14:]),
+		sequence: binary.LittleEndian.Uint32(header[18:]),
+		lacing:   make([]byte, header[26]),
+	}
+	if _, err := io.ReadFull(r, p.lacing); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size := 0
+	for _, n := range p.lacing {
+		size += int(n)
+	}
+	p.data = make([]byte, size)
+	if _, err := io.ReadFull(r, p.data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return p, nil
+}
+
+// write writes the page with its checksum worked out afresh
+func (p *oggPage) write(w io.Writer) error {
+	b := make([]byte, 27, 27+len(p.lacing)+len(p.data))
+	copy(b, "OggS")
+	b[5] = p.flags
+	binary.LittleEndian.PutUint64(b[6:], p.granule)
+	binary.LittleEndian.PutUint32(b[14:], p.serial)
+	binary.LittleEndian.PutUint32(b[18:], p.sequence)
+	b[26] = byte(len(p.lacing))
+	b = append(append(b, p.lacing...), p.data...)
+	binary.LittleEndian.PutUint32(b[22:], oggCRC(b))
+	_, err := w.Write(b)
+	return err
+}
+
+// oggCRCTable drives the unreflected CRC-32 Ogg pages are checksummed with
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func oggCRC(b []byte) uint32 {
+	var crc uint32
+	for _, c := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^c]
+	}
+	return crc
+}
+
+// oggPages splits a header packet into pages of the stream numbered from
+// sequence, the last ending the packet
+func oggPages(packet []byte, serial, sequence uint32) []*oggPage {
+	lacing := bytes.Repeat([]byte{255}, len(packet)/255)
+	lacing = append(lacing, byte(len(packet)%255))
+
+	var pages []*oggPage
+	for len(lacing) > 0 {
+		n := len(lacing)
+		if n > 255 {
+			n = 255
+		}
+		size := 0
+		for _, l := range lacing[:n] {
+			size += int(l)
+		}
+		// a page on which no packet ends has no granule position
+		p := &oggPage{granule: ^uint64(0), serial: serial, sequence: sequence, lacing: lacing[:n], data: packet[:size]}
+		if len(pages) > 0 {
+			p.flags = oggContinued
+		}
+		if n == len(lacing) {
+			p.granule = 0
+		}
+		pages = append(pages, p)
+		lacing, packet = lacing[n:], packet[size:]
+		sequence++
+	}
+	return pages
+}
+
+// writeOggTags copies an Ogg Vorbis or Opus file to w with the comment
+// header replaced by the tags. The header packets are laid out on pages of
+// their own again and every later page of the stream is renumbered.
+func writeOggTags(src io.Reader, w io.Writer, t fileTags) error {
+	first, err := readOggPage(src)
+	if err != nil {
+		return err
+	}
+	magic, headers := "", 0
+	switch {
+	case bytes.HasPrefix(first.data, []byte("OpusHead")):
+		magic, headers = "OpusTags", 2
+	case bytes.HasPrefix(first.data, []byte("\x01vorbis")):
+		magic, headers = "\x03vorbis", 3
+	default:
+		return errors.New("not an Ogg Vorbis or Opus file")
+	}
+
+	// gather the header packets after the identification header, which has
+	// the first page to itself
+	var packets [][]byte
+	var packet []byte
+	for len(packets) < headers-1 {
+		p, err := readOggPage(src)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("reading headers: %v", err)
+		}
+		data := p.data
+		for _, n := range p.lacing {
+			packet, data = append(packet, data[:n]...), data[n:]
+			if n < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+	if len(packets) != headers-1 || packet != nil {
+		return errors.New("audio shares a page with the headers")
+	}
+
+	comments := packets[0]
+	if !bytes.HasPrefix(comments, []byte(magic)) {
+		return errors.New("no comment header")
+	}
+	packets[0] = append([]byte(magic), commentBody(commentVendor(comments[len(magic):]), vorbisComments(t, true))...)
+	if magic == "\x03vorbis" {
+		packets[0] = append(packets[0], 1) // framing bit
+	}
+
+	if err := first.write(w); err != nil {
+		return err
+	}
+	sequence := first.sequence + 1
+	for _, packet := range packets {
+		for _, p := range oggPages(packet, first.serial, sequence) {
+			if err := p.write(w); err != nil {
+				return err
+			}
+			sequence++
+		}
+	}
+
+	for {
+		p, err := readOggPage(src)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p.serial == first.serial {
+			p.sequence = sequence
+			sequence++
+		}
+		if err := p.write(w); err != nil {
+			return err
+		}
+	}
+}